@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var catFrom string
+
+var catCmd = &cobra.Command{
+	Use:   "cat <service> <backup|latest> <path>",
+	Short: "Write a single file from a backup to stdout",
+	Long: `Write the contents of one file stored in a backup to stdout, without
+restoring anything to the service directory.
+
+The path is relative to the service directory, as shown by "packrat ls".`,
+	Example: `  packrat cat gitea latest custom/conf/app.ini
+  packrat cat gitea gitea-2024-01-02T02-00-00Z.enc data/gitea.db > gitea.db`,
+	Args: cobra.ExactArgs(3),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		serviceName := args[0]
+
+		manager, err := createManager()
+		if err != nil {
+			return fmt.Errorf("failed to create backup manager: %w", err)
+		}
+		defer manager.Close()
+
+		selected, err := resolveBackup(manager, serviceName, args[1], catFrom)
+		if err != nil {
+			return err
+		}
+
+		out := bufio.NewWriter(os.Stdout)
+		if err := manager.CatBackupFile(serviceName, selected.Name, args[2], selected.source, out); err != nil {
+			return err
+		}
+		return out.Flush()
+	},
+}
+
+func init() {
+	catCmd.Flags().StringVar(&catFrom, "from", "", "Only read from this destination (synology or s3)")
+	rootCmd.AddCommand(catCmd)
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 
+	"github.com/logandonley/packrat/pkg/cmd"
 	"github.com/spf13/cobra"
 )
 
@@ -20,19 +21,12 @@ The number of backups to retain can be configured:
 Service-specific settings override the global setting.`,
 	Args: cobra.MaximumNArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
-		manager, err := createManager()
-		if err != nil {
-			return fmt.Errorf("failed to create backup manager: %w", err)
-		}
-		defer manager.Close()
-
 		var serviceName string
 		if len(args) > 0 {
 			serviceName = args[0]
 		}
 
-		// Run cleanup
-		deletedCounts, err := manager.CleanupBackups(serviceName)
+		deletedCounts, err := cleanupBackups(serviceName)
 		if err != nil {
 			return fmt.Errorf("failed to clean up backups: %w", err)
 		}
@@ -63,6 +57,24 @@ Service-specific settings override the global setting.`,
 	},
 }
 
+// cleanupBackups cleans up through the daemon if it's running, or standalone otherwise
+func cleanupBackups(serviceName string) (map[string]int, error) {
+	client, err := cmd.DaemonClient()
+	if err != nil {
+		return nil, err
+	}
+	if client != nil {
+		return client.Cleanup(serviceName)
+	}
+
+	manager, err := createManager()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create backup manager: %w", err)
+	}
+	defer manager.Close()
+	return manager.CleanupBackups(serviceName)
+}
+
 func init() {
 	rootCmd.AddCommand(cleanupCmd)
 }
@@ -5,6 +5,7 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
 	"syscall"
 
 	"github.com/logandonley/packrat/pkg/backup"
@@ -83,10 +84,15 @@ func validateConfiguration(manager *backup.Manager) error {
 		fmt.Printf("\n📁 Validating service: %s\n", name)
 
 		// Validate service path
-		if err := validateDirectory(service.Path, false); err != nil {
-			return fmt.Errorf("service %s path validation failed: %w", name, err)
+		if service.Path == "" && (service.Docker == nil || len(service.Docker.Volumes) == 0) {
+			return fmt.Errorf("service %s has neither a path nor Docker volumes", name)
+		}
+		if service.Path != "" {
+			if err := validateDirectory(service.Path, false); err != nil {
+				return fmt.Errorf("service %s path validation failed: %w", name, err)
+			}
+			fmt.Printf("✅ Service path %s is accessible\n", service.Path)
 		}
-		fmt.Printf("✅ Service path %s is accessible\n", service.Path)
 
 		// Validate schedule if specified
 		if service.Schedule != "" {
@@ -98,10 +104,58 @@ func validateConfiguration(manager *backup.Manager) error {
 
 		// Validate Docker container if specified
 		if service.Docker != nil {
-			if err := validateDockerContainer(manager, service.Docker.Container); err != nil {
+			containers, err := manager.ServiceContainers(service.Docker)
+			if err != nil {
 				return fmt.Errorf("service %s Docker validation failed: %w", name, err)
 			}
-			fmt.Printf("✅ Docker container %s is accessible\n", service.Docker.Container)
+			if len(containers) > 0 {
+				fmt.Printf("✅ Docker container(s) %s are accessible\n", strings.Join(containers, ", "))
+			}
+			if err := manager.ValidateVolumes(service.Docker); err != nil {
+				return fmt.Errorf("service %s volume validation failed: %w", name, err)
+			}
+			if len(service.Docker.Volumes) > 0 {
+				fmt.Printf("✅ Docker volume(s) %s are accessible\n", strings.Join(service.Docker.Volumes, ", "))
+			}
+		}
+
+		// Validate containers that hooks run in
+		for _, hook := range service.Hooks() {
+			if hook.Command.ExecIn == "" {
+				continue
+			}
+			containerName := hook.Command.ExecIn
+			if backup.IsOwnContainer(containerName) {
+				if service.Docker == nil {
+					return fmt.Errorf("service %s %s hook runs in its container, but the service has no docker section", name, hook.Name)
+				}
+				containerName = service.Docker.Container
+			}
+			if err := validateDockerContainer(manager, containerName); err != nil {
+				return fmt.Errorf("service %s %s hook validation failed: %w", name, hook.Name, err)
+			}
+			fmt.Printf("✅ %s hook container %s is accessible\n", hook.Name, containerName)
+		}
+
+		// Validate containers that dumps run in
+		for _, dump := range service.Dumps {
+			containerName := dump.Container
+			if containerName == "" {
+				containerName = dump.ExecIn
+			}
+			if containerName == "" {
+				continue
+			}
+			if backup.IsOwnContainer(containerName) {
+				if service.Docker == nil {
+					return fmt.Errorf("service %s dump %s runs in its container, but the service has no docker section", name, dump.Name)
+				}
+				containerName = service.Docker.Container
+			}
+			if err := validateDockerContainer(manager, containerName); err != nil {
+				return fmt.Errorf("service %s dump %s validation failed: %w", name, dump.Name, err)
+			}
+			fmt.Printf("✅ Dump %s container %s is accessible\n", dump.Name, containerName)
 		}
 	}
 
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+
+	"github.com/logandonley/packrat/pkg/backup"
+)
+
+var (
+	diffLive bool
+	diffFrom string
+)
+
+var diffCmd = &cobra.Command{
+	Use:   "diff <service> <backup|latest> [<backup>|--live]",
+	Short: "Show what changed between two backups, or since a backup",
+	Long: `List the files added, removed and modified between two backups of a service,
+or between a backup and the live service directory with --live.
+
+Files are compared by content hash. Backups with a manifest are compared without
+downloading them; older backups are downloaded and hashed. With --live, the
+service's exclude patterns are honored.`,
+	Example: `  packrat diff gitea latest --live
+  packrat diff gitea gitea-2024-01-01T02-00-00Z.enc gitea-2024-01-02T02-00-00Z.enc`,
+	Args: cobra.RangeArgs(2, 3),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		serviceName := args[0]
+		if diffLive == (len(args) == 3) {
+			return fmt.Errorf("give either a second backup or --live")
+		}
+
+		manager, err := createManager()
+		if err != nil {
+			return fmt.Errorf("failed to create backup manager: %w", err)
+		}
+		defer manager.Close()
+
+		oldBackup, err := resolveBackup(manager, serviceName, args[1], diffFrom)
+		if err != nil {
+			return err
+		}
+
+		var changes []backup.Change
+		if diffLive {
+			fmt.Printf("Comparing %s with %s\n\n", oldBackup.Name, manager.GetServices()[serviceName].Path)
+			changes, err = manager.DiffLive(serviceName, oldBackup.Name, oldBackup.source)
+		} else {
+			newBackup, rerr := resolveBackup(manager, serviceName, args[2], diffFrom)
+			if rerr != nil {
+				return rerr
+			}
+			fmt.Printf("Comparing %s with %s\n\n", oldBackup.Name, newBackup.Name)
+			changes, err = manager.DiffBackups(serviceName, oldBackup.Name, newBackup.Name, diffFrom)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to compare: %w", err)
+		}
+
+		counts := make(map[backup.ChangeKind]int)
+		for _, c := range changes {
+			counts[c.Kind]++
+			printChange(c)
+		}
+
+		if len(changes) == 0 {
+			fmt.Println("No differences")
+			return nil
+		}
+		fmt.Printf("\n%d added, %d removed, %d modified\n", counts[backup.Added], counts[backup.Removed], counts[backup.Modified])
+		return nil
+	},
+}
+
+// printChange prints one line per changed path, with size and mtime deltas for modifications
+func printChange(c backup.Change) {
+	name := c.Name
+	if (c.New != nil && c.New.IsDir()) || (c.Old != nil && c.Old.IsDir()) {
+		name += "/"
+	}
+
+	switch c.Kind {
+	case backup.Added:
+		fmt.Printf("A %s (%s)\n", name, humanize.Bytes(uint64(c.New.Size)))
+	case backup.Removed:
+		fmt.Printf("D %s (%s)\n", name, humanize.Bytes(uint64(c.Old.Size)))
+	case backup.Modified:
+		details := fmt.Sprintf("%s, %s → %s", formatSizeDelta(c.New.Size-c.Old.Size),
+			humanize.Bytes(uint64(c.Old.Size)), humanize.Bytes(uint64(c.New.Size)))
+		if delta := c.New.ModTime.Sub(c.Old.ModTime).Round(time.Second); delta > 0 {
+			details += fmt.Sprintf(", mtime +%s", delta)
+		} else if delta < 0 {
+			details += fmt.Sprintf(", mtime %s", delta)
+		}
+		if c.Old.Mode != c.New.Mode {
+			details += fmt.Sprintf(", mode %s → %s", c.Old.Mode, c.New.Mode)
+		}
+		fmt.Printf("M %s (%s)\n", name, details)
+	}
+}
+
+func formatSizeDelta(delta int64) string {
+	if delta < 0 {
+		return "-" + humanize.Bytes(uint64(-delta))
+	}
+	return "+" + humanize.Bytes(uint64(delta))
+}
+
+func init() {
+	diffCmd.Flags().BoolVar(&diffLive, "live", false, "Compare the backup with the live service directory")
+	diffCmd.Flags().StringVar(&diffFrom, "from", "", "Only read from this destination (synology or s3)")
+	rootCmd.AddCommand(diffCmd)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/logandonley/packrat/pkg/backup"
+	"github.com/logandonley/packrat/pkg/config"
+)
+
+var (
+	historySince string
+	historyJSON  bool
+)
+
+var historyCmd = &cobra.Command{
+	Use:   "history [service]",
+	Short: "Show past backups and restores",
+	Long: `Show the backups and restores packrat has run on this host, oldest first,
+whether started by the daemon or by hand. Each job lists when it ran, how long it
+took, the size of the backup and how it ended.
+
+--since takes a duration (24h, 7d) or a date (2024-01-02, or RFC 3339).`,
+	Example: `  packrat history
+  packrat history gitea --since 7d
+  packrat history --json`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var serviceName string
+		if len(args) > 0 {
+			serviceName = args[0]
+		}
+		var since time.Time
+		if historySince != "" {
+			var err error
+			if since, err = parseSince(historySince, time.Now()); err != nil {
+				return err
+			}
+		}
+
+		var cfg config.Config
+		if err := viper.Unmarshal(&cfg); err != nil {
+			return fmt.Errorf("failed to load configuration: %w", err)
+		}
+		stateDir, err := cfg.StateDirectory()
+		if err != nil {
+			return err
+		}
+		entries, err := backup.ReadHistory(stateDir, serviceName, since)
+		if err != nil {
+			return err
+		}
+
+		if historyJSON {
+			if entries == nil {
+				entries = []backup.HistoryEntry{}
+			}
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(entries)
+		}
+
+		if len(entries) == 0 {
+			fmt.Println("No jobs recorded")
+			return nil
+		}
+		fmt.Printf("%-16s  %-20s  %-9s  %-7s  %-8s  %-9s  %s\n", "STARTED", "SERVICE", "OPERATION", "TRIGGER", "DURATION", "SIZE", "RESULT")
+		for _, e := range entries {
+			size := ""
+			if e.Size > 0 {
+				size = humanize.Bytes(uint64(e.Size))
+			}
+			duration := time.Duration(e.Duration * float64(time.Second)).Round(time.Second)
+			fmt.Printf("%-16s  %-20s  %-9s  %-7s  %-8s  %-9s  %s\n",
+				e.Started.Local().Format("2006-01-02 15:04"), e.Service, e.Operation, e.Trigger, duration, size, historyResult(e))
+		}
+
+		if serviceName != "" {
+			for i := len(entries) - 1; i >= 0; i-- {
+				if e := entries[i]; e.Operation == "backup" && e.Succeeded() {
+					fmt.Printf("\nLast successful backup of %s: %s (%s)\n", serviceName, e.Backup, humanize.Time(e.Finished))
+					break
+				}
+			}
+		}
+		return nil
+	},
+}
+
+// historyResult describes how a job ended
+func historyResult(e backup.HistoryEntry) string {
+	if e.Succeeded() {
+		return "ok"
+	}
+	return "failed: " + strings.ReplaceAll(e.Error, "\n", "; ")
+}
+
+// parseSince parses a --since value: a duration before now, with d for days,
+// or a date
+func parseSince(value string, now time.Time) (time.Time, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		if n, err := strconv.Atoi(days); err == nil && n >= 0 {
+			return now.AddDate(0, 0, -n), nil
+		}
+	}
+	if d, err := time.ParseDuration(value); err == nil && d >= 0 {
+		return now.Add(-d), nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid --since %q: use a duration like 24h or 7d, or a date like 2024-01-02", value)
+}
+
+func init() {
+	historyCmd.Flags().StringVar(&historySince, "since", "", "Only show jobs started since this duration ago or date")
+	historyCmd.Flags().BoolVar(&historyJSON, "json", false, "Print the jobs as JSON")
+	rootCmd.AddCommand(historyCmd)
+}
@@ -8,6 +8,7 @@ import (
 	"github.com/dustin/go-humanize"
 	"github.com/spf13/cobra"
 
+	"github.com/logandonley/packrat/pkg/backup"
 	"github.com/logandonley/packrat/pkg/storage"
 )
 
@@ -21,10 +22,11 @@ func getServiceBackupInfo(store storage.Storage, serviceName string) (backupInfo
 		return backupInfo{}, nil
 	}
 
-	backups, err := store.List(serviceName + "-")
+	files, err := store.List(serviceName + "-")
 	if err != nil {
 		return backupInfo{}, err
 	}
+	backups := backup.BackupFiles(files)
 
 	if len(backups) == 0 {
 		return backupInfo{}, nil
@@ -58,7 +60,7 @@ var listCmd = &cobra.Command{
 		}
 
 		// Get list of services
-		services := manager.GetConfig().Services
+		services := manager.GetServices()
 
 		// Print header
 		fmt.Println("\nConfigured services and their backups:")
@@ -67,9 +69,24 @@ var listCmd = &cobra.Command{
 		// Process each service
 		for serviceName, service := range services {
 			fmt.Printf("\n📁 Service: %s\n", serviceName)
-			fmt.Printf("   Path: %s\n", service.Path)
+			if container, ok := manager.DiscoveredFrom(serviceName); ok {
+				fmt.Printf("   Source: labels on container %s\n", container)
+			} else {
+				fmt.Printf("   Source: config file\n")
+			}
+			if service.Path != "" {
+				fmt.Printf("   Path: %s\n", service.Path)
+			}
+			if service.Priority != 0 {
+				fmt.Printf("   Priority: %d\n", service.Priority)
+			}
 			if service.Docker != nil {
-				fmt.Printf("   Docker container: %s\n", service.Docker.Container)
+				if describe := service.Docker.Describe(); describe != "" {
+					fmt.Printf("   Docker: %s\n", describe)
+				}
+				if len(service.Docker.Volumes) > 0 {
+					fmt.Printf("   Volumes: %s\n", strings.Join(service.Docker.Volumes, ", "))
+				}
 			}
 
 			// Get Synology backup info
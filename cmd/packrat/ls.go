@@ -0,0 +1,134 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/bmatcuk/doublestar/v4"
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+
+	"github.com/logandonley/packrat/pkg/backup"
+)
+
+var lsFrom string
+
+var lsCmd = &cobra.Command{
+	Use:   "ls <service> <backup|latest> [path-glob]",
+	Short: "List the contents of a backup",
+	Long: `List the files stored in a backup with their permissions, owner, size and
+modification time, without restoring anything.
+
+An optional glob (e.g. "data/**/*.db") limits the listing to matching paths.
+A path that matches a directory lists everything below it.
+
+Backups that have a manifest are listed without downloading the archive.`,
+	Example: `  packrat ls gitea latest
+  packrat ls gitea gitea-2024-01-02T02-00-00Z.enc 'data/**/*.db'`,
+	Args: cobra.RangeArgs(2, 3),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		serviceName := args[0]
+		var pattern string
+		if len(args) > 2 {
+			pattern = filepath.Clean(args[2])
+			if !doublestar.ValidatePattern(pattern) {
+				return fmt.Errorf("invalid path glob %q", args[2])
+			}
+		}
+
+		manager, err := createManager()
+		if err != nil {
+			return fmt.Errorf("failed to create backup manager: %w", err)
+		}
+		defer manager.Close()
+
+		selected, err := resolveBackup(manager, serviceName, args[1], lsFrom)
+		if err != nil {
+			return err
+		}
+
+		entries, err := manager.ListBackupEntries(serviceName, selected.Name, selected.source)
+		if err != nil {
+			return fmt.Errorf("failed to list backup: %w", err)
+		}
+
+		matched := 0
+		for _, e := range entries {
+			if e.Name == "." || (pattern != "" && !matchesEntry(pattern, e.Name)) {
+				continue
+			}
+			printEntry(e)
+			matched++
+		}
+
+		if pattern != "" && matched == 0 {
+			return fmt.Errorf("no paths in %s match %s", selected.Name, pattern)
+		}
+		return nil
+	},
+}
+
+// resolveBackup finds a service's backup by name, or its most recent one for "latest"
+func resolveBackup(manager *backup.Manager, serviceName, name, source string) (backupWithSource, error) {
+	if _, ok := manager.GetServices()[serviceName]; !ok {
+		return backupWithSource{}, fmt.Errorf("service %s not found in configuration", serviceName)
+	}
+
+	backups, err := listServiceBackups(manager, serviceName, source)
+	if err != nil {
+		return backupWithSource{}, err
+	}
+	if len(backups) == 0 {
+		return backupWithSource{}, fmt.Errorf("no backups found for service %s", serviceName)
+	}
+
+	if name == "latest" {
+		return selectBackup(backups, serviceName, "", true, time.Time{})
+	}
+	return selectBackup(backups, serviceName, name, false, time.Time{})
+}
+
+// matchesEntry reports whether an archive path or one of its parent directories matches a glob
+func matchesEntry(pattern, name string) bool {
+	for p := name; p != "."; p = filepath.Dir(p) {
+		if ok, _ := doublestar.Match(pattern, filepath.ToSlash(p)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// printEntry prints an archive entry in the style of tar -tv
+func printEntry(e backup.ArchiveEntry) {
+	owner := e.Uname
+	if owner == "" {
+		owner = "?"
+	}
+	group := e.Gname
+	if group == "" {
+		group = "?"
+	}
+
+	name := e.Name
+	switch e.Type {
+	case tar.TypeSymlink:
+		name += " -> " + e.Linkname
+	case tar.TypeLink:
+		name += " link to " + e.Linkname
+	}
+
+	fmt.Printf("%s %-17s %9s %s %s\n",
+		e.Mode,
+		owner+"/"+group,
+		humanize.Bytes(uint64(e.Size)),
+		e.ModTime.Local().Format("2006-01-02 15:04"),
+		name,
+	)
+}
+
+func init() {
+	lsCmd.Flags().StringVar(&lsFrom, "from", "", "Only read from this destination (synology or s3)")
+	rootCmd.AddCommand(lsCmd)
+}
@@ -0,0 +1,38 @@
+package main
+
+import "testing"
+
+func TestResolveBackup(t *testing.T) {
+	manager := newListManager(t)
+	tests := []struct {
+		name    string
+		service string
+		backup  string
+		want    string
+		wantErr bool
+	}{
+		// app-db's backups are newer, but aren't app's
+		{name: "latest", service: "app", backup: "latest", want: "app-2024-01-02T00-00-00Z.enc"},
+		{name: "latest of the longer name", service: "app-db", backup: "latest", want: "app-db-2024-01-03T00-00-00Z.enc"},
+		{name: "by name", service: "app", backup: "app-2024-01-01T00-00-00Z.enc", want: "app-2024-01-01T00-00-00Z.enc"},
+		{name: "another service's backup", service: "app", backup: "app-db-2024-01-03T00-00-00Z.enc", wantErr: true},
+		{name: "unknown service", service: "web", backup: "latest", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolveBackup(manager, tt.service, tt.backup, "")
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("resolveBackup() = %s, want an error", got.Name)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolveBackup() failed: %v", err)
+			}
+			if got.Name != tt.want {
+				t.Errorf("resolveBackup() = %s, want %s", got.Name, tt.want)
+			}
+		})
+	}
+}
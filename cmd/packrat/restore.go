@@ -11,10 +11,29 @@ import (
 
 	"github.com/dustin/go-humanize"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"golang.org/x/term"
 
+	"github.com/logandonley/packrat/pkg/backup"
 	"github.com/logandonley/packrat/pkg/storage"
 )
 
+var (
+	restoreMirror       bool
+	restoreDryRun       bool
+	restoreNoOwner      bool
+	restoreNumericOwner bool
+	restoreNoXattrs     bool
+	restoreBackupName   string
+	restoreLatest       bool
+	restoreAt           string
+	restoreFrom         string
+	restoreYes          bool
+	restoreNoTUI        bool
+	restoreRecreate     bool
+	restoreDumpsTo      string
+)
+
 type backupWithSource struct {
 	storage.BackupFile
 	source string
@@ -67,73 +86,134 @@ var restoreCmd = &cobra.Command{
 	Short: "Restore a backup for a service",
 	Long: `Restore a backup for a specified service. The backup will be downloaded from the selected storage backend,
 decrypted, and extracted to the service's path. If the service uses a Docker container,
-it will be stopped before restoration and started afterward.`,
-	Args: cobra.ExactArgs(1),
+it will be stopped before restoration and started afterward.
+
+When run from a terminal without a backup selection, a full-screen browser lets you pick
+the service and backup, browse the backup's files, mark the files or directories to
+restore and choose where to restore them. Use --no-tui for a plain numbered prompt.
+
+With --clean (or --mirror), files under the service path that are not present in the
+backup are deleted so the directory matches the backup exactly. Paths matching the
+service's exclude patterns are kept. Combine with --dry-run to list what would be
+deleted without changing anything.
+
+File ownership, permissions, modification times and extended attributes (including
+POSIX ACLs and SELinux labels) are restored as recorded in the backup. Owners are
+matched by user and group name first, falling back to the numeric IDs. When restoring
+as a non-root user, pass --no-owner to keep files owned by the current user.
+
+For scripts and runbooks, select the backup with --backup, --latest or --at (the most
+recent backup taken at or before the given time), optionally limit the search to one
+destination with --from, and skip the confirmation with --yes. Without a selection the
+backup is chosen interactively, which fails when stdin is not a terminal.`,
+	Example: `  # Browse services, backups and files interactively
+  packrat restore
+  packrat restore gitea
+
+  # Scripted restores
+  packrat restore gitea --latest --yes
+  packrat restore gitea --backup gitea-2024-01-02T02-00-00Z.enc --from s3 --yes
+  packrat restore gitea --at "2024-01-02 12:00" --yes`,
+	Args: cobra.MaximumNArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
-		serviceName := args[0]
+		var serviceName string
+		if len(args) > 0 {
+			serviceName = args[0]
+		}
+
+		if restoreDryRun && !restoreMirror {
+			return fmt.Errorf("--dry-run requires --clean")
+		}
+
+		if restoreFrom != "" && restoreFrom != "synology" && restoreFrom != "s3" {
+			return fmt.Errorf("invalid --from destination %q: must be synology or s3", restoreFrom)
+		}
+
+		var at time.Time
+		if restoreAt != "" {
+			var err error
+			at, err = parseRestoreTime(restoreAt)
+			if err != nil {
+				return err
+			}
+		}
+
+		// Without a selection flag we have to ask, which needs a terminal
+		interactive := restoreBackupName == "" && !restoreLatest && restoreAt == ""
+		isTTY := term.IsTerminal(int(os.Stdin.Fd()))
+		if interactive && !isTTY {
+			return fmt.Errorf("stdin is not a terminal: select a backup with --backup, --latest or --at")
+		}
+		if !restoreYes && !restoreDryRun && !isTTY {
+			return fmt.Errorf("stdin is not a terminal: pass --yes to restore without confirmation")
+		}
+
+		useTUI := interactive && !restoreNoTUI && !restoreDryRun
+		if serviceName == "" && !useTUI {
+			return fmt.Errorf("a service name is required")
+		}
 
 		manager, err := createManager()
 		if err != nil {
 			return fmt.Errorf("failed to create backup manager: %w", err)
 		}
 
-		// Get list of backups from all storage backends
-		var allBackups []backupWithSource
+		if useTUI {
+			return runRestoreTUI(manager, serviceName, backup.RestoreOptions{
+				Mirror:        restoreMirror,
+				SkipOwnership: restoreNoOwner,
+				NumericOwner:  restoreNumericOwner,
+				SkipXattrs:    restoreNoXattrs,
+				Source:        restoreFrom,
 
-		// Get Synology backups
-		synologyBackups, err := manager.Synology.List(serviceName + "-")
-		if err != nil {
-			return fmt.Errorf("failed to list Synology backups: %w", err)
-		}
-		for _, b := range synologyBackups {
-			allBackups = append(allBackups, backupWithSource{
-				BackupFile: b,
-				source:     "synology",
+				DumpsPath:          restoreDumpsTo,
+				RecreateContainers: restoreRecreate,
 			})
 		}
 
-		// Get S3 backups if configured
-		if manager.S3 != nil {
-			s3Backups, err := manager.S3.List(serviceName + "-")
-			if err != nil {
-				return fmt.Errorf("failed to list S3 backups: %w", err)
-			}
-			for _, b := range s3Backups {
-				allBackups = append(allBackups, backupWithSource{
-					BackupFile: b,
-					source:     "s3",
-				})
-			}
+		// Get list of backups from all storage backends
+		allBackups, err := listServiceBackups(manager, serviceName, restoreFrom)
+		if err != nil {
+			return err
 		}
 
 		if len(allBackups) == 0 {
 			return fmt.Errorf("no backups found for service %s", serviceName)
 		}
 
-		// Display the list of backups
-		displayBackupList(allBackups)
-
-		// Get user selection
 		reader := bufio.NewReader(os.Stdin)
-		fmt.Print("\nEnter the number of the backup to restore (or 'q' to quit): ")
-		input, err := reader.ReadString('\n')
-		if err != nil {
-			return fmt.Errorf("failed to read input: %w", err)
-		}
-		input = strings.TrimSpace(input)
 
-		if input == "q" || input == "Q" {
-			return nil
-		}
+		var selectedBackup backupWithSource
+		if interactive {
+			// Display the list of backups
+			displayBackupList(allBackups)
 
-		// Parse the selection
-		index, err := strconv.Atoi(input)
-		if err != nil || index < 1 || index > len(allBackups) {
-			return fmt.Errorf("invalid selection: %s", input)
-		}
+			// Get user selection
+			fmt.Print("\nEnter the number of the backup to restore (or 'q' to quit): ")
+			input, err := reader.ReadString('\n')
+			if err != nil {
+				return fmt.Errorf("failed to read input: %w", err)
+			}
+			input = strings.TrimSpace(input)
 
-		// Get the selected backup
-		selectedBackup := allBackups[index-1]
+			if input == "q" || input == "Q" {
+				return nil
+			}
+
+			// Parse the selection
+			index, err := strconv.Atoi(input)
+			if err != nil || index < 1 || index > len(allBackups) {
+				return fmt.Errorf("invalid selection: %s", input)
+			}
+
+			// Get the selected backup
+			selectedBackup = allBackups[index-1]
+		} else {
+			selectedBackup, err = selectBackup(allBackups, serviceName, restoreBackupName, restoreLatest, at)
+			if err != nil {
+				return err
+			}
+		}
 
 		// Show backup details
 		backupTime := parseBackupTime(selectedBackup.ModTime)
@@ -144,34 +224,69 @@ it will be stopped before restoration and started afterward.`,
 		fmt.Printf("  Created: %s (%s)\n", backupTime.Format("Mon Jan 2 15:04:05 2006"), humanize.Time(backupTime))
 
 		// Get the service configuration
-		service, ok := manager.GetConfig().Services[serviceName]
+		service, ok := manager.GetServices()[serviceName]
 		if !ok {
 			return fmt.Errorf("service %s not found", serviceName)
 		}
 
+		opts := backup.RestoreOptions{
+			Mirror:        restoreMirror,
+			SkipOwnership: restoreNoOwner,
+			NumericOwner:  restoreNumericOwner,
+			SkipXattrs:    restoreNoXattrs,
+			Source:        selectedBackup.source,
+			DumpsPath:     restoreDumpsTo,
+
+			RecreateContainers: restoreRecreate,
+		}
+
+		// Preview the mirror restore without touching anything
+		if restoreDryRun {
+			stale, err := manager.PreviewMirrorRestore(serviceName, selectedBackup.Name, opts)
+			if err != nil {
+				return fmt.Errorf("failed to preview restore: %w", err)
+			}
+			printStalePaths(service.Location(), stale)
+			return nil
+		}
+
 		// Handle Docker container if specified
-		if service.Docker != nil {
-			if err := manager.ValidateDockerContainer(service.Docker.Container); err != nil {
+		if restoreRecreate {
+			fmt.Printf("\nThe service's containers will be removed and recreated from the definitions in the backup.\n")
+		} else if service.Docker != nil {
+			containers, err := manager.ServiceContainers(service.Docker)
+			if err != nil {
 				return fmt.Errorf("failed to validate Docker container: %w", err)
 			}
-			fmt.Printf("\nDocker container %s will be stopped during restore and started afterward.\n", service.Docker.Container)
+			if len(containers) > 0 {
+				fmt.Printf("\nDocker container(s) %s will be stopped during restore and started afterward.\n", strings.Join(containers, ", "))
+			}
 		}
 
-		// Confirm the restore
-		fmt.Print("\nAre you sure you want to restore this backup? (y/N): ")
-		input, err = reader.ReadString('\n')
-		if err != nil {
-			return fmt.Errorf("failed to read input: %w", err)
+		if restoreMirror {
+			fmt.Printf("\nFiles in %s that are not in this backup will be deleted (use --dry-run to preview).\n", service.Location())
 		}
-		input = strings.TrimSpace(input)
 
-		if input != "y" && input != "Y" {
-			fmt.Println("Restore cancelled.")
-			return nil
+		// Confirm the restore
+		if !restoreYes {
+			fmt.Print("\nAre you sure you want to restore this backup? (y/N): ")
+			input, err := reader.ReadString('\n')
+			if err != nil {
+				return fmt.Errorf("failed to read input: %w", err)
+			}
+			input = strings.TrimSpace(input)
+
+			if input != "y" && input != "Y" {
+				fmt.Println("Restore cancelled.")
+				return nil
+			}
 		}
 
 		fmt.Println("\nRestoring backup...")
-		if err := manager.RestoreBackup(serviceName, selectedBackup.Name); err != nil {
+		if err := manager.RestoreBackupWithOptions(serviceName, selectedBackup.Name, opts); err != nil {
+			if backup.IsJobRunning(err) {
+				return fmt.Errorf("%w, try again when it has finished", err)
+			}
 			return fmt.Errorf("failed to restore backup: %w", err)
 		}
 
@@ -180,6 +295,140 @@ it will be stopped before restoration and started afterward.`,
 	},
 }
 
+// listServiceBackups lists a service's backups across storage backends, or only
+// the given one, sorted newest first
+func listServiceBackups(manager *backup.Manager, serviceName, source string) ([]backupWithSource, error) {
+	var allBackups []backupWithSource
+	// The prefix also matches services whose names start with this one's, such
+	// as app-db for app, so only names that are this service's followed by a
+	// timestamp count
+	add := func(files []storage.BackupFile, source string) {
+		for _, b := range backup.BackupFiles(files) {
+			if _, ok := backup.BackupTime(serviceName, b.Name); ok {
+				allBackups = append(allBackups, backupWithSource{BackupFile: b, source: source})
+			}
+		}
+	}
+
+	// Get Synology backups
+	if source == "" || source == "synology" {
+		synologyFiles, err := manager.Synology.List(serviceName + "-")
+		if err != nil {
+			return nil, fmt.Errorf("failed to list Synology backups: %w", err)
+		}
+		add(synologyFiles, "synology")
+	}
+
+	// Get S3 backups if configured
+	if source == "" || source == "s3" {
+		if manager.S3 == nil {
+			if source == "s3" {
+				return nil, fmt.Errorf("S3 storage is not configured")
+			}
+		} else {
+			s3Files, err := manager.S3.List(serviceName + "-")
+			if err != nil {
+				return nil, fmt.Errorf("failed to list S3 backups: %w", err)
+			}
+			add(s3Files, "s3")
+		}
+	}
+
+	// Sort backups by modification time (newest first)
+	sort.SliceStable(allBackups, func(i, j int) bool {
+		return parseBackupTime(allBackups[i].ModTime).After(parseBackupTime(allBackups[j].ModTime))
+	})
+
+	return allBackups, nil
+}
+
+// selectBackup picks a backup from a newest-first list by name, as the latest,
+// or as the most recent one taken at or before a point in time. Points in time
+// are matched against the timestamp in the backup's name, since storage
+// modification times change when backups are copied between destinations.
+func selectBackup(backups []backupWithSource, serviceName, name string, latest bool, at time.Time) (backupWithSource, error) {
+	switch {
+	case name != "":
+		for _, b := range backups {
+			if b.Name == name {
+				return b, nil
+			}
+		}
+		return backupWithSource{}, fmt.Errorf("backup %s not found", name)
+
+	case latest:
+		if len(backups) == 0 {
+			return backupWithSource{}, fmt.Errorf("no backups found")
+		}
+		return backups[0], nil
+
+	case !at.IsZero():
+		var selected backupWithSource
+		var selectedTime time.Time
+		for _, b := range backups {
+			taken, ok := backup.BackupTime(serviceName, b.Name)
+			if ok && !taken.After(at) && taken.After(selectedTime) {
+				selected, selectedTime = b, taken
+			}
+		}
+		if selectedTime.IsZero() {
+			return backupWithSource{}, fmt.Errorf("no backup found at or before %s", at.Format(time.RFC3339))
+		}
+		return selected, nil
+	}
+
+	return backupWithSource{}, fmt.Errorf("no backup selected")
+}
+
+// parseRestoreTime parses the --at timestamp. Times without a zone are local.
+func parseRestoreTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02 15:04", "2006-01-02T15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid --at timestamp %q: use RFC 3339 (2006-01-02T15:04:05Z) or 2006-01-02 15:04", value)
+}
+
+// printStalePaths prints the paths a mirror restore would delete
+func printStalePaths(servicePath string, stale []string) {
+	if len(stale) == 0 {
+		fmt.Printf("\nNo files would be deleted from %s\n", servicePath)
+		return
+	}
+
+	fmt.Printf("\nThe following %d path(s) in %s would be deleted:\n", len(stale), servicePath)
+	for _, p := range stale {
+		fmt.Printf("  %s\n", p)
+	}
+}
+
+// restoreFlagAliases maps the --mirror alias to --clean
+func restoreFlagAliases(f *pflag.FlagSet, name string) pflag.NormalizedName {
+	if name == "mirror" {
+		name = "clean"
+	}
+	return pflag.NormalizedName(name)
+}
+
 func init() {
+	restoreCmd.Flags().BoolVar(&restoreMirror, "clean", false, "Delete files that are not present in the backup (alias --mirror)")
+	restoreCmd.Flags().BoolVar(&restoreDryRun, "dry-run", false, "With --clean, list the files that would be deleted and exit")
+	restoreCmd.Flags().BoolVar(&restoreNoOwner, "no-owner", false, "Don't restore file ownership (for restoring as a non-root user)")
+	restoreCmd.Flags().BoolVar(&restoreNumericOwner, "numeric-owner", false, "Restore numeric uid/gid instead of mapping user and group names")
+	restoreCmd.Flags().BoolVar(&restoreNoXattrs, "no-xattrs", false, "Don't restore extended attributes, ACLs or SELinux labels")
+	restoreCmd.Flags().StringVar(&restoreBackupName, "backup", "", "Name of the backup to restore")
+	restoreCmd.Flags().BoolVar(&restoreLatest, "latest", false, "Restore the most recent backup")
+	restoreCmd.Flags().StringVar(&restoreAt, "at", "", "Restore the most recent backup taken at or before this time")
+	restoreCmd.Flags().StringVar(&restoreFrom, "from", "", "Only restore from this destination (synology or s3)")
+	restoreCmd.Flags().BoolVarP(&restoreYes, "yes", "y", false, "Don't ask for confirmation")
+	restoreCmd.Flags().BoolVar(&restoreRecreate, "recreate-container", false, "Pull the images and recreate the containers from the definitions stored in the backup")
+	restoreCmd.Flags().StringVar(&restoreDumpsTo, "dumps-to", "", "Also extract the backup's dumps into this directory")
+	restoreCmd.Flags().BoolVar(&restoreNoTUI, "no-tui", false, "Use a plain numbered prompt instead of the full-screen browser")
+	restoreCmd.MarkFlagsMutuallyExclusive("backup", "latest", "at")
+	restoreCmd.Flags().SetNormalizeFunc(restoreFlagAliases)
 	rootCmd.AddCommand(restoreCmd)
 }
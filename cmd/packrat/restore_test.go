@@ -0,0 +1,212 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/logandonley/packrat/pkg/backup"
+	"github.com/logandonley/packrat/pkg/config"
+	"github.com/logandonley/packrat/pkg/storage"
+)
+
+// listStorage is a storage that only lists files
+type listStorage struct {
+	files []storage.BackupFile
+}
+
+func (s *listStorage) Upload(localPath, remoteName string) error {
+	return nil
+}
+
+func (s *listStorage) Download(remoteName, localPath string) error {
+	return nil
+}
+
+func (s *listStorage) Delete(remoteName string) error {
+	return nil
+}
+
+func (s *listStorage) Close() error {
+	return nil
+}
+
+func (s *listStorage) List(prefix string) ([]storage.BackupFile, error) {
+	var files []storage.BackupFile
+	for _, f := range s.files {
+		if strings.HasPrefix(f.Name, prefix) {
+			files = append(files, f)
+		}
+	}
+	return files, nil
+}
+
+// newListManager returns a manager for the services app and app-db, whose
+// storage has backups of both. app-db's are the most recent.
+func newListManager(t *testing.T) *backup.Manager {
+	t.Helper()
+	cfg := &config.Config{
+		Services: map[string]config.Service{"app": {Path: t.TempDir()}, "app-db": {Path: t.TempDir()}},
+		StateDir: t.TempDir(),
+	}
+	synology := &listStorage{files: []storage.BackupFile{
+		{Name: "app-2024-01-01T00-00-00Z.enc", ModTime: "2024-01-01 00:00:05 UTC"},
+		{Name: "app-2024-01-01T00-00-00Z.manifest", ModTime: "2024-01-01 00:00:05 UTC"},
+		{Name: "app-2024-01-02T00-00-00Z.enc", ModTime: "2024-01-02 00:00:05 UTC"},
+		{Name: "app-db-2024-01-03T00-00-00Z.enc", ModTime: "2024-01-03 00:00:05 UTC"},
+		{Name: "app-db-2024-01-03T00-00-00Z.manifest", ModTime: "2024-01-03 00:00:05 UTC"},
+	}}
+	manager, err := backup.NewManagerWithStorage(cfg, []byte("testkey0123456789012345678901234"), synology, nil)
+	if err != nil {
+		t.Fatalf("Failed to create manager: %v", err)
+	}
+	return manager
+}
+
+func TestListServiceBackups(t *testing.T) {
+	manager := newListManager(t)
+	tests := []struct {
+		service string
+		want    []string
+	}{
+		// Listing app also finds app-db's backups, which aren't app's
+		{service: "app", want: []string{"app-2024-01-02T00-00-00Z.enc", "app-2024-01-01T00-00-00Z.enc"}},
+		{service: "app-db", want: []string{"app-db-2024-01-03T00-00-00Z.enc"}},
+	}
+	for _, tt := range tests {
+		backups, err := listServiceBackups(manager, tt.service, "")
+		if err != nil {
+			t.Fatalf("listServiceBackups(%s) failed: %v", tt.service, err)
+		}
+		var names []string
+		for _, b := range backups {
+			names = append(names, b.Name)
+		}
+		if !reflect.DeepEqual(names, tt.want) {
+			t.Errorf("listServiceBackups(%s) = %q, want %q", tt.service, names, tt.want)
+		}
+
+		latest, err := selectBackup(backups, tt.service, "", true, time.Time{})
+		if err != nil || latest.Name != tt.want[0] {
+			t.Errorf("latest backup of %s = %s, %v; want %s", tt.service, latest.Name, err, tt.want[0])
+		}
+	}
+
+	if _, err := listServiceBackups(manager, "app", "s3"); err == nil {
+		t.Error("Expected listing S3 backups to fail without S3 configured")
+	}
+}
+
+func TestSelectBackup(t *testing.T) {
+	file := func(name, modTime, source string) backupWithSource {
+		return backupWithSource{BackupFile: storage.BackupFile{Name: name, ModTime: modTime}, source: source}
+	}
+	// Newest first by modification time. The oldest backup was copied to S3
+	// last, so its modification time there is the newest.
+	backups := []backupWithSource{
+		file("app-2024-01-01T00-00-00Z.enc", "2024-03-01 00:00:00 UTC", "s3"),
+		file("app-2024-01-03T12-00-00Z.enc", "2024-01-03 12:00:05 UTC", "synology"),
+		file("app-db-2024-01-02T12-00-00Z.enc", "2024-01-02 12:00:05 UTC", "synology"),
+		file("app-2024-01-02T00-00-00Z.enc", "2024-01-02 00:00:05 UTC", "synology"),
+		file("app-2024-01-01T00-00-00Z.enc", "2024-01-01 00:00:05 UTC", "synology"),
+	}
+	date := func(value string) time.Time {
+		t.Helper()
+		at, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %v", value, err)
+		}
+		return at
+	}
+
+	tests := []struct {
+		name       string
+		backups    []backupWithSource
+		backup     string
+		latest     bool
+		at         time.Time
+		want       string
+		wantSource string
+		wantErr    bool
+	}{
+		{name: "by name", backups: backups, backup: "app-2024-01-02T00-00-00Z.enc", want: "app-2024-01-02T00-00-00Z.enc", wantSource: "synology"},
+		{name: "missing name", backups: backups, backup: "app-2023-01-01T00-00-00Z.enc", wantErr: true},
+		{name: "latest", backups: backups, latest: true, want: "app-2024-01-01T00-00-00Z.enc", wantSource: "s3"},
+		{name: "latest without backups", latest: true, wantErr: true},
+		{name: "at an exact backup time", backups: backups, at: date("2024-01-02T00:00:00Z"), want: "app-2024-01-02T00-00-00Z.enc", wantSource: "synology"},
+		{name: "at uses the name, not the modification time", backups: backups, at: date("2024-01-02T00:00:03Z"), want: "app-2024-01-02T00-00-00Z.enc", wantSource: "synology"},
+		{name: "at skips other services", backups: backups, at: date("2024-01-02T18:00:00Z"), want: "app-2024-01-02T00-00-00Z.enc", wantSource: "synology"},
+		{name: "at after every backup", backups: backups, at: date("2025-01-01T00:00:00Z"), want: "app-2024-01-03T12-00-00Z.enc", wantSource: "synology"},
+		{name: "at in another zone", backups: backups, at: date("2024-01-03T13:00:00+02:00"), want: "app-2024-01-02T00-00-00Z.enc", wantSource: "synology"},
+		{name: "at before every backup", backups: backups, at: date("2023-12-31T23:59:59Z"), wantErr: true},
+		{name: "nothing selected", backups: backups, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := selectBackup(tt.backups, "app", tt.backup, tt.latest, tt.at)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("selectBackup() = %s, want an error", got.Name)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("selectBackup() failed: %v", err)
+			}
+			if got.Name != tt.want || got.source != tt.wantSource {
+				t.Errorf("selectBackup() = %s from %s, want %s from %s", got.Name, got.source, tt.want, tt.wantSource)
+			}
+		})
+	}
+}
+
+func TestParseRestoreTime(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Time
+		wantErr bool
+	}{
+		{value: "2024-01-02T03:04:05Z", want: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)},
+		{value: "2024-01-02T03:04:05+02:00", want: time.Date(2024, 1, 2, 1, 4, 5, 0, time.UTC)},
+		{value: "2024-01-02 03:04:05", want: time.Date(2024, 1, 2, 3, 4, 5, 0, time.Local)},
+		{value: "2024-01-02T03:04:05", want: time.Date(2024, 1, 2, 3, 4, 5, 0, time.Local)},
+		{value: "2024-01-02 03:04", want: time.Date(2024, 1, 2, 3, 4, 0, 0, time.Local)},
+		{value: "2024-01-02T03:04", want: time.Date(2024, 1, 2, 3, 4, 0, 0, time.Local)},
+		{value: "2024-01-02", want: time.Date(2024, 1, 2, 0, 0, 0, 0, time.Local)},
+		{value: "yesterday", wantErr: true},
+		{value: "2024-13-01", wantErr: true},
+		{value: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := parseRestoreTime(tt.value)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("parseRestoreTime(%q) = %v, want an error", tt.value, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseRestoreTime(%q) failed: %v", tt.value, err)
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("parseRestoreTime(%q) = %v, want %v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRestoreMirrorAlias(t *testing.T) {
+	defer func() {
+		restoreMirror = false
+		restoreCmd.Flags().Lookup("clean").Changed = false
+	}()
+
+	if err := restoreCmd.Flags().Parse([]string{"--mirror"}); err != nil {
+		t.Fatalf("Failed to parse --mirror: %v", err)
+	}
+	if !restoreMirror || !restoreCmd.Flags().Changed("clean") {
+		t.Error("--mirror did not set --clean")
+	}
+}
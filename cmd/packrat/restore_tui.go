@@ -0,0 +1,773 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/charmbracelet/bubbles/progress"
+	"github.com/charmbracelet/bubbles/spinner"
+	"github.com/charmbracelet/bubbles/textinput"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+	"github.com/dustin/go-humanize"
+
+	"github.com/logandonley/packrat/pkg/backup"
+)
+
+type tuiScreen int
+
+const (
+	screenServices tuiScreen = iota
+	screenBackups
+	screenFiles
+	screenTarget
+	screenConfirm
+	screenRestoring
+	screenDone
+)
+
+var (
+	tuiTitleStyle    = lipgloss.NewStyle().Bold(true).Foreground(lipgloss.Color("12"))
+	tuiSelectedStyle = lipgloss.NewStyle().Reverse(true)
+	tuiDimStyle      = lipgloss.NewStyle().Foreground(lipgloss.Color("8"))
+	tuiMarkStyle     = lipgloss.NewStyle().Foreground(lipgloss.Color("10"))
+	tuiErrorStyle    = lipgloss.NewStyle().Foreground(lipgloss.Color("9"))
+)
+
+// mergedBackup is a backup that may be stored in several destinations
+type mergedBackup struct {
+	name    string
+	size    int64
+	modTime string
+	sources []string
+}
+
+// fileNode is a file or directory in a backup's file tree
+type fileNode struct {
+	name     string
+	path     string
+	isDir    bool
+	size     int64
+	entry    backup.ArchiveEntry
+	parent   *fileNode
+	children []*fileNode
+}
+
+type backupsLoadedMsg struct {
+	backups []mergedBackup
+	err     error
+}
+
+type entriesLoadedMsg struct {
+	root *fileNode
+	err  error
+}
+
+type restoreProgressMsg struct {
+	name string
+	size int64
+}
+
+type restoreDoneMsg struct {
+	err error
+}
+
+// restoreTUI is the full-screen restore browser
+type restoreTUI struct {
+	manager *backup.Manager
+	opts    backup.RestoreOptions
+
+	screen  tuiScreen
+	width   int
+	height  int
+	loading string
+	spinner spinner.Model
+	err     error
+
+	services      []string
+	serviceCursor int
+	service       string
+
+	backups      []mergedBackup
+	backupCursor int
+	backup       mergedBackup
+
+	root       *fileNode
+	dir        *fileNode
+	fileCursor int
+	marked     map[string]bool
+
+	target textinput.Model
+
+	progress   progress.Model
+	progressCh chan tea.Msg
+	totalBytes int64
+	doneBytes  int64
+	totalFiles int
+	doneFiles  int
+	current    string
+	restored   bool
+}
+
+// runRestoreTUI runs the interactive restore browser, optionally starting at a service's backups
+func runRestoreTUI(manager *backup.Manager, serviceName string, opts backup.RestoreOptions) error {
+	services := make([]string, 0, len(manager.GetServices()))
+	for name := range manager.GetServices() {
+		services = append(services, name)
+	}
+	sort.Strings(services)
+	if len(services) == 0 {
+		return fmt.Errorf("no services configured")
+	}
+
+	target := textinput.New()
+	target.Prompt = "Restore to: "
+	target.CharLimit = 4096
+
+	m := &restoreTUI{
+		manager:  manager,
+		opts:     opts,
+		spinner:  spinner.New(spinner.WithSpinner(spinner.MiniDot)),
+		services: services,
+		marked:   make(map[string]bool),
+		target:   target,
+		progress: progress.New(progress.WithDefaultGradient()),
+	}
+
+	var initial tea.Cmd
+	if serviceName != "" {
+		if _, ok := manager.GetServices()[serviceName]; !ok {
+			return fmt.Errorf("service %s not found", serviceName)
+		}
+		for i, name := range services {
+			if name == serviceName {
+				m.serviceCursor = i
+			}
+		}
+		initial = m.selectService(serviceName)
+	}
+
+	// Log output from the backup manager would tear the full-screen UI, so
+	// hold on to it and print it once the UI has exited
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	final, err := tea.NewProgram(&restoreModel{m, initial}, tea.WithAltScreen()).Run()
+	log.SetOutput(os.Stderr)
+	io.Copy(os.Stderr, &logs)
+	if err != nil {
+		return fmt.Errorf("failed to run restore UI: %w", err)
+	}
+
+	result := final.(*restoreModel).restoreTUI
+	if result.screen == screenDone {
+		if result.err != nil {
+			return fmt.Errorf("failed to restore backup: %w", result.err)
+		}
+		fmt.Printf("Successfully restored backup %s for service %s to %s\n", result.backup.name, result.service, result.target.Value())
+	}
+	return nil
+}
+
+// restoreModel adapts restoreTUI to tea.Model and carries the initial command
+type restoreModel struct {
+	*restoreTUI
+	initial tea.Cmd
+}
+
+func (m *restoreModel) Init() tea.Cmd {
+	return tea.Batch(m.spinner.Tick, m.initial)
+}
+
+func (m *restoreModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	return m, m.update(msg)
+}
+
+func (m *restoreModel) View() string {
+	return m.view()
+}
+
+func (m *restoreTUI) update(msg tea.Msg) tea.Cmd {
+	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		m.width, m.height = msg.Width, msg.Height
+		m.progress.Width = min(msg.Width-4, 80)
+		return nil
+
+	case spinner.TickMsg:
+		var cmd tea.Cmd
+		m.spinner, cmd = m.spinner.Update(msg)
+		return cmd
+
+	case progress.FrameMsg:
+		model, cmd := m.progress.Update(msg)
+		m.progress = model.(progress.Model)
+		return cmd
+
+	case backupsLoadedMsg:
+		m.loading = ""
+		if msg.err != nil {
+			m.err = msg.err
+			m.screen = screenServices
+			return nil
+		}
+		m.backups = msg.backups
+		m.backupCursor = 0
+		m.screen = screenBackups
+		return nil
+
+	case entriesLoadedMsg:
+		m.loading = ""
+		if msg.err != nil {
+			m.err = msg.err
+			m.screen = screenBackups
+			return nil
+		}
+		m.root = msg.root
+		m.dir = msg.root
+		m.fileCursor = 0
+		m.marked = make(map[string]bool)
+		m.screen = screenFiles
+		return nil
+
+	case restoreProgressMsg:
+		m.doneFiles++
+		m.doneBytes += msg.size
+		m.current = msg.name
+		return tea.Batch(m.progress.SetPercent(m.percent()), waitForRestore(m.progressCh))
+
+	case restoreDoneMsg:
+		m.err = msg.err
+		m.restored = msg.err == nil
+		m.screen = screenDone
+		if m.restored {
+			return m.progress.SetPercent(1)
+		}
+		return nil
+
+	case tea.KeyMsg:
+		return m.handleKey(msg)
+	}
+
+	if m.screen == screenTarget {
+		var cmd tea.Cmd
+		m.target, cmd = m.target.Update(msg)
+		return cmd
+	}
+	return nil
+}
+
+func (m *restoreTUI) handleKey(msg tea.KeyMsg) tea.Cmd {
+	key := msg.String()
+
+	// Quitting mid-restore would leave the service half restored and its container stopped
+	if m.screen == screenRestoring {
+		return nil
+	}
+	if key == "ctrl+c" || (key == "q" && m.screen != screenTarget) {
+		return tea.Quit
+	}
+	if m.loading != "" {
+		return nil
+	}
+	m.err = nil
+
+	switch m.screen {
+	case screenServices:
+		switch key {
+		case "up", "k":
+			m.serviceCursor = max(m.serviceCursor-1, 0)
+		case "down", "j":
+			m.serviceCursor = min(m.serviceCursor+1, len(m.services)-1)
+		case "enter", "right", "l":
+			return m.selectService(m.services[m.serviceCursor])
+		}
+
+	case screenBackups:
+		switch key {
+		case "up", "k":
+			m.backupCursor = max(m.backupCursor-1, 0)
+		case "down", "j":
+			m.backupCursor = min(m.backupCursor+1, len(m.backups)-1)
+		case "pgup":
+			m.backupCursor = max(m.backupCursor-m.listHeight(), 0)
+		case "pgdown":
+			m.backupCursor = min(m.backupCursor+m.listHeight(), len(m.backups)-1)
+		case "esc", "left", "h":
+			m.screen = screenServices
+		case "enter", "right", "l":
+			m.backup = m.backups[m.backupCursor]
+			m.loading = fmt.Sprintf("Downloading %s to read its contents...", m.backup.name)
+			return tea.Batch(m.spinner.Tick, m.loadEntries())
+		}
+
+	case screenFiles:
+		entries := m.dir.children
+		rows := len(entries)
+		if m.dir.parent != nil {
+			rows++ // ".." row
+		}
+		switch key {
+		case "up", "k":
+			m.fileCursor = max(m.fileCursor-1, 0)
+		case "down", "j":
+			m.fileCursor = min(m.fileCursor+1, rows-1)
+		case "pgup":
+			m.fileCursor = max(m.fileCursor-m.listHeight(), 0)
+		case "pgdown":
+			m.fileCursor = min(m.fileCursor+m.listHeight(), rows-1)
+		case "esc":
+			m.screen = screenBackups
+		case "backspace", "left", "h":
+			m.leaveDir()
+		case "enter", "right", "l":
+			node := m.cursorNode()
+			if node == nil {
+				m.leaveDir()
+			} else if node.isDir {
+				m.dir = node
+				m.fileCursor = 0
+			}
+		case " ", "x":
+			if node := m.cursorNode(); node != nil {
+				m.toggleMark(node)
+			}
+		case "a":
+			// Restore everything
+			m.marked = make(map[string]bool)
+		case "r", "tab":
+			if m.target.Value() == "" {
+				m.target.SetValue(m.manager.GetServices()[m.service].Path)
+			}
+			m.target.Focus()
+			m.screen = screenTarget
+			return textinput.Blink
+		}
+
+	case screenTarget:
+		switch key {
+		case "esc":
+			m.target.Blur()
+			m.screen = screenFiles
+			return nil
+		case "enter":
+			if strings.TrimSpace(m.target.Value()) == "" {
+				m.err = fmt.Errorf("a target directory is required")
+				return nil
+			}
+			if m.opts.Mirror && len(m.marked) > 0 {
+				m.err = fmt.Errorf("--clean restores the whole backup; clear the selection with 'a' or restart without --clean")
+				return nil
+			}
+			m.target.Blur()
+			m.screen = screenConfirm
+			return nil
+		}
+		var cmd tea.Cmd
+		m.target, cmd = m.target.Update(msg)
+		return cmd
+
+	case screenConfirm:
+		switch key {
+		case "esc", "n":
+			m.target.Focus()
+			m.screen = screenTarget
+			return textinput.Blink
+		case "y", "enter":
+			return m.startRestore()
+		}
+
+	case screenDone:
+		if key == "enter" || key == "esc" {
+			return tea.Quit
+		}
+	}
+
+	return nil
+}
+
+func (m *restoreTUI) selectService(name string) tea.Cmd {
+	m.service = name
+	m.target.SetValue("")
+	m.loading = fmt.Sprintf("Listing backups for %s...", name)
+	source := m.opts.Source
+	return tea.Batch(m.spinner.Tick, func() tea.Msg {
+		backups, err := listServiceBackups(m.manager, name, source)
+		if err != nil {
+			return backupsLoadedMsg{err: err}
+		}
+		if len(backups) == 0 {
+			return backupsLoadedMsg{err: fmt.Errorf("no backups found for service %s", name)}
+		}
+		return backupsLoadedMsg{backups: mergeBackups(backups)}
+	})
+}
+
+func (m *restoreTUI) loadEntries() tea.Cmd {
+	service, name, source := m.service, m.backup.name, m.opts.Source
+	return func() tea.Msg {
+		entries, err := m.manager.ListBackupEntries(service, name, source)
+		if err != nil {
+			return entriesLoadedMsg{err: err}
+		}
+		return entriesLoadedMsg{root: buildFileTree(entries)}
+	}
+}
+
+func (m *restoreTUI) startRestore() tea.Cmd {
+	opts := m.opts
+	opts.TargetPath = strings.TrimSpace(m.target.Value())
+	opts.Paths = m.selectedPaths()
+
+	m.totalFiles, m.totalBytes = 0, 0
+	m.doneFiles, m.doneBytes = 0, 0
+	walkFileTree(m.root, func(n *fileNode) {
+		if opts.Paths == nil || m.isMarked(n) {
+			m.totalFiles++
+			m.totalBytes += n.entry.Size
+		}
+	})
+
+	ch := make(chan tea.Msg, 64)
+	m.progressCh = ch
+	opts.Progress = func(name string, size int64) {
+		ch <- restoreProgressMsg{name: name, size: size}
+	}
+
+	service, name := m.service, m.backup.name
+	go func() {
+		ch <- restoreDoneMsg{err: m.manager.RestoreBackupWithOptions(service, name, opts)}
+	}()
+
+	m.screen = screenRestoring
+	return tea.Batch(m.progress.SetPercent(0), waitForRestore(ch))
+}
+
+func waitForRestore(ch <-chan tea.Msg) tea.Cmd {
+	return func() tea.Msg {
+		return <-ch
+	}
+}
+
+func (m *restoreTUI) percent() float64 {
+	if m.totalBytes > 0 {
+		return float64(m.doneBytes) / float64(m.totalBytes)
+	}
+	if m.totalFiles > 0 {
+		return float64(m.doneFiles) / float64(m.totalFiles)
+	}
+	return 0
+}
+
+// cursorNode returns the node under the cursor, or nil for the ".." row
+func (m *restoreTUI) cursorNode() *fileNode {
+	i := m.fileCursor
+	if m.dir.parent != nil {
+		if i == 0 {
+			return nil
+		}
+		i--
+	}
+	if i < 0 || i >= len(m.dir.children) {
+		return nil
+	}
+	return m.dir.children[i]
+}
+
+func (m *restoreTUI) leaveDir() {
+	if m.dir.parent == nil {
+		return
+	}
+	child := m.dir
+	m.dir = m.dir.parent
+	m.fileCursor = 0
+	for i, n := range m.dir.children {
+		if n == child {
+			m.fileCursor = i
+			if m.dir.parent != nil {
+				m.fileCursor++
+			}
+		}
+	}
+}
+
+// toggleMark marks or unmarks a node. Marking a directory covers everything below it.
+func (m *restoreTUI) toggleMark(node *fileNode) {
+	if m.marked[node.path] {
+		delete(m.marked, node.path)
+		return
+	}
+	if m.isMarked(node) {
+		m.err = fmt.Errorf("%s is already included by a selected directory", node.path)
+		return
+	}
+	for p := range m.marked {
+		if strings.HasPrefix(p, node.path+"/") {
+			delete(m.marked, p)
+		}
+	}
+	m.marked[node.path] = true
+}
+
+// isMarked reports whether a node or one of its parents is marked
+func (m *restoreTUI) isMarked(node *fileNode) bool {
+	for n := node; n != nil; n = n.parent {
+		if m.marked[n.path] {
+			return true
+		}
+	}
+	return false
+}
+
+// hasMarkedChild reports whether anything below a directory is marked
+func (m *restoreTUI) hasMarkedChild(node *fileNode) bool {
+	for p := range m.marked {
+		if strings.HasPrefix(p, node.path+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// selectedPaths returns the marked archive paths, or nil to restore everything
+func (m *restoreTUI) selectedPaths() []string {
+	if len(m.marked) == 0 {
+		return nil
+	}
+	paths := make([]string, 0, len(m.marked))
+	for p := range m.marked {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func (m *restoreTUI) listHeight() int {
+	return max(m.height-8, 5)
+}
+
+func (m *restoreTUI) view() string {
+	var b strings.Builder
+
+	b.WriteString(tuiTitleStyle.Render("Packrat restore"))
+	if m.service != "" && m.screen != screenServices {
+		b.WriteString(tuiDimStyle.Render("  " + m.service))
+		if m.backup.name != "" && m.screen > screenBackups {
+			b.WriteString(tuiDimStyle.Render(" › " + m.backup.name))
+		}
+	}
+	b.WriteString("\n\n")
+
+	if m.loading != "" {
+		b.WriteString(m.spinner.View() + " " + m.loading + "\n")
+		return b.String()
+	}
+
+	switch m.screen {
+	case screenServices:
+		b.WriteString("Select a service:\n\n")
+		rows := make([]string, len(m.services))
+		for i, name := range m.services {
+			rows[i] = fmt.Sprintf("%-24s %s", name, tuiDimStyle.Render(m.manager.GetServices()[name].Path))
+		}
+		b.WriteString(m.renderList(rows, m.serviceCursor))
+		b.WriteString(m.footer("↑/↓ move • enter select • q quit"))
+
+	case screenBackups:
+		b.WriteString(fmt.Sprintf("  %-40s %-10s %-16s %s\n", "BACKUP", "SIZE", "AGE", "DESTINATIONS"))
+		rows := make([]string, len(m.backups))
+		for i, bk := range m.backups {
+			rows[i] = fmt.Sprintf("%-40s %-10s %-16s %s",
+				bk.name,
+				humanize.Bytes(uint64(bk.size)),
+				humanize.Time(parseBackupTime(bk.modTime)),
+				strings.Join(bk.sources, ", "),
+			)
+		}
+		b.WriteString(m.renderList(rows, m.backupCursor))
+		b.WriteString(m.footer("↑/↓ move • enter browse files • esc back • q quit"))
+
+	case screenFiles:
+		b.WriteString(fmt.Sprintf("/%s\n", strings.TrimPrefix(m.dir.path, ".")))
+		var rows []string
+		if m.dir.parent != nil {
+			rows = append(rows, "    ..")
+		}
+		for _, n := range m.dir.children {
+			mark := "[ ]"
+			switch {
+			case m.isMarked(n):
+				mark = tuiMarkStyle.Render("[x]")
+			case n.isDir && m.hasMarkedChild(n):
+				mark = tuiMarkStyle.Render("[~]")
+			}
+			name := n.name
+			if n.isDir {
+				name += "/"
+			}
+			rows = append(rows, fmt.Sprintf("%s %-40s %10s  %s", mark, name, humanize.Bytes(uint64(n.size)), n.entry.ModTime.Local().Format("2006-01-02 15:04")))
+		}
+		b.WriteString(m.renderList(rows, m.fileCursor))
+		selection := "Selection: entire backup"
+		if len(m.marked) > 0 {
+			selection = fmt.Sprintf("Selection: %d path(s)", len(m.marked))
+		}
+		b.WriteString("\n" + selection + "\n")
+		b.WriteString(m.footer("space mark • enter open • ← up • a select all • r restore • esc back • q quit"))
+
+	case screenTarget:
+		b.WriteString(m.target.View() + "\n\n")
+		service := m.manager.GetServices()[m.service]
+		if service.Docker != nil {
+			b.WriteString(tuiDimStyle.Render(fmt.Sprintf("Restoring to %s stops %s during the restore.", service.Path, service.Docker.Describe())) + "\n")
+		}
+		b.WriteString(m.footer("enter continue • esc back"))
+
+	case screenConfirm:
+		target := strings.TrimSpace(m.target.Value())
+		service := m.manager.GetServices()[m.service]
+		b.WriteString(fmt.Sprintf("Backup:  %s (%s)\n", m.backup.name, humanize.Bytes(uint64(m.backup.size))))
+		if paths := m.selectedPaths(); paths == nil {
+			b.WriteString("Restore: entire backup\n")
+		} else {
+			b.WriteString(fmt.Sprintf("Restore: %d path(s)\n", len(paths)))
+			for i, p := range paths {
+				if i == 10 {
+					b.WriteString(fmt.Sprintf("         ... and %d more\n", len(paths)-10))
+					break
+				}
+				b.WriteString("         " + p + "\n")
+			}
+		}
+		b.WriteString(fmt.Sprintf("Target:  %s\n", target))
+		if service.Docker != nil && backup.SamePath(target, service.Path) {
+			b.WriteString(fmt.Sprintf("\nDocker %s will be stopped during restore and started afterward.\n", service.Docker.Describe()))
+		}
+		if m.opts.Mirror {
+			b.WriteString(fmt.Sprintf("\nFiles in %s that are not in this backup will be deleted.\n", target))
+		}
+		b.WriteString(m.footer("y restore • esc back • q quit"))
+
+	case screenRestoring:
+		b.WriteString(m.progress.View() + "\n\n")
+		b.WriteString(fmt.Sprintf("%d/%d files • %s/%s\n", m.doneFiles, m.totalFiles, humanize.Bytes(uint64(m.doneBytes)), humanize.Bytes(uint64(m.totalBytes))))
+		b.WriteString(tuiDimStyle.Render(m.current) + "\n")
+
+	case screenDone:
+		if m.restored {
+			b.WriteString(m.progress.View() + "\n\n")
+			b.WriteString(fmt.Sprintf("Restored %s to %s\n", m.backup.name, strings.TrimSpace(m.target.Value())))
+		} else {
+			b.WriteString(tuiErrorStyle.Render("Restore failed") + "\n")
+		}
+		b.WriteString(m.footer("enter exit"))
+	}
+
+	if m.err != nil {
+		b.WriteString("\n" + tuiErrorStyle.Render("Error: "+m.err.Error()) + "\n")
+	}
+	return b.String()
+}
+
+// renderList renders rows in a window that keeps the cursor visible
+func (m *restoreTUI) renderList(rows []string, cursor int) string {
+	height := m.listHeight()
+	start := 0
+	if cursor >= height {
+		start = cursor - height + 1
+	}
+	end := min(start+height, len(rows))
+
+	var b strings.Builder
+	for i := start; i < end; i++ {
+		if i == cursor {
+			b.WriteString(tuiSelectedStyle.Render("> "+rows[i]) + "\n")
+		} else {
+			b.WriteString("  " + rows[i] + "\n")
+		}
+	}
+	return b.String()
+}
+
+func (m *restoreTUI) footer(help string) string {
+	return "\n" + tuiDimStyle.Render(help) + "\n"
+}
+
+// mergeBackups combines copies of the same backup in different destinations, newest first
+func mergeBackups(backups []backupWithSource) []mergedBackup {
+	var merged []mergedBackup
+	index := make(map[string]int)
+	for _, b := range backups {
+		if i, ok := index[b.Name]; ok {
+			merged[i].sources = append(merged[i].sources, b.source)
+			continue
+		}
+		index[b.Name] = len(merged)
+		merged = append(merged, mergedBackup{
+			name:    b.Name,
+			size:    b.Size,
+			modTime: b.ModTime,
+			sources: []string{b.source},
+		})
+	}
+	return merged
+}
+
+// buildFileTree arranges archive entries into a tree rooted at the service directory
+func buildFileTree(entries []backup.ArchiveEntry) *fileNode {
+	root := &fileNode{name: "", path: ".", isDir: true}
+	nodes := map[string]*fileNode{".": root}
+
+	var ensure func(p string) *fileNode
+	ensure = func(p string) *fileNode {
+		if n, ok := nodes[p]; ok {
+			return n
+		}
+		parent := ensure(path.Dir(p))
+		n := &fileNode{name: path.Base(p), path: p, isDir: true, parent: parent}
+		parent.children = append(parent.children, n)
+		nodes[p] = n
+		return n
+	}
+
+	for _, e := range entries {
+		p := path.Clean(strings.ReplaceAll(e.Name, "\\", "/"))
+		n := ensure(p)
+		n.entry = e
+		n.isDir = e.IsDir()
+	}
+
+	var finish func(n *fileNode) int64
+	finish = func(n *fileNode) int64 {
+		sort.Slice(n.children, func(i, j int) bool {
+			a, b := n.children[i], n.children[j]
+			if a.isDir != b.isDir {
+				return a.isDir
+			}
+			return a.name < b.name
+		})
+		n.size = n.entry.Size
+		for _, c := range n.children {
+			n.size += finish(c)
+		}
+		return n.size
+	}
+	finish(root)
+
+	return root
+}
+
+// walkFileTree calls fn for every node in the tree
+func walkFileTree(n *fileNode, fn func(*fileNode)) {
+	fn(n)
+	for _, c := range n.children {
+		walkFileTree(c, fn)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/logandonley/packrat/pkg/backup"
+	"github.com/logandonley/packrat/pkg/storage"
+)
+
+func TestMergeBackups(t *testing.T) {
+	file := func(name string, size int64, modTime, source string) backupWithSource {
+		return backupWithSource{BackupFile: storage.BackupFile{Name: name, Size: size, ModTime: modTime}, source: source}
+	}
+
+	tests := []struct {
+		name    string
+		backups []backupWithSource
+		want    []mergedBackup
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name: "distinct backups keep their order",
+			backups: []backupWithSource{
+				file("app-2.enc", 20, "2024-01-02 00:00:00 UTC", "synology"),
+				file("app-1.enc", 10, "2024-01-01 00:00:00 UTC", "synology"),
+			},
+			want: []mergedBackup{
+				{name: "app-2.enc", size: 20, modTime: "2024-01-02 00:00:00 UTC", sources: []string{"synology"}},
+				{name: "app-1.enc", size: 10, modTime: "2024-01-01 00:00:00 UTC", sources: []string{"synology"}},
+			},
+		},
+		{
+			name: "copies are merged into the first",
+			backups: []backupWithSource{
+				file("app-2.enc", 20, "2024-01-02 00:00:00 UTC", "synology"),
+				file("app-1.enc", 10, "2024-01-01 00:00:00 UTC", "synology"),
+				file("app-2.enc", 21, "2024-01-02 00:00:05 UTC", "s3"),
+			},
+			want: []mergedBackup{
+				{name: "app-2.enc", size: 20, modTime: "2024-01-02 00:00:00 UTC", sources: []string{"synology", "s3"}},
+				{name: "app-1.enc", size: 10, modTime: "2024-01-01 00:00:00 UTC", sources: []string{"synology"}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mergeBackups(tt.backups); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("mergeBackups() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildFileTree(t *testing.T) {
+	dir := func(name string) backup.ArchiveEntry {
+		return backup.ArchiveEntry{Name: name, Type: tar.TypeDir}
+	}
+	file := func(name string, size int64) backup.ArchiveEntry {
+		return backup.ArchiveEntry{Name: name, Type: tar.TypeReg, Size: size}
+	}
+
+	tests := []struct {
+		name    string
+		entries []backup.ArchiveEntry
+		want    []string // path, kind and size of each node, depth first
+	}{
+		{
+			name: "empty",
+			want: []string{". dir 0"},
+		},
+		{
+			name:    "root entry",
+			entries: []backup.ArchiveEntry{dir("."), file("a.txt", 3)},
+			want:    []string{". dir 3", "a.txt file 3"},
+		},
+		{
+			name:    "missing parents are created",
+			entries: []backup.ArchiveEntry{file("data/sub/a.txt", 5)},
+			want:    []string{". dir 5", "data dir 5", "data/sub dir 5", "data/sub/a.txt file 5"},
+		},
+		{
+			name: "directories first, then by name",
+			entries: []backup.ArchiveEntry{
+				file("b.txt", 1),
+				file("a.txt", 2),
+				dir("z"),
+				file("z/c.txt", 4),
+				dir("m"),
+			},
+			want: []string{". dir 7", "m dir 0", "z dir 4", "z/c.txt file 4", "a.txt file 2", "b.txt file 1"},
+		},
+		{
+			name:    "backslashes and unclean names",
+			entries: []backup.ArchiveEntry{file(`data\a.txt`, 1), file("./data/b.txt", 2)},
+			want:    []string{". dir 3", "data dir 3", "data/a.txt file 1", "data/b.txt file 2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := buildFileTree(tt.entries)
+			var got []string
+			walkFileTree(root, func(n *fileNode) {
+				kind := "file"
+				if n.isDir {
+					kind = "dir"
+				}
+				got = append(got, fmt.Sprintf("%s %s %d", n.path, kind, n.size))
+				for _, c := range n.children {
+					if c.parent != n {
+						t.Errorf("%s has the wrong parent", c.path)
+					}
+				}
+			})
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("buildFileTree() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
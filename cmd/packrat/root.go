@@ -18,6 +18,9 @@ import (
 var (
 	cfgFile string
 	debug   bool
+
+	// configErr holds the error from reading the config file, if any
+	configErr error
 )
 
 // rootCmd represents the base command when called without any subcommands
@@ -26,7 +29,13 @@ var rootCmd = &cobra.Command{
 	Short: "A secure backup tool",
 	Long: `Packrat is a secure backup tool that encrypts and stores your data
 in various storage backends like Synology NAS.`,
-	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+	PersistentPreRun: func(c *cobra.Command, args []string) {
+		// Offline commands work without a config file, so don't warn about a missing one
+		if configErr != nil && c.Annotations[cmd.AnnotationOffline] != "true" {
+			// Report on stderr so commands that write data to stdout stay clean
+			fmt.Fprintf(os.Stderr, "Error reading config file: %v\n", configErr)
+		}
+
 		storage.Debug = debug
 		if debug {
 			log.Println("Debug mode enabled")
@@ -49,6 +58,8 @@ func init() {
 	rootCmd.AddCommand(cmd.BackupCmd())
 	rootCmd.AddCommand(cmd.InitCmd())
 	rootCmd.AddCommand(cmd.RekeyCmd())
+	rootCmd.AddCommand(cmd.DecryptCmd())
+	rootCmd.AddCommand(cmd.ExtractCmd())
 }
 
 // initConfig reads in config file and ENV variables if set
@@ -81,7 +92,7 @@ func initConfig() {
 			fmt.Printf("Config contents: %+v\n", viper.AllSettings())
 		}
 	} else {
-		fmt.Printf("Error reading config file: %v\n", err)
+		configErr = err
 	}
 }
 
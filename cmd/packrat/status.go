@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/dustin/go-humanize"
+	"github.com/logandonley/packrat/pkg/cmd"
+	"github.com/spf13/cobra"
+)
+
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show the daemon's jobs and services",
+	Long: `Show whether the daemon is running, the backups it is running or has
+queued, and for each service its next scheduled backup and how the last one
+went. Queued backups are listed in the order they will start.`,
+	Args: cobra.NoArgs,
+	RunE: func(c *cobra.Command, args []string) error {
+		client, err := cmd.DaemonClient()
+		if err != nil {
+			return err
+		}
+		if client == nil {
+			fmt.Println("The packrat daemon is not running")
+			return nil
+		}
+		status, err := client.Status()
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Daemon running (pid %d), started %s\n", status.PID, humanize.Time(status.Started))
+		if status.MaxConcurrentJobs > 0 {
+			fmt.Printf("Concurrent job limit: %d\n", status.MaxConcurrentJobs)
+		}
+
+		if len(status.Jobs) == 0 {
+			fmt.Println("\nNo backups running or queued")
+		} else {
+			fmt.Printf("\n%-24s %-8s %-8s %s\n", "SERVICE", "STATE", "PRIORITY", "SINCE")
+			for _, job := range status.Jobs {
+				since := job.Queued
+				if job.Started != nil {
+					since = *job.Started
+				}
+				fmt.Printf("%-24s %-8s %-8d %s\n", job.Service, job.State, job.Priority, humanize.Time(since))
+			}
+		}
+
+		if len(status.Services) > 0 {
+			fmt.Printf("\n%-24s %-20s %-20s %s\n", "SERVICE", "NEXT BACKUP", "LAST BACKUP", "RESULT")
+			for _, service := range status.Services {
+				next, last, result := "-", "-", "-"
+				if service.NextRun != nil {
+					next = humanize.Time(*service.NextRun)
+				}
+				if entry := service.LastBackup; entry != nil {
+					last = humanize.Time(entry.Finished)
+					result = historyResult(*entry)
+				}
+				fmt.Printf("%-24s %-20s %-20s %s\n", service.Name, next, last, result)
+			}
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(statusCmd)
+}
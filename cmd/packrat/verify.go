@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/dustin/go-humanize"
+	"github.com/logandonley/packrat/pkg/backup"
+	"github.com/logandonley/packrat/pkg/cmd"
+	"github.com/spf13/cobra"
+)
+
+var (
+	verifyBackupName string
+	verifySource     string
+)
+
+var verifyCmd = &cobra.Command{
+	Use:   "verify <service>",
+	Short: "Check that a backup can be restored",
+	Long: `Download a backup, decrypt and decompress it, and check every file in it
+against the backup's manifest, without restoring anything. The latest backup is
+verified unless --backup names another.`,
+	Example: `  packrat verify gitea
+  packrat verify gitea --backup gitea-2024-01-02T03-00-00Z.enc --source s3`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(c *cobra.Command, args []string) error {
+		serviceName := args[0]
+		result, err := verifyBackup(serviceName)
+		if err != nil {
+			return fmt.Errorf("failed to verify backup: %w", err)
+		}
+
+		fmt.Printf("Backup %s is OK: %d file(s), %s\n", result.Backup, result.Files, humanize.Bytes(uint64(result.Size)))
+		if !result.Manifest {
+			fmt.Println("It has no manifest, so its files could only be checked for being readable")
+		}
+		return nil
+	},
+}
+
+// verifyBackup verifies through the daemon if it's running, or standalone otherwise
+func verifyBackup(serviceName string) (*backup.VerifyResult, error) {
+	client, err := cmd.DaemonClient()
+	if err != nil {
+		return nil, err
+	}
+	if client != nil {
+		return client.Verify(serviceName, verifyBackupName, verifySource)
+	}
+
+	manager, err := createManager()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create backup manager: %w", err)
+	}
+	defer manager.Close()
+	return manager.VerifyBackup(serviceName, verifyBackupName, verifySource)
+}
+
+func init() {
+	verifyCmd.Flags().StringVar(&verifyBackupName, "backup", "", "Backup to verify (default the latest)")
+	verifyCmd.Flags().StringVar(&verifySource, "source", "", "Storage to verify from: synology or s3 (default either)")
+	rootCmd.AddCommand(verifyCmd)
+}
@@ -4,18 +4,21 @@ import (
 	"archive/tar"
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/bmatcuk/doublestar/v4"
-	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/client"
 	"github.com/klauspost/compress/zstd"
 	"github.com/logandonley/packrat/pkg/config"
@@ -67,24 +70,25 @@ func debugLog(format string, v ...interface{}) {
 type Manager struct {
 	config     *config.Config
 	key        []byte
-	dockerCli  *client.Client
 	backupRoot string
+	stateDir   string
 	Synology   storage.Storage
 	S3         storage.Storage
+
+	// Container engine, connected to on first use
+	runtimeMu sync.Mutex
+	runtime   ContainerRuntime
+
+	mu         sync.RWMutex
+	discovered map[string]discoveredService // Services declared by container labels
+
+	// Limits on concurrent jobs in the archive and upload stages
+	archiveLimit stageLimit
+	uploadLimit  stageLimit
 }
 
 // NewManager creates a new backup manager
 func NewManager(cfg *config.Config, key []byte) (*Manager, error) {
-	cli, err := client.NewClientWithOpts(client.FromEnv)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create Docker client: %w", err)
-	}
-
-	backupRoot := filepath.Join(os.TempDir(), "packrat-backups")
-	if err := os.MkdirAll(backupRoot, 0700); err != nil {
-		return nil, fmt.Errorf("failed to create backup directory: %w", err)
-	}
-
 	// Create Synology storage
 	synologyStorage, err := storage.NewSynologyStorage(&storage.SynologyConfig{
 		Host:     cfg.Backup.Synology.Host,
@@ -113,14 +117,44 @@ func NewManager(cfg *config.Config, key []byte) (*Manager, error) {
 		}
 	}
 
-	return &Manager{
+	return NewManagerWithStorage(cfg, key, synologyStorage, s3Storage)
+}
+
+// NewManagerWithStorage creates a backup manager that stores backups in the
+// given storages. s3Storage may be nil.
+func NewManagerWithStorage(cfg *config.Config, key []byte, synologyStorage, s3Storage storage.Storage) (*Manager, error) {
+	backupRoot := filepath.Join(os.TempDir(), "packrat-backups")
+	if err := os.MkdirAll(backupRoot, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create backup directory: %w", err)
+	}
+
+	stateDir, err := cfg.StateDirectory()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(stateDir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create state directory: %w", err)
+	}
+
+	manager := &Manager{
 		config:     cfg,
 		key:        key,
-		dockerCli:  cli,
 		backupRoot: backupRoot,
+		stateDir:   stateDir,
 		Synology:   synologyStorage,
 		S3:         s3Storage,
-	}, nil
+
+		archiveLimit: newStageLimit(cfg.Daemon.MaxConcurrentArchives),
+		uploadLimit:  newStageLimit(cfg.Daemon.MaxConcurrentUploads),
+	}
+
+	if cfg.Discovery.Enabled {
+		if err := manager.DiscoverServices(); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}
+
+	return manager, nil
 }
 
 // Close closes all connections
@@ -136,28 +170,31 @@ func (m *Manager) Close() error {
 			errs = append(errs, fmt.Errorf("failed to close S3 storage: %w", err))
 		}
 	}
+	m.runtimeMu.Lock()
+	if closer, ok := m.runtime.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to close container engine client: %w", err))
+		}
+	}
+	m.runtime = nil
+	m.runtimeMu.Unlock()
 	if len(errs) > 0 {
 		return fmt.Errorf("failed to close storages: %v", errs)
 	}
 	return nil
 }
 
-// executeCommand executes a command with the specified configuration
-func (m *Manager) executeCommand(cmd *config.Command, servicePath string) error {
+// executeCommand executes a command with the specified configuration. env is
+// added to the environment before the command's own variables.
+func (m *Manager) executeCommand(cmd *config.Command, servicePath string, env []string) error {
 	if cmd == nil {
 		return nil
 	}
 
 	// Parse timeout duration
-	var timeout time.Duration
-	var err error
-	if cmd.Timeout != "" {
-		timeout, err = time.ParseDuration(cmd.Timeout)
-		if err != nil {
-			return fmt.Errorf("invalid timeout duration: %w", err)
-		}
-	} else {
-		timeout = 5 * time.Minute // Default timeout
+	timeout, err := commandTimeout(cmd)
+	if err != nil {
+		return err
 	}
 
 	// Create context with timeout
@@ -175,12 +212,11 @@ func (m *Manager) executeCommand(cmd *config.Command, servicePath string) error
 	}
 
 	// Set environment variables
-	if len(cmd.Environment) > 0 {
-		env := os.Environ()
+	if len(env) > 0 || len(cmd.Environment) > 0 {
+		command.Env = append(os.Environ(), env...)
 		for key, value := range cmd.Environment {
-			env = append(env, fmt.Sprintf("%s=%s", key, value))
+			command.Env = append(command.Env, fmt.Sprintf("%s=%s", key, value))
 		}
-		command.Env = env
 	}
 
 	// Capture output
@@ -193,13 +229,50 @@ func (m *Manager) executeCommand(cmd *config.Command, servicePath string) error
 	return nil
 }
 
+// commandTimeout returns how long a command may run
+func commandTimeout(cmd *config.Command) (time.Duration, error) {
+	if cmd.Timeout == "" {
+		return 5 * time.Minute, nil // Default timeout
+	}
+	timeout, err := time.ParseDuration(cmd.Timeout)
+	if err != nil {
+		return 0, fmt.Errorf("invalid timeout duration: %w", err)
+	}
+	return timeout, nil
+}
+
+// BackupOptions controls how a backup is created
+type BackupOptions struct {
+	// Trigger records what started the backup in the run history (default manual)
+	Trigger string
+}
+
 // CreateBackup creates a backup of the specified service
 func (m *Manager) CreateBackup(serviceName string) error {
-	service, ok := m.config.Services[serviceName]
+	return m.CreateBackupWithOptions(serviceName, BackupOptions{})
+}
+
+// CreateBackupWithOptions creates a backup of the specified service using the given options
+func (m *Manager) CreateBackupWithOptions(serviceName string, opts BackupOptions) (err error) {
+	service, ok := m.service(serviceName)
 	if !ok {
 		return fmt.Errorf("service %s not found in configuration", serviceName)
 	}
 
+	// A job that can't get the lock didn't run, so it doesn't trigger the hooks
+	unlock, err := m.lockService(serviceName, "backup")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// Run the post-backup and notification hooks however the backup ends. This is
+	// deferred first so it runs after the container has been restarted, and the
+	// job is recorded in the history after that.
+	job := newHookJob("backup", serviceName, service.Path, opts.Trigger)
+	defer m.recordHistory(job)
+	defer m.finishBackup(service, job, &err)
+
 	// Create temporary directory for the backup
 	tmpDir := filepath.Join(m.backupRoot, fmt.Sprintf("%s-%d", serviceName, time.Now().Unix()))
 	if err := os.MkdirAll(tmpDir, 0700); err != nil {
@@ -208,24 +281,53 @@ func (m *Manager) CreateBackup(serviceName string) error {
 	defer os.RemoveAll(tmpDir)
 
 	// Execute pre-backup command if specified
-	if service.PreBackup != nil {
-		debugLog("Executing pre-backup command for service %s", serviceName)
-		if err := m.executeCommand(service.PreBackup, service.Path); err != nil {
-			return fmt.Errorf("failed to execute pre-backup command: %w", err)
-		}
+	if err := m.runHook("pre_backup", service.PreBackup, service, job); err != nil {
+		return err
 	}
 
+	// Capture dumps while the containers they run in are still up
+	dumps, err := m.captureDumps(service, job, tmpDir)
+	if err != nil {
+		return err
+	}
+	defer closeDumps(dumps)
+
+	// Find the volumes' data and record the container definitions before anything is stopped
+	volumes, err := m.resolveVolumes(service.Docker, false)
+	if err != nil {
+		return err
+	}
+	definitions, err := m.captureDefinitions(service.Docker)
+	if err != nil {
+		return fmt.Errorf("failed to record container definitions: %w", err)
+	}
+
+	// Archiving and encryption are the CPU-heavy part of a backup. The slot is
+	// taken before the containers are stopped so they aren't down while waiting.
+	releaseArchive := m.archiveLimit.acquire("archive", serviceName)
+	defer releaseArchive()
+
 	// Handle Docker container if specified
 	if service.Docker != nil {
-		if err := m.handleDockerContainer(service.Docker.Container, true); err != nil {
-			return fmt.Errorf("failed to handle Docker container: %w", err)
+		start, stopErr := m.stopServiceContainers(serviceName, service.Docker)
+		if stopErr != nil {
+			return fmt.Errorf("failed to handle Docker container: %w", stopErr)
+		}
+		if start != nil {
+			defer m.restartContainers(job, start, &err)
 		}
-		defer m.handleDockerContainer(service.Docker.Container, false)
 	}
 
 	// Create tar.gz archive in memory
 	archiveData := new(bytes.Buffer)
-	if err := m.createArchive(service.Path, archiveData); err != nil {
+	entries, err := m.createArchive(archiveSources{
+		path:    service.Path,
+		exclude: service.Exclude,
+		volumes: volumes,
+		dumps:   dumps,
+		meta:    definitions,
+	}, archiveData)
+	if err != nil {
 		return fmt.Errorf("failed to create archive: %w", err)
 	}
 
@@ -234,10 +336,13 @@ func (m *Manager) CreateBackup(serviceName string) error {
 	if err != nil {
 		return fmt.Errorf("failed to encrypt backup: %w", err)
 	}
+	releaseArchive()
 
 	// Create final backup name with timestamp
-	timestamp := time.Now().UTC().Format("2006-01-02T15-04-05Z")
+	timestamp := time.Now().UTC().Format(backupTimeFormat)
 	backupName := fmt.Sprintf("%s-%s.enc", serviceName, timestamp)
+	job.BackupName = backupName
+	job.Size = int64(len(encrypted))
 
 	// Save temporary local copy
 	localPath := filepath.Join(tmpDir, backupName)
@@ -245,50 +350,109 @@ func (m *Manager) CreateBackup(serviceName string) error {
 		return fmt.Errorf("failed to save backup locally: %w", err)
 	}
 
+	releaseUpload := m.uploadLimit.acquire("upload", serviceName)
+	defer releaseUpload()
+
 	// Upload to Synology
-	if err := m.Synology.Upload(localPath, backupName); err != nil {
+	if err := job.upload("synology", m.Synology, localPath, backupName); err != nil {
 		return fmt.Errorf("failed to upload to Synology: %w", err)
 	}
 
 	// Upload to S3 if configured
 	if m.S3 != nil {
-		if err := m.S3.Upload(localPath, backupName); err != nil {
+		if err := job.upload("s3", m.S3, localPath, backupName); err != nil {
 			return fmt.Errorf("failed to upload to S3: %w", err)
 		}
 	}
 
+	// The backup is complete without its manifest, which only speeds up browsing
+	manifest := &Manifest{
+		Service: serviceName,
+		Backup:  backupName,
+		Created: time.Now().UTC(),
+		Entries: entries,
+	}
+	if err := m.uploadManifest(tmpDir, manifest); err != nil {
+		log.Printf("Warning: failed to upload manifest for %s: %v", backupName, err)
+	}
+
 	return nil
 }
 
-func (m *Manager) createArchive(sourcePath string, output io.Writer) error {
+// archiveSources is what goes into a backup archive
+type archiveSources struct {
+	path    string          // Service directory, stored at the archive root
+	exclude []string        // Exclude patterns, matched against archive paths
+	volumes []archiveVolume // Docker volumes, stored under volumes/<name>
+	dumps   []capturedDump  // Dump command output, stored under .packrat/dumps
+	meta    []capturedDump  // Generated files, stored under .packrat
+}
+
+// createArchive writes a compressed archive of the service directory, volumes and
+// captured dumps to output and returns its entries, with content hashes, for the
+// backup's manifest
+func (m *Manager) createArchive(src archiveSources, output io.Writer) ([]ArchiveEntry, error) {
 	zw, err := zstd.NewWriter(output)
 	if err != nil {
-		return fmt.Errorf("failed to create zstd writer: %w", err)
+		return nil, fmt.Errorf("failed to create zstd writer: %w", err)
 	}
 	defer zw.Close()
 
 	tw := tar.NewWriter(zw)
 	defer tw.Close()
 
-	// Get service configuration to access exclude patterns
-	var excludePatterns []string
-	for _, service := range m.config.Services {
-		if strings.HasPrefix(sourcePath, service.Path) {
-			excludePatterns = service.Exclude
-			break
+	// First archived path of each multiply-linked inode
+	links := make(map[fileID]string)
+
+	var entries []ArchiveEntry
+	if src.path != "" {
+		if err := writeTree(tw, src.path, "", src.exclude, links, &entries); err != nil {
+			return nil, err
+		}
+	}
+
+	// Add the volumes, which must not shadow files from the service directory
+	if len(src.volumes) > 0 && slices.ContainsFunc(entries, func(e ArchiveEntry) bool { return e.Name == volumesDir }) {
+		return nil, fmt.Errorf("volumes conflict with %s in %s", volumesDir, src.path)
+	}
+	for _, v := range src.volumes {
+		if err := writeTree(tw, v.path, v.archiveName(), src.exclude, links, &entries); err != nil {
+			return nil, fmt.Errorf("failed to archive volume %s: %w", v.name, err)
 		}
 	}
 
-	return filepath.Walk(sourcePath, func(path string, info os.FileInfo, err error) error {
+	// Add the generated files and dumps, in a directory of their own
+	if len(src.meta) > 0 || len(src.dumps) > 0 {
+		if slices.ContainsFunc(entries, func(e ArchiveEntry) bool { return e.Name == metadataDir }) {
+			return nil, fmt.Errorf("generated files conflict with %s in %s", metadataDir, src.path)
+		}
+		metaEntries, err := writeDumps(tw, append(slices.Clip(src.meta), src.dumps...))
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, metaEntries...)
+	}
+
+	fillLinkHashes(entries)
+	return entries, nil
+}
+
+// writeTree archives the directory tree at root under prefix in the archive,
+// appending what it wrote to entries
+func writeTree(tw *tar.Writer, root, prefix string, excludePatterns []string, links map[fileID]string, entries *[]ArchiveEntry) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
 
-		// Get path relative to source directory for pattern matching
-		relPath, err := filepath.Rel(sourcePath, path)
+		// Get the path in the archive for pattern matching
+		relPath, err := filepath.Rel(root, path)
 		if err != nil {
 			return fmt.Errorf("failed to get relative path: %w", err)
 		}
+		if prefix != "" {
+			relPath = filepath.Join(prefix, relPath)
+		}
 
 		// Skip excluded files/directories
 		if isExcluded(relPath, excludePatterns) {
@@ -298,182 +462,473 @@ func (m *Manager) createArchive(sourcePath string, output io.Writer) error {
 			return nil
 		}
 
+		// Symlinks are archived with their target so they can be recreated
+		var linkTarget string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if linkTarget, err = os.Readlink(path); err != nil {
+				return fmt.Errorf("failed to read symlink: %w", err)
+			}
+		}
+
 		// Create tar header
-		header, err := tar.FileInfoHeader(info, info.Name())
+		header, err := tar.FileInfoHeader(info, linkTarget)
 		if err != nil {
 			return fmt.Errorf("failed to create tar header: %w", err)
 		}
 
-		// Update header name to be relative to source directory
 		header.Name = relPath
 
-		// Write header
-		if err := tw.WriteHeader(header); err != nil {
-			return fmt.Errorf("failed to write tar header: %w", err)
+		// Store additional links to an already archived inode as hard links
+		if id, ok := hardLinkID(info); ok {
+			if first, seen := links[id]; seen {
+				header.Typeflag = tar.TypeLink
+				header.Linkname = first
+				header.Size = 0
+				if err := tw.WriteHeader(header); err != nil {
+					return fmt.Errorf("failed to write tar header: %w", err)
+				}
+				*entries = append(*entries, entryFromHeader(header))
+				return nil
+			}
+			links[id] = relPath
 		}
 
-		// If it's a regular file, write the contents
-		if info.Mode().IsRegular() {
-			file, err := os.Open(path)
-			if err != nil {
-				return fmt.Errorf("failed to open file: %w", err)
+		// Record xattrs, ACLs and precise timestamps alongside ownership
+		if err := recordMetadata(header, path); err != nil {
+			return err
+		}
+
+		// If it's not a regular file, the header is all there is
+		if !info.Mode().IsRegular() {
+			if err := tw.WriteHeader(header); err != nil {
+				return fmt.Errorf("failed to write tar header: %w", err)
 			}
-			defer file.Close()
+			*entries = append(*entries, entryFromHeader(header))
+			return nil
+		}
 
-			if _, err := io.Copy(tw, file); err != nil {
-				return fmt.Errorf("failed to write file contents: %w", err)
+		file, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("failed to open file: %w", err)
+		}
+		defer file.Close()
+
+		// Map the holes of sparse files so they can be recreated on restore
+		var regions []sparseRegion
+		if isSparse(info) {
+			regions, err = findDataRegions(file, info.Size())
+			if err != nil {
+				return fmt.Errorf("failed to map sparse file %s: %w", path, err)
+			}
+			if regions != nil {
+				if header.PAXRecords == nil {
+					header.PAXRecords = make(map[string]string)
+				}
+				header.PAXRecords[paxSparseMap] = formatSparseMap(regions)
 			}
 		}
 
+		// Write header
+		if err := tw.WriteHeader(header); err != nil {
+			return fmt.Errorf("failed to write tar header: %w", err)
+		}
+
+		// Write the contents, hashing them for the manifest
+		hash := sha256.New()
+		contents := io.MultiWriter(tw, hash)
+		if regions != nil {
+			err = writeSparseContents(contents, file, regions, info.Size())
+		} else {
+			_, err = io.Copy(contents, file)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to write file contents: %w", err)
+		}
+
+		entry := entryFromHeader(header)
+		entry.SHA256 = hex.EncodeToString(hash.Sum(nil))
+		*entries = append(*entries, entry)
+
 		return nil
 	})
 }
 
-func (m *Manager) handleDockerContainer(containerName string, stop bool) error {
-	ctx := context.Background()
-	timeout := time.After(2 * time.Minute)
+// RestoreOptions controls how a backup is restored
+type RestoreOptions struct {
+	// Mirror removes files under the service path that are not present in the
+	// backup, so the restored directory matches the archive exactly. Paths
+	// matching the service's exclude patterns are never removed.
+	Mirror bool
 
-	if stop {
-		log.Printf("Stopping Docker container: %s", containerName)
-		timeoutSeconds := 30 // Give containers 30 seconds to stop gracefully
-		if err := m.dockerCli.ContainerStop(ctx, containerName, container.StopOptions{Timeout: &timeoutSeconds}); err != nil {
-			return fmt.Errorf("failed to stop container: %w", err)
-		}
+	// SkipOwnership leaves restored files owned by the restoring user
+	SkipOwnership bool
 
-		// Wait for container to actually stop
-		for {
-			select {
-			case <-timeout:
-				return fmt.Errorf("timeout waiting for container %s to stop", containerName)
-			default:
-				info, err := m.dockerCli.ContainerInspect(ctx, containerName)
-				if err != nil {
-					return fmt.Errorf("failed to inspect container: %w", err)
-				}
-				if !info.State.Running {
-					log.Printf("Container %s stopped successfully", containerName)
-					return nil
-				}
-				time.Sleep(100 * time.Millisecond)
-			}
+	// NumericOwner restores the recorded uid/gid as-is instead of mapping
+	// user and group names to this host's IDs
+	NumericOwner bool
+
+	// SkipXattrs skips restoring extended attributes, ACLs and SELinux labels
+	SkipXattrs bool
+
+	// Source restricts the download to one storage destination ("synology" or "s3").
+	// By default Synology is tried first, then S3.
+	Source string
+
+	// Paths limits the restore to these archive paths and everything below
+	// them. Empty restores the whole backup.
+	Paths []string
+
+	// TargetPath extracts into this directory instead of the service path.
+	// The service's container is left running when restoring elsewhere.
+	TargetPath string
+
+	// VolumePaths maps Docker volume names to the directories their contents are
+	// extracted into. Volumes not listed are extracted to volumes/<name> under
+	// the target path.
+	VolumePaths map[string]string
+
+	// RecreateContainers replaces the service's containers with ones created
+	// from the definitions stored in the backup, pulling their images first.
+	// Only for restores to the service path.
+	RecreateContainers bool
+
+	// DumpsPath extracts the dumps stored in the backup into this directory.
+	// Restoring in place leaves them out otherwise.
+	DumpsPath string
+
+	// skipMetadata leaves out the .packrat directory of container definitions
+	// and dumps, except for dumps extracted to DumpsPath
+	skipMetadata bool
+
+	// Progress, if set, is called after each entry is extracted
+	Progress func(name string, size int64)
+}
+
+// targetPath returns the directory a restore extracts into
+func (o RestoreOptions) targetPath(service config.Service) string {
+	if o.TargetPath != "" {
+		return o.TargetPath
+	}
+	return service.Path
+}
+
+// SamePath reports whether two paths refer to the same directory, after making
+// them absolute and resolving symlinks where they exist
+func SamePath(a, b string) bool {
+	if a == "" || b == "" {
+		return a == b
+	}
+	return resolvePath(a) == resolvePath(b)
+}
+
+func resolvePath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	return filepath.Clean(path)
+}
+
+// entryTarget returns where an archive entry is extracted to
+func (o RestoreOptions) entryTarget(destPath, name string) (string, error) {
+	if o.DumpsPath != "" && isDump(name) {
+		rel, err := filepath.Rel(dumpsDir, filepath.Clean(name))
+		if err != nil {
+			return "", fmt.Errorf("failed to get dump path: %w", err)
 		}
-	} else {
-		log.Printf("Starting Docker container: %s", containerName)
-		if err := m.dockerCli.ContainerStart(ctx, containerName, container.StartOptions{}); err != nil {
-			return fmt.Errorf("failed to start container: %w", err)
+		return filepath.Join(o.DumpsPath, rel), nil
+	}
+	if volumeName, inside, ok := splitVolumeName(name); ok {
+		if dir, ok := o.VolumePaths[volumeName]; ok {
+			return filepath.Join(dir, inside), nil
 		}
+	}
+	if destPath == "" {
+		return "", fmt.Errorf("nowhere to restore %s: the service has no path", name)
+	}
+	return filepath.Join(destPath, name), nil
+}
 
-		// Wait for container to be healthy if it has a healthcheck
-		info, err := m.dockerCli.ContainerInspect(ctx, containerName)
-		if err != nil {
-			return fmt.Errorf("failed to inspect container: %w", err)
-		}
-
-		if info.State.Health != nil {
-			log.Printf("Waiting for container %s to be healthy...", containerName)
-			for {
-				select {
-				case <-timeout:
-					return fmt.Errorf("timeout waiting for container %s to become healthy", containerName)
-				default:
-					info, err := m.dockerCli.ContainerInspect(ctx, containerName)
-					if err != nil {
-						return fmt.Errorf("failed to inspect container health: %w", err)
-					}
-					if info.State.Health.Status == "healthy" {
-						log.Printf("Container %s is healthy", containerName)
-						return nil
-					}
-					if info.State.Health.Status == "unhealthy" {
-						return fmt.Errorf("container %s is unhealthy after start", containerName)
-					}
-					time.Sleep(1 * time.Second)
-				}
-			}
-		} else {
-			// If no healthcheck, just wait for it to be running
-			for {
-				select {
-				case <-timeout:
-					return fmt.Errorf("timeout waiting for container %s to start", containerName)
-				default:
-					info, err := m.dockerCli.ContainerInspect(ctx, containerName)
-					if err != nil {
-						return fmt.Errorf("failed to inspect container: %w", err)
-					}
-					if info.State.Running {
-						log.Printf("Container %s started successfully", containerName)
-						return nil
-					}
-					if info.State.ExitCode != 0 {
-						return fmt.Errorf("container %s failed to start (exit code: %d)", containerName, info.State.ExitCode)
-					}
-					time.Sleep(100 * time.Millisecond)
-				}
-			}
+// checkEntryName rejects archive paths that lead outside the restore directory
+func checkEntryName(name string) error {
+	clean := filepath.Clean(name)
+	if filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("refusing to extract %s: the path leads outside the restore directory", name)
+	}
+	return nil
+}
+
+// checkSymlink rejects symlinks in the archive that point outside the restore directory
+func checkSymlink(name, linkname string) error {
+	if filepath.IsAbs(linkname) || checkEntryName(filepath.Join(filepath.Dir(filepath.Clean(name)), linkname)) != nil {
+		return fmt.Errorf("refusing to extract %s: it links to %s, outside the restore directory", name, linkname)
+	}
+	return nil
+}
+
+// skipsMetadata reports whether an archive entry is generated by packrat and
+// left out of the restore
+func (o RestoreOptions) skipsMetadata(name string) bool {
+	return o.skipMetadata && isMetadata(name) && (o.DumpsPath == "" || !isDump(name))
+}
+
+// includes reports whether an archive entry is part of the restore
+func (o RestoreOptions) includes(name string) bool {
+	if len(o.Paths) == 0 {
+		return true
+	}
+	name = filepath.Clean(name)
+	for _, p := range o.Paths {
+		p = filepath.Clean(p)
+		if p == "." || name == p || strings.HasPrefix(name, p+string(filepath.Separator)) {
+			return true
 		}
 	}
+	return false
 }
 
 // RestoreBackup restores a backup of the specified service
 func (m *Manager) RestoreBackup(serviceName, backupName string) error {
-	service, ok := m.config.Services[serviceName]
+	return m.RestoreBackupWithOptions(serviceName, backupName, RestoreOptions{})
+}
+
+// RestoreBackupWithOptions restores a backup of the specified service using the given options
+func (m *Manager) RestoreBackupWithOptions(serviceName, backupName string, opts RestoreOptions) (err error) {
+	service, ok := m.service(serviceName)
 	if !ok {
 		return fmt.Errorf("service %s not found in configuration", serviceName)
 	}
 
-	// Create temporary directory for the restore
-	tmpDir := filepath.Join(m.backupRoot, fmt.Sprintf("%s-restore-%d", serviceName, time.Now().Unix()))
-	if err := os.MkdirAll(tmpDir, 0700); err != nil {
-		return fmt.Errorf("failed to create temporary directory: %w", err)
+	if opts.Mirror && len(opts.Paths) > 0 {
+		return fmt.Errorf("a mirror restore can't be limited to specific paths")
 	}
-	defer os.RemoveAll(tmpDir)
 
-	// Download the backup file
-	encryptedPath := filepath.Join(tmpDir, backupName)
+	// Restoring in place takes the service's lock, as it replaces the data and
+	// may stop the containers
+	destPath := opts.targetPath(service)
+	inPlace := SamePath(destPath, service.Path)
+	if inPlace {
+		unlock, err := m.lockService(serviceName, "restore")
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
 
-	// Try to download from Synology first
-	err := m.Synology.Download(backupName, encryptedPath)
+	decrypted, err := m.fetchBackup(serviceName, backupName, opts.Source)
 	if err != nil {
-		// If not found in Synology and S3 is configured, try S3
-		if m.S3 != nil {
-			if err := m.S3.Download(backupName, encryptedPath); err != nil {
-				return fmt.Errorf("failed to download backup from any storage: %w", err)
+		return err
+	}
+
+	var specs []containerSpec
+	if opts.RecreateContainers {
+		if !inPlace {
+			return fmt.Errorf("containers can only be recreated when restoring to the service path")
+		}
+		if specs, err = readContainerSpecs(decrypted); err != nil {
+			return err
+		}
+	}
+
+	job := newHookJob("restore", serviceName, service.Path, TriggerManual)
+	job.RestorePath = destPath
+	job.BackupName = backupName
+	defer m.recordHistory(job)
+
+	if err := m.runHook("pre_restore", service.PreRestore, service, job); err != nil {
+		job.Err = err
+		return err
+	}
+
+	// Once the restore has started, run the post-restore hook however it ends,
+	// after the container is back up
+	defer func() {
+		job.Err = err
+		if hookErr := m.runHook("post_restore", service.PostRestore, service, job); hookErr != nil {
+			if err == nil {
+				err = hookErr
+			} else {
+				log.Printf("Warning: %v", hookErr)
 			}
-		} else {
-			return fmt.Errorf("failed to download backup from Synology: %w", err)
+		}
+		job.Err = err
+	}()
+
+	// Restoring in place puts volumes back where their data lives, creating
+	// them if needed, and leaves out packrat's own files. Restoring a copy
+	// elsewhere doesn't touch the live data, so the containers can keep running.
+	if inPlace {
+		volumes, err := m.resolveVolumes(service.Docker, true)
+		if err != nil {
+			return err
+		}
+		opts.VolumePaths = volumePaths(volumes)
+		opts.skipMetadata = true
+	}
+	switch {
+	case opts.RecreateContainers:
+		timeouts := defaultDockerTimeouts()
+		if service.Docker != nil {
+			if timeouts, err = parseDockerTimeouts(service.Docker); err != nil {
+				return err
+			}
+		}
+		// Pull first, so an image that can't be pulled doesn't leave the service down
+		if err := m.pullImages(specs); err != nil {
+			return err
+		}
+		record, removeErr := m.removeContainers(serviceName, specs, timeouts)
+		if record != nil {
+			// Bring back what was removed, even if removing the rest failed
+			defer m.recreateContainers(job, record, timeouts, &err)
+		}
+		if removeErr != nil {
+			return fmt.Errorf("failed to remove containers: %w", removeErr)
+		}
+	case service.Docker != nil && inPlace:
+		start, stopErr := m.stopServiceContainers(serviceName, service.Docker)
+		if stopErr != nil {
+			return fmt.Errorf("failed to handle Docker container: %w", stopErr)
+		}
+		if start != nil {
+			defer m.restartContainers(job, start, &err)
 		}
 	}
 
-	// Read the encrypted backup
-	encrypted, err := os.ReadFile(encryptedPath)
+	// Remove stale files before extracting so type changes (file <-> directory) succeed
+	if opts.Mirror {
+		entries, err := readArchiveEntries(bytes.NewReader(decrypted))
+		if err != nil {
+			return fmt.Errorf("failed to read archive: %w", err)
+		}
+		removed, err := pruneStale(destPath, entries, service.Exclude, opts.VolumePaths, false)
+		if err != nil {
+			return fmt.Errorf("failed to remove stale files: %w", err)
+		}
+		log.Printf("Removed %d path(s) not present in backup %s", len(removed), backupName)
+	}
+
+	// Extract the archive
+	if err := ExtractArchive(bytes.NewReader(decrypted), destPath, opts); err != nil {
+		return fmt.Errorf("failed to extract archive: %w", err)
+	}
+
+	return nil
+}
+
+// PreviewMirrorRestore returns the paths, relative to the service path, that a
+// mirror restore of the given backup would delete. Nothing is modified.
+func (m *Manager) PreviewMirrorRestore(serviceName, backupName string, opts RestoreOptions) ([]string, error) {
+	service, ok := m.service(serviceName)
+	if !ok {
+		return nil, fmt.Errorf("service %s not found in configuration", serviceName)
+	}
+
+	decrypted, err := m.fetchBackup(serviceName, backupName, opts.Source)
 	if err != nil {
-		return fmt.Errorf("failed to read backup file: %w", err)
+		return nil, err
+	}
+
+	entries, err := readArchiveEntries(bytes.NewReader(decrypted))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read archive: %w", err)
+	}
+
+	// Volumes that don't exist yet have nothing to prune
+	destPath := opts.targetPath(service)
+	if SamePath(destPath, service.Path) && service.Docker != nil {
+		opts.VolumePaths = nil
+		for _, name := range service.Docker.Volumes {
+			v, err := m.resolveVolume(name, false)
+			if err != nil {
+				if client.IsErrNotFound(err) {
+					continue
+				}
+				return nil, err
+			}
+			if opts.VolumePaths == nil {
+				opts.VolumePaths = make(map[string]string)
+			}
+			opts.VolumePaths[v.name] = v.path
+		}
+	}
+
+	return pruneStale(destPath, entries, service.Exclude, opts.VolumePaths, true)
+}
+
+// fetchBackup downloads a backup and returns the decrypted archive. Without a
+// source, the backup is downloaded from the first storage that has it.
+func (m *Manager) fetchBackup(serviceName, backupName, source string) ([]byte, error) {
+	encrypted, err := m.downloadFile(serviceName, backupName, source)
+	if err != nil {
+		return nil, err
 	}
 
 	// Decrypt the backup
 	decrypted, err := crypto.Decrypt(m.key, encrypted)
 	if err != nil {
-		return fmt.Errorf("failed to decrypt backup: %w", err)
+		return nil, fmt.Errorf("failed to decrypt backup: %w", err)
 	}
 
-	// Handle Docker container if specified
-	if service.Docker != nil {
-		if err := m.handleDockerContainer(service.Docker.Container, true); err != nil {
-			return fmt.Errorf("failed to handle Docker container: %w", err)
+	return decrypted, nil
+}
+
+// downloadFile downloads a stored file and returns its encrypted contents. Without
+// a source, the file is downloaded from the first storage that has it.
+func (m *Manager) downloadFile(serviceName, remoteName, source string) ([]byte, error) {
+	// Create temporary directory for the download
+	tmpDir, err := os.MkdirTemp(m.backupRoot, serviceName+"-restore-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// Download the file
+	encryptedPath := filepath.Join(tmpDir, remoteName)
+
+	switch source {
+	case "":
+		// Try to download from Synology first
+		err := m.Synology.Download(remoteName, encryptedPath)
+		if err != nil {
+			// If not found in Synology and S3 is configured, try S3
+			if m.S3 != nil {
+				if err := m.S3.Download(remoteName, encryptedPath); err != nil {
+					return nil, fmt.Errorf("failed to download %s from any storage: %w", remoteName, err)
+				}
+			} else {
+				return nil, fmt.Errorf("failed to download %s from Synology: %w", remoteName, err)
+			}
 		}
-		defer m.handleDockerContainer(service.Docker.Container, false)
+	case "synology":
+		if err := m.Synology.Download(remoteName, encryptedPath); err != nil {
+			return nil, fmt.Errorf("failed to download %s from Synology: %w", remoteName, err)
+		}
+	case "s3":
+		if m.S3 == nil {
+			return nil, fmt.Errorf("S3 storage is not configured")
+		}
+		if err := m.S3.Download(remoteName, encryptedPath); err != nil {
+			return nil, fmt.Errorf("failed to download %s from S3: %w", remoteName, err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown storage destination: %s", source)
 	}
 
-	// Extract the archive
-	if err := m.extractArchive(bytes.NewReader(decrypted), service.Path); err != nil {
-		return fmt.Errorf("failed to extract archive: %w", err)
+	// Read the encrypted file
+	encrypted, err := os.ReadFile(encryptedPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read downloaded file: %w", err)
 	}
 
-	return nil
+	return encrypted, nil
 }
 
-func (m *Manager) extractArchive(input io.Reader, destPath string) error {
+// ExtractArchive extracts a decrypted, zstd-compressed backup archive into destPath.
+// It needs no configuration, storage or Docker access, so it also serves offline recovery.
+func ExtractArchive(input io.Reader, destPath string, opts RestoreOptions) error {
 	// Create zstd reader
 	zr, err := zstd.NewReader(input)
 	if err != nil {
@@ -483,6 +938,7 @@ func (m *Manager) extractArchive(input io.Reader, destPath string) error {
 
 	// Create tar reader
 	tr := tar.NewReader(zr)
+	metadata := newMetadataRestorer(opts)
 
 	// Extract each file
 	for {
@@ -494,8 +950,30 @@ func (m *Manager) extractArchive(input io.Reader, destPath string) error {
 			return fmt.Errorf("failed to read tar header: %w", err)
 		}
 
+		// Nothing in the archive may write or link outside the restore directory
+		if err := checkEntryName(header.Name); err != nil {
+			return err
+		}
+		switch header.Typeflag {
+		case tar.TypeSymlink:
+			err = checkSymlink(header.Name, header.Linkname)
+		case tar.TypeLink:
+			err = checkEntryName(header.Linkname)
+		}
+		if err != nil {
+			return err
+		}
+
+		// Skip entries outside the requested paths
+		if !opts.includes(header.Name) || opts.skipsMetadata(header.Name) {
+			continue
+		}
+
 		// Get the target path
-		target := filepath.Join(destPath, header.Name)
+		target, err := opts.entryTarget(destPath, header.Name)
+		if err != nil {
+			return err
+		}
 
 		// Create parent directories if needed
 		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
@@ -525,8 +1003,16 @@ func (m *Manager) extractArchive(input io.Reader, destPath string) error {
 				return fmt.Errorf("failed to create file: %w", err)
 			}
 
-			// Copy contents
-			if _, err := io.Copy(file, tr); err != nil {
+			// Copy contents, recreating holes for entries archived as sparse
+			regions, sparse, err := sparseRegions(header)
+			if err == nil {
+				if sparse {
+					err = extractSparseContents(file, tr, regions, header.Size)
+				} else {
+					_, err = io.Copy(file, tr)
+				}
+			}
+			if err != nil {
 				file.Close()
 				return fmt.Errorf("failed to write file contents: %w", err)
 			}
@@ -548,7 +1034,11 @@ func (m *Manager) extractArchive(input io.Reader, destPath string) error {
 				return fmt.Errorf("failed to remove existing link: %w", err)
 			}
 			// Create new hard link
-			if err := os.Link(filepath.Join(destPath, header.Linkname), target); err != nil {
+			linkTarget, err := opts.entryTarget(destPath, header.Linkname)
+			if err != nil {
+				return err
+			}
+			if err := os.Link(linkTarget, target); err != nil {
 				return fmt.Errorf("failed to create hard link: %w", err)
 			}
 
@@ -572,14 +1062,35 @@ func (m *Manager) extractArchive(input io.Reader, destPath string) error {
 		default:
 			return fmt.Errorf("unsupported file type: %d in %s", header.Typeflag, header.Name)
 		}
+
+		// Hard links share the inode, and with it the metadata, of their target
+		if header.Typeflag != tar.TypeLink {
+			if err := metadata.apply(target, header); err != nil {
+				return err
+			}
+		}
+
+		if opts.Progress != nil {
+			opts.Progress(header.Name, header.Size)
+		}
 	}
 
-	return nil
+	return metadata.finish()
 }
 
-// GetServices returns the configured services
+// GetServices returns the configured services and those discovered from container labels
 func (m *Manager) GetServices() map[string]config.Service {
-	return m.config.Services
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	services := make(map[string]config.Service, len(m.config.Services)+len(m.discovered))
+	for name, d := range m.discovered {
+		services[name] = d.service
+	}
+	for name, service := range m.config.Services {
+		services[name] = service
+	}
+	return services
 }
 
 // CleanupBackups removes old backups while keeping the most recent ones
@@ -587,7 +1098,7 @@ func (m *Manager) CleanupBackups(serviceName string) (map[string]int, error) {
 	deletedCounts := make(map[string]int)
 
 	// Get services to clean up
-	services := m.config.Services
+	services := m.GetServices()
 	if serviceName != "" {
 		service, ok := services[serviceName]
 		if !ok {
@@ -605,10 +1116,11 @@ func (m *Manager) CleanupBackups(serviceName string) (map[string]int, error) {
 		}
 
 		// Clean up Synology backups
-		synologyBackups, err := m.Synology.List(name + "-")
+		synologyFiles, err := m.Synology.List(name + "-")
 		if err != nil {
 			return nil, fmt.Errorf("failed to list Synology backups: %w", err)
 		}
+		synologyBackups, synologyManifests := splitManifests(synologyFiles)
 
 		// Sort backups by modification time (newest first)
 		sort.Slice(synologyBackups, func(i, j int) bool {
@@ -629,6 +1141,7 @@ func (m *Manager) CleanupBackups(serviceName string) (map[string]int, error) {
 					}
 					return nil, fmt.Errorf("failed to delete Synology backup %s: %w", backup.Name, err)
 				}
+				m.deleteManifest(m.Synology, synologyManifests, backup.Name)
 				deletedCount++
 			}
 			deletedCounts[name+"_synology"] = deletedCount
@@ -636,10 +1149,11 @@ func (m *Manager) CleanupBackups(serviceName string) (map[string]int, error) {
 
 		// Clean up S3 backups if configured
 		if m.S3 != nil {
-			s3Backups, err := m.S3.List(name + "-")
+			s3Files, err := m.S3.List(name + "-")
 			if err != nil {
 				return nil, fmt.Errorf("failed to list S3 backups: %w", err)
 			}
+			s3Backups, s3Manifests := splitManifests(s3Files)
 
 			// Sort backups by modification time (newest first)
 			sort.Slice(s3Backups, func(i, j int) bool {
@@ -655,6 +1169,7 @@ func (m *Manager) CleanupBackups(serviceName string) (map[string]int, error) {
 					if err := m.S3.Delete(backup.Name); err != nil {
 						return nil, fmt.Errorf("failed to delete S3 backup %s: %w", backup.Name, err)
 					}
+					m.deleteManifest(m.S3, s3Manifests, backup.Name)
 					deletedCount++
 				}
 				deletedCounts[name+"_s3"] = deletedCount
@@ -680,9 +1195,11 @@ func (m *Manager) GetConfig() *config.Config {
 
 // ValidateDockerContainer checks if a Docker container exists and is accessible
 func (m *Manager) ValidateDockerContainer(containerName string) error {
-	ctx := context.Background()
-	_, err := m.dockerCli.ContainerInspect(ctx, containerName)
+	runtime, err := m.containerRuntime()
 	if err != nil {
+		return err
+	}
+	if _, err := runtime.Inspect(context.Background(), containerName); err != nil {
 		return fmt.Errorf("failed to inspect container %s: %w", containerName, err)
 	}
 	return nil
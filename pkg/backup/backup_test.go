@@ -155,8 +155,10 @@ func TestBackupManager_CreateBackup(t *testing.T) {
 		t.Fatalf("Failed to list backups: %v", err)
 	}
 
-	if len(files) != 1 {
-		t.Errorf("Expected 1 backup, got %d", len(files))
+	if backups := BackupFiles(files); len(backups) != 1 {
+		t.Errorf("Expected 1 backup, got %d", len(backups))
+	} else if _, ok := mockStorage.files[ManifestName(backups[0].Name)]; !ok {
+		t.Errorf("Expected a manifest next to backup %s", backups[0].Name)
 	}
 
 	// Verify backup contents
@@ -251,6 +253,133 @@ func TestManager_RestoreBackup(t *testing.T) {
 	}
 }
 
+func TestArchiveSymlinks(t *testing.T) {
+	srcDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(srcDir, "sub"), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(srcDir, "target.txt"), []byte("data"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	links := map[string]string{
+		"sub/link":    "../target.txt",
+		"dangling":    "missing.txt",
+		"sub/dirlink": ".",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(srcDir, name)); err != nil {
+			t.Fatalf("Failed to create symlink: %v", err)
+		}
+	}
+
+	manager := &Manager{config: &config.Config{}}
+	var archive bytes.Buffer
+	entries, err := manager.createArchive(archiveSources{path: srcDir}, &archive)
+	if err != nil {
+		t.Fatalf("Failed to create archive: %v", err)
+	}
+	for _, e := range entries {
+		if target, ok := links[e.Name]; ok && (e.Type != tar.TypeSymlink || e.Linkname != target) {
+			t.Errorf("Entry %s = type %c linkname %q, want a symlink to %q", e.Name, e.Type, e.Linkname, target)
+		}
+	}
+
+	destDir := t.TempDir()
+	if err := ExtractArchive(bytes.NewReader(archive.Bytes()), destDir, RestoreOptions{}); err != nil {
+		t.Fatalf("Failed to extract archive: %v", err)
+	}
+	for name, want := range links {
+		got, err := os.Readlink(filepath.Join(destDir, name))
+		if err != nil {
+			t.Errorf("Failed to read restored symlink %s: %v", name, err)
+		} else if got != want {
+			t.Errorf("Restored symlink %s points to %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestExtractArchiveUnsafePaths(t *testing.T) {
+	tests := []struct {
+		name   string
+		header tar.Header
+	}{
+		{name: "absolute path", header: tar.Header{Name: "/tmp/escaped.txt", Typeflag: tar.TypeReg, Mode: 0644}},
+		{name: "parent directory", header: tar.Header{Name: "../escaped.txt", Typeflag: tar.TypeReg, Mode: 0644}},
+		{name: "parent directory inside the path", header: tar.Header{Name: "data/../../escaped.txt", Typeflag: tar.TypeReg, Mode: 0644}},
+		{name: "absolute symlink", header: tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "/etc/hostname"}},
+		{name: "symlink out of the directory", header: tar.Header{Name: "data/link", Typeflag: tar.TypeSymlink, Linkname: "../../escaped.txt"}},
+		{name: "hard link out of the directory", header: tar.Header{Name: "link", Typeflag: tar.TypeLink, Linkname: "../escaped.txt"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var archive bytes.Buffer
+			zw, err := zstd.NewWriter(&archive)
+			if err != nil {
+				t.Fatalf("Failed to create zstd writer: %v", err)
+			}
+			tw := tar.NewWriter(zw)
+			if err := tw.WriteHeader(&tt.header); err != nil {
+				t.Fatalf("Failed to write tar header: %v", err)
+			}
+			tw.Close()
+			zw.Close()
+
+			// Extract into a subdirectory so anything escaping it would be visible
+			parent := t.TempDir()
+			destDir := filepath.Join(parent, "restore")
+			if err := ExtractArchive(&archive, destDir, RestoreOptions{}); err == nil {
+				t.Errorf("Expected extracting %s to fail", tt.header.Name)
+			}
+			entries, err := os.ReadDir(parent)
+			if err != nil {
+				t.Fatalf("Failed to read directory: %v", err)
+			}
+			for _, e := range entries {
+				if e.Name() != "restore" {
+					t.Errorf("Extraction created %s outside the restore directory", e.Name())
+				}
+			}
+		})
+	}
+}
+
+func TestSamePath(t *testing.T) {
+	dir := t.TempDir()
+	service := filepath.Join(dir, "service")
+	if err := os.Mkdir(service, 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := os.Symlink(service, filepath.Join(dir, "link")); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Failed to get working directory: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		a, b string
+		want bool
+	}{
+		{"identical", service, service, true},
+		{"trailing slash", service + "/", service, true},
+		{"dot segments", filepath.Join(dir, "other", "..", "service"), service, true},
+		{"symlink", filepath.Join(dir, "link"), service, true},
+		{"relative", ".", wd, true},
+		{"missing path", filepath.Join(dir, "missing") + "/", filepath.Join(dir, "missing"), true},
+		{"different", filepath.Join(dir, "other"), service, false},
+		{"empty", "", service, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SamePath(tt.a, tt.b); got != tt.want {
+				t.Errorf("SamePath(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+			}
+		})
+	}
+}
+
 func TestExcludePatterns(t *testing.T) {
 	// Create a temporary test directory structure
 	tmpDir, err := os.MkdirTemp("", "backup-exclude-test")
@@ -305,7 +434,7 @@ func TestExcludePatterns(t *testing.T) {
 
 	// Create archive
 	var buf bytes.Buffer
-	if err := manager.createArchive(tmpDir, &buf); err != nil {
+	if _, err := manager.createArchive(archiveSources{path: tmpDir, exclude: cfg.Services["test"].Exclude}, &buf); err != nil {
 		t.Fatalf("Failed to create archive: %v", err)
 	}
 
@@ -478,3 +607,12 @@ func TestCleanupBackups(t *testing.T) {
 		})
 	}
 }
+
+// failingStorage rejects every upload
+type failingStorage struct {
+	mockStorage
+}
+
+func (f *failingStorage) Upload(localPath, remoteName string) error {
+	return fmt.Errorf("storage unavailable")
+}
@@ -0,0 +1,166 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// ArchiveEntry describes a file, directory or link stored in a backup
+type ArchiveEntry struct {
+	// Name is the path relative to the service directory ("." for the root)
+	Name     string      `json:"name"`
+	Type     byte        `json:"type"`
+	Size     int64       `json:"size"`
+	Mode     os.FileMode `json:"mode"`
+	ModTime  time.Time   `json:"mtime"`
+	Linkname string      `json:"linkname,omitempty"`
+	Uname    string      `json:"uname,omitempty"`
+	Gname    string      `json:"gname,omitempty"`
+
+	// SHA256 is the hex digest of a regular file's contents. It is only
+	// recorded in manifests, not when listing an archive.
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// IsDir reports whether the entry is a directory
+func (e ArchiveEntry) IsDir() bool {
+	return e.Type == tar.TypeDir
+}
+
+// ListBackupEntries lists the contents of a backup in archive order. The backup's
+// manifest is used when it has one, otherwise the whole backup is downloaded.
+func (m *Manager) ListBackupEntries(serviceName, backupName, source string) ([]ArchiveEntry, error) {
+	if _, ok := m.service(serviceName); !ok {
+		return nil, fmt.Errorf("service %s not found in configuration", serviceName)
+	}
+
+	manifest, err := m.GetManifest(serviceName, backupName, source)
+	if err != nil {
+		return nil, err
+	}
+	if manifest != nil {
+		return manifest.Entries, nil
+	}
+
+	decrypted, err := m.fetchBackup(serviceName, backupName, source)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := listArchive(bytes.NewReader(decrypted))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read archive: %w", err)
+	}
+	return entries, nil
+}
+
+// listArchive reads the headers of a compressed archive
+func listArchive(input io.Reader) ([]ArchiveEntry, error) {
+	zr, err := zstd.NewReader(input)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create zstd reader: %w", err)
+	}
+	defer zr.Close()
+
+	var entries []ArchiveEntry
+	tr := tar.NewReader(zr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read tar header: %w", err)
+		}
+		entries = append(entries, entryFromHeader(header))
+	}
+
+	return entries, nil
+}
+
+// entryFromHeader describes a tar entry
+func entryFromHeader(header *tar.Header) ArchiveEntry {
+	return ArchiveEntry{
+		Name:     filepath.Clean(header.Name),
+		Type:     header.Typeflag,
+		Size:     header.Size,
+		Mode:     header.FileInfo().Mode(),
+		ModTime:  header.ModTime,
+		Linkname: header.Linkname,
+		Uname:    header.Uname,
+		Gname:    header.Gname,
+	}
+}
+
+// CatBackupFile downloads a backup and writes the contents of one regular file
+// in it to w. Hard links are followed to the file they share contents with.
+func (m *Manager) CatBackupFile(serviceName, backupName, name, source string, w io.Writer) error {
+	if _, ok := m.service(serviceName); !ok {
+		return fmt.Errorf("service %s not found in configuration", serviceName)
+	}
+	name = filepath.Clean(name)
+
+	// Check the manifest first so a typo doesn't download the whole backup
+	manifest, err := m.GetManifest(serviceName, backupName, source)
+	if err != nil {
+		return err
+	}
+	if manifest != nil && !slices.ContainsFunc(manifest.Entries, func(e ArchiveEntry) bool { return e.Name == name }) {
+		return fmt.Errorf("%s not found in backup %s", name, backupName)
+	}
+
+	decrypted, err := m.fetchBackup(serviceName, backupName, source)
+	if err != nil {
+		return err
+	}
+
+	return copyArchiveFile(decrypted, name, w)
+}
+
+// copyArchiveFile writes the contents of the named regular file in a compressed archive to w
+func copyArchiveFile(archive []byte, name string, w io.Writer) error {
+	zr, err := zstd.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		return fmt.Errorf("failed to create zstd reader: %w", err)
+	}
+	defer zr.Close()
+
+	tr := tar.NewReader(zr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return fmt.Errorf("%s not found in backup", name)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read tar header: %w", err)
+		}
+		if filepath.Clean(header.Name) != name {
+			continue
+		}
+
+		switch header.Typeflag {
+		case tar.TypeReg:
+			if _, err := io.Copy(w, tr); err != nil {
+				return fmt.Errorf("failed to write file contents: %w", err)
+			}
+			return nil
+		case tar.TypeLink:
+			// Hard links are archived after their target, so start over from the top
+			return copyArchiveFile(archive, filepath.Clean(header.Linkname), w)
+		case tar.TypeDir:
+			return fmt.Errorf("%s is a directory", name)
+		case tar.TypeSymlink:
+			return fmt.Errorf("%s is a symbolic link to %s", name, header.Linkname)
+		default:
+			return fmt.Errorf("%s is not a regular file", name)
+		}
+	}
+}
@@ -0,0 +1,386 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/logandonley/packrat/pkg/config"
+)
+
+// Docker Compose labels used to find a project's containers and their dependencies
+const (
+	composeProjectLabel   = "com.docker.compose.project"
+	composeServiceLabel   = "com.docker.compose.service"
+	composeDependsOnLabel = "com.docker.compose.depends_on"
+	composeOneoffLabel    = "com.docker.compose.oneoff"
+)
+
+// containerInfo is what ordering needs to know about a container
+type containerInfo struct {
+	name      string
+	project   string
+	service   string
+	dependsOn []string // Compose service names
+}
+
+// ServiceContainers resolves a service's containers, including those of its
+// Compose project, in the order they are stopped
+func (m *Manager) ServiceContainers(docker *config.Docker) ([]string, error) {
+	runtime, err := m.containerRuntime()
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+
+	var infos []containerInfo
+	seen := make(map[string]bool)
+
+	for _, name := range docker.ContainerNames() {
+		inspect, err := runtime.Inspect(ctx, name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to inspect container %s: %w", name, err)
+		}
+		var labels map[string]string
+		if inspect.Config != nil {
+			labels = inspect.Config.Labels
+		}
+		infos = append(infos, newContainerInfo(name, labels))
+		seen[strings.TrimPrefix(inspect.Name, "/")] = true
+	}
+
+	if docker.ComposeProject != "" {
+		list, err := runtime.List(ctx, composeProjectLabel+"="+docker.ComposeProject, false)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list containers of compose project %s: %w", docker.ComposeProject, err)
+		}
+		if len(list) == 0 {
+			return nil, fmt.Errorf("no running containers found for compose project %s", docker.ComposeProject)
+		}
+		for _, c := range list {
+			if len(c.Names) == 0 || c.Labels[composeOneoffLabel] == "True" {
+				continue
+			}
+			name := strings.TrimPrefix(c.Names[0], "/")
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			infos = append(infos, newContainerInfo(name, c.Labels))
+		}
+	}
+
+	return stopOrder(infos)
+}
+
+func newContainerInfo(name string, labels map[string]string) containerInfo {
+	info := containerInfo{
+		name:    name,
+		project: labels[composeProjectLabel],
+		service: labels[composeServiceLabel],
+	}
+	// Compose writes depends_on as comma-separated service:condition:restart entries
+	for _, dep := range strings.Split(labels[composeDependsOnLabel], ",") {
+		if service, _, _ := strings.Cut(dep, ":"); service != "" {
+			info.dependsOn = append(info.dependsOn, service)
+		}
+	}
+	return info
+}
+
+// stopOrder sorts containers so each is stopped only after the containers that
+// depend on it. Containers without dependencies between them keep their order.
+func stopOrder(infos []containerInfo) ([]string, error) {
+	// dependents[i] counts the containers still running that depend on container i
+	dependents := make([]int, len(infos))
+	dependencies := make([][]int, len(infos))
+	for i, c := range infos {
+		for _, service := range c.dependsOn {
+			for j, d := range infos {
+				if j != i && d.project == c.project && d.service == service {
+					dependencies[i] = append(dependencies[i], j)
+					dependents[j]++
+				}
+			}
+		}
+	}
+
+	order := make([]string, 0, len(infos))
+	stopped := make([]bool, len(infos))
+	for len(order) < len(infos) {
+		next := -1
+		for i := range infos {
+			if !stopped[i] && dependents[i] == 0 {
+				next = i
+				break
+			}
+		}
+		if next == -1 {
+			return nil, fmt.Errorf("containers have circular depends_on labels")
+		}
+
+		stopped[next] = true
+		order = append(order, infos[next].name)
+		for _, j := range dependencies[next] {
+			dependents[j]--
+		}
+	}
+	return order, nil
+}
+
+// dockerTimeouts are the waits used when stopping and starting containers
+type dockerTimeouts struct {
+	stop   time.Duration
+	start  time.Duration
+	health time.Duration
+}
+
+// defaultDockerTimeouts returns the timeouts used when a service doesn't set its own
+func defaultDockerTimeouts() dockerTimeouts {
+	return dockerTimeouts{
+		stop:   30 * time.Second,
+		start:  2 * time.Minute,
+		health: 2 * time.Minute,
+	}
+}
+
+// parseDockerTimeouts reads a service's Docker timeouts, applying the defaults
+func parseDockerTimeouts(docker *config.Docker) (dockerTimeouts, error) {
+	timeouts := defaultDockerTimeouts()
+	for _, t := range []struct {
+		key   string
+		value string
+		dest  *time.Duration
+	}{
+		{"stop_timeout", docker.StopTimeout, &timeouts.stop},
+		{"start_timeout", docker.StartTimeout, &timeouts.start},
+		{"health_timeout", docker.HealthTimeout, &timeouts.health},
+	} {
+		if t.value == "" {
+			continue
+		}
+		d, err := time.ParseDuration(t.value)
+		if err != nil || d <= 0 {
+			return timeouts, fmt.Errorf("invalid docker %s %q", t.key, t.value)
+		}
+		*t.dest = d
+	}
+	return timeouts, nil
+}
+
+// quiescedContainer is a container packrat stopped or paused, and must bring back
+type quiescedContainer struct {
+	Name   string `json:"name"`
+	Paused bool   `json:"paused,omitempty"` // Paused rather than stopped
+}
+
+// stopServiceContainers quiesces a service's containers in dependency order,
+// according to its Docker mode, and returns a function that brings them back in
+// reverse order, or nil if none needed quiescing. Only containers packrat stopped
+// are started and only those it paused are unpaused, so containers that were
+// already down stay down.
+//
+// While containers are down a recovery record is kept in the state directory,
+// so they are brought back on the next daemon start if packrat dies mid-job.
+func (m *Manager) stopServiceContainers(serviceName string, docker *config.Docker) (func() error, error) {
+	mode := docker.Mode
+	if mode == "" {
+		mode = config.DockerModeStop
+	}
+	switch mode {
+	case config.DockerModeNone:
+		return nil, nil
+	case config.DockerModeStop, config.DockerModePause:
+	default:
+		return nil, fmt.Errorf("invalid docker mode %q: use stop, pause or none", docker.Mode)
+	}
+
+	timeouts, err := parseDockerTimeouts(docker)
+	if err != nil {
+		return nil, err
+	}
+
+	names, err := m.ServiceContainers(docker)
+	if err != nil {
+		return nil, err
+	}
+
+	record := &recoveryRecord{Service: serviceName, PID: os.Getpid(), Started: time.Now().UTC()}
+	resume := func() error {
+		return m.resumeContainers(record, timeouts)
+	}
+
+	for _, name := range names {
+		// Record the container before touching it, so a crash in between still recovers it
+		c := quiescedContainer{Name: name, Paused: mode == config.DockerModePause}
+		record.Containers = append(record.Containers, c)
+		if err := m.saveRecoveryRecord(record); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+
+		changed, err := m.quiesceContainer(name, mode, timeouts)
+		if !changed {
+			record.Containers = record.Containers[:len(record.Containers)-1]
+		}
+		if err != nil {
+			// Bring back what was already quiesced rather than leaving the stack half down
+			if resumeErr := resume(); resumeErr != nil {
+				err = errors.Join(err, resumeErr)
+			}
+			return nil, fmt.Errorf("container %s: %w", name, err)
+		}
+	}
+	if len(record.Containers) == 0 {
+		m.removeRecoveryRecord(serviceName)
+		return nil, nil
+	}
+	if err := m.saveRecoveryRecord(record); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+
+	return resume, nil
+}
+
+// restartContainers brings back the containers stopped for a job, failing the
+// job if any of them can't be started so the failure isn't missed
+func (m *Manager) restartContainers(job *hookJob, start func() error, errp *error) {
+	if err := start(); err != nil {
+		job.Containers = ContainersFailed
+		log.Printf("ERROR: containers for service %s could not be restarted and are still down: %v", job.Service, err)
+		*errp = errors.Join(*errp, fmt.Errorf("failed to restart Docker containers: %w", err))
+		return
+	}
+	job.Containers = ContainersRestarted
+}
+
+// resumeContainers brings back the containers in a recovery record in reverse
+// order. The record is removed once they are all back, and otherwise keeps the
+// containers that failed so a later daemon start tries again.
+func (m *Manager) resumeContainers(record *recoveryRecord, timeouts dockerTimeouts) error {
+	var errs []error
+	var failed []quiescedContainer
+	for i := len(record.Containers) - 1; i >= 0; i-- {
+		c := record.Containers[i]
+		var err error
+		if c.Paused {
+			err = m.unpauseContainer(c.Name)
+		} else {
+			err = m.startContainerWithRetry(c.Name, timeouts)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("container %s: %w", c.Name, err))
+			failed = append([]quiescedContainer{c}, failed...)
+		}
+	}
+
+	record.Containers = failed
+	if len(failed) == 0 {
+		m.removeRecoveryRecord(record.Service)
+	} else if err := m.saveRecoveryRecord(record); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	return errors.Join(errs...)
+}
+
+// quiesceContainer stops or pauses a running container. It reports whether the
+// container may have been changed; containers that are already stopped or paused
+// are left alone.
+func (m *Manager) quiesceContainer(name, mode string, timeouts dockerTimeouts) (bool, error) {
+	runtime, err := m.containerRuntime()
+	if err != nil {
+		return false, err
+	}
+	info, err := runtime.Inspect(context.Background(), name)
+	if err != nil {
+		return false, fmt.Errorf("failed to inspect container: %w", err)
+	}
+	if !info.State.Running || info.State.Paused {
+		log.Printf("Container %s is not running, leaving it as it is", name)
+		return false, nil
+	}
+
+	if mode == config.DockerModePause {
+		return true, m.pauseContainer(name)
+	}
+	return true, m.stopContainer(name, timeouts)
+}
+
+// stopContainer stops a container and waits for it to exit
+func (m *Manager) stopContainer(name string, timeouts dockerTimeouts) error {
+	runtime, err := m.containerRuntime()
+	if err != nil {
+		return err
+	}
+	log.Printf("Stopping Docker container: %s", name)
+	if err := runtime.Stop(context.Background(), name, timeouts.stop); err != nil {
+		return err
+	}
+	log.Printf("Container %s stopped successfully", name)
+	return nil
+}
+
+// startContainer starts a container and waits for it to be running, and healthy
+// if it has a healthcheck
+func (m *Manager) startContainer(name string, timeouts dockerTimeouts) error {
+	runtime, err := m.containerRuntime()
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	log.Printf("Starting Docker container: %s", name)
+	if err := runtime.Start(ctx, name, timeouts.start); err != nil {
+		return err
+	}
+	if err := runtime.WaitHealthy(ctx, name, timeouts.health); err != nil {
+		return err
+	}
+	log.Printf("Container %s started successfully", name)
+	return nil
+}
+
+// startAttempts is how often starting a container is tried before giving up
+const startAttempts = 3
+
+// startRetryDelay is the wait before the first retry, doubled for each further one
+var startRetryDelay = 5 * time.Second
+
+// startContainerWithRetry starts a container, retrying if it fails to come up
+func (m *Manager) startContainerWithRetry(name string, timeouts dockerTimeouts) error {
+	delay := startRetryDelay
+	var err error
+	for attempt := 1; attempt <= startAttempts; attempt++ {
+		if err = m.startContainer(name, timeouts); err == nil {
+			return nil
+		}
+		if attempt < startAttempts {
+			log.Printf("Failed to start container %s (attempt %d/%d), retrying in %s: %v", name, attempt, startAttempts, delay, err)
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+	return fmt.Errorf("gave up after %d attempts: %w", startAttempts, err)
+}
+
+// pauseContainer freezes a container's processes
+func (m *Manager) pauseContainer(name string) error {
+	runtime, err := m.containerRuntime()
+	if err != nil {
+		return err
+	}
+	log.Printf("Pausing Docker container: %s", name)
+	return runtime.Pause(context.Background(), name)
+}
+
+// unpauseContainer resumes a paused container
+func (m *Manager) unpauseContainer(name string) error {
+	runtime, err := m.containerRuntime()
+	if err != nil {
+		return err
+	}
+	log.Printf("Unpausing Docker container: %s", name)
+	return runtime.Unpause(context.Background(), name)
+}
@@ -0,0 +1,251 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/logandonley/packrat/pkg/config"
+)
+
+func TestStopOrder(t *testing.T) {
+	labels := func(service, dependsOn string) map[string]string {
+		return map[string]string{
+			composeProjectLabel:   "gitea",
+			composeServiceLabel:   service,
+			composeDependsOnLabel: dependsOn,
+		}
+	}
+
+	tests := []struct {
+		name    string
+		infos   []containerInfo
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "no labels keeps the configured order",
+			infos: []containerInfo{
+				newContainerInfo("app", nil),
+				newContainerInfo("db", nil),
+			},
+			want: []string{"app", "db"},
+		},
+		{
+			name: "dependents stop before their dependencies",
+			infos: []containerInfo{
+				newContainerInfo("gitea-db-1", labels("db", "")),
+				newContainerInfo("gitea-redis-1", labels("redis", "")),
+				newContainerInfo("gitea-app-1", labels("app", "db:service_healthy:false,redis:service_started:false")),
+				newContainerInfo("gitea-proxy-1", labels("proxy", "app:service_started:true")),
+			},
+			want: []string{"gitea-proxy-1", "gitea-app-1", "gitea-db-1", "gitea-redis-1"},
+		},
+		{
+			name: "cycles are rejected",
+			infos: []containerInfo{
+				newContainerInfo("a", labels("a", "b:service_started:false")),
+				newContainerInfo("b", labels("b", "a:service_started:false")),
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := stopOrder(tt.infos)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("stopOrder() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("stopOrder() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseDockerTimeouts(t *testing.T) {
+	timeouts, err := parseDockerTimeouts(&config.Docker{HealthTimeout: "5m"})
+	if err != nil {
+		t.Fatalf("parseDockerTimeouts failed: %v", err)
+	}
+	want := dockerTimeouts{stop: 30 * time.Second, start: 2 * time.Minute, health: 5 * time.Minute}
+	if timeouts != want {
+		t.Errorf("parseDockerTimeouts() = %+v, want %+v", timeouts, want)
+	}
+
+	for _, bad := range []config.Docker{{StopTimeout: "soon"}, {StartTimeout: "-1s"}} {
+		if _, err := parseDockerTimeouts(&bad); err == nil {
+			t.Errorf("Expected an error for %+v", bad)
+		}
+	}
+
+	// Invalid modes are rejected before any container is touched
+	manager := &Manager{}
+	if _, err := manager.stopServiceContainers("app", &config.Docker{Container: "app", Mode: "freeze"}); err == nil {
+		t.Error("Expected an error for an invalid mode")
+	}
+	if _, err := manager.stopServiceContainers("app", &config.Docker{Container: "app", Mode: config.DockerModeNone}); err != nil {
+		t.Errorf("Mode none failed: %v", err)
+	}
+}
+
+func TestContainerBackup(t *testing.T) {
+	runtime := newFakeRuntime(t)
+	runtime.containers["web"] = &fakeContainer{image: "app/web", running: true, labels: map[string]string{
+		composeProjectLabel:   "app",
+		composeServiceLabel:   "web",
+		composeDependsOnLabel: "db:service_started:false",
+	}}
+	runtime.containers["db"] = &fakeContainer{image: "postgres", running: true, labels: map[string]string{
+		composeProjectLabel: "app",
+		composeServiceLabel: "db",
+	}, exec: func(ctx context.Context, opts ExecOptions) (int, error) {
+		fmt.Fprint(opts.Stdout, "dump of db")
+		return 0, nil
+	}}
+	runtime.addVolume(t, "app_data", map[string]string{"data/file.txt": "volume data"})
+
+	store := &mockStorage{files: make(map[string][]byte)}
+	service := config.Service{
+		Docker: &config.Docker{ComposeProject: "app", Volumes: []string{"app_data"}},
+		Dumps:  []config.Dump{{Name: "db.sql", Container: "db", Command: config.Command{Command: "pg_dump app"}}},
+	}
+	manager := &Manager{
+		config:     &config.Config{Services: map[string]config.Service{"app": service}},
+		key:        []byte("testkey0123456789012345678901234"),
+		backupRoot: t.TempDir(),
+		stateDir:   t.TempDir(),
+		Synology:   store,
+		runtime:    runtime,
+	}
+
+	if err := manager.CreateBackup("app"); err != nil {
+		t.Fatalf("CreateBackup failed: %v", err)
+	}
+
+	// Dumps run first, then the app is stopped before its database and started after it
+	want := []string{"exec db", "stop web", "stop db", "start db", "start web"}
+	if ops := runtime.operations(); !reflect.DeepEqual(ops, want) {
+		t.Errorf("Operations = %v, want %v", ops, want)
+	}
+	for name, c := range runtime.containers {
+		if !c.running {
+			t.Errorf("Container %s was left stopped", name)
+		}
+	}
+	if _, err := os.Stat(manager.recoveryPath("app")); !os.IsNotExist(err) {
+		t.Errorf("Expected no recovery record after the job, got %v", err)
+	}
+
+	files, _ := store.List("app-")
+	backupName := BackupFiles(files)[0].Name
+	for name, want := range map[string]string{
+		"volumes/app_data/data/file.txt": "volume data",
+		".packrat/dumps/db.sql":          "dump of db",
+	} {
+		var out bytes.Buffer
+		if err := manager.CatBackupFile("app", backupName, name, "", &out); err != nil {
+			t.Errorf("Failed to read %s from backup: %v", name, err)
+		} else if out.String() != want {
+			t.Errorf("%s = %q, want %q", name, out.String(), want)
+		}
+	}
+
+	// Pausing leaves containers that were already down alone
+	runtime.containers["db"].running = false
+	service.Docker = &config.Docker{Container: "web", Containers: []string{"db"}, Mode: config.DockerModePause}
+	service.Dumps = nil
+	manager.config.Services["app"] = service
+	opCount := len(runtime.operations())
+	if err := manager.CreateBackup("app"); err != nil {
+		t.Fatalf("CreateBackup failed: %v", err)
+	}
+	want = []string{"pause web", "unpause web"}
+	if ops := runtime.operations()[opCount:]; !reflect.DeepEqual(ops, want) {
+		t.Errorf("Operations = %v, want %v", ops, want)
+	}
+	if runtime.containers["db"].running {
+		t.Error("Container db was started")
+	}
+}
+
+func TestContainerRuntimeFailures(t *testing.T) {
+	defer func(delay time.Duration) { startRetryDelay = delay }(startRetryDelay)
+	startRetryDelay = time.Millisecond
+
+	tests := []struct {
+		name      string
+		container *fakeContainer
+		docker    config.Docker
+		wantOps   []string
+		wantErr   bool
+	}{
+		{
+			name:      "slow stop is killed after the grace period",
+			container: &fakeContainer{running: true, stopDelay: time.Minute},
+			docker:    config.Docker{StopTimeout: "10ms"},
+			wantOps:   []string{"kill db", "start db"},
+		},
+		{
+			name:      "crash on start is retried",
+			container: &fakeContainer{running: true, crashes: 1},
+			wantOps:   []string{"stop db", "start db", "start db"},
+		},
+		{
+			name:      "failed health check fails the job",
+			container: &fakeContainer{running: true, healthcheck: true, unhealthy: true},
+			wantOps:   []string{"stop db", "start db", "start db", "start db"},
+			wantErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srcDir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(srcDir, "data.txt"), []byte("data"), 0644); err != nil {
+				t.Fatalf("Failed to write file: %v", err)
+			}
+			runtime := newFakeRuntime(t)
+			runtime.containers["db"] = tt.container
+
+			docker := tt.docker
+			docker.Container = "db"
+			store := &mockStorage{files: make(map[string][]byte)}
+			manager := &Manager{
+				config:     &config.Config{Services: map[string]config.Service{"test": {Path: srcDir, Docker: &docker}}},
+				key:        []byte("testkey0123456789012345678901234"),
+				backupRoot: t.TempDir(),
+				stateDir:   t.TempDir(),
+				Synology:   store,
+				runtime:    runtime,
+			}
+
+			err := manager.CreateBackup("test")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CreateBackup() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if ops := runtime.operations(); !reflect.DeepEqual(ops, tt.wantOps) {
+				t.Errorf("Operations = %v, want %v", ops, tt.wantOps)
+			}
+
+			// The backup itself is stored either way, but a container left down
+			// keeps its recovery record
+			if len(store.files) == 0 {
+				t.Error("Backup was not uploaded")
+			}
+			_, statErr := os.Stat(manager.recoveryPath("test"))
+			if tt.wantErr && statErr != nil {
+				t.Errorf("Expected a recovery record, got %v", statErr)
+			}
+			if !tt.wantErr && !os.IsNotExist(statErr) {
+				t.Errorf("Expected no recovery record, got %v", statErr)
+			}
+		})
+	}
+}
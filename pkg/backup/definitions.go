@@ -0,0 +1,302 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+	"github.com/logandonley/packrat/pkg/config"
+)
+
+// metadataDir is the archive directory for files packrat generates, such as
+// container definitions. It is not extracted when restoring in place.
+const metadataDir = ".packrat"
+
+// containersFile holds a backup's container definitions, in stop order
+var containersFile = filepath.Join(metadataDir, "containers.json")
+
+// Labels Compose sets on its containers to find the project's files
+const (
+	composeConfigFilesLabel = "com.docker.compose.project.config_files"
+	composeWorkingDirLabel  = "com.docker.compose.project.working_dir"
+)
+
+// containerSpec is what's needed to recreate a container on another host.
+// Environment variables are kept as-is, so they are only ever stored inside
+// the encrypted archive.
+type containerSpec struct {
+	Name       string                               `json:"name"`
+	Image      string                               `json:"image"`
+	Config     *container.Config                    `json:"config"`
+	HostConfig *container.HostConfig                `json:"host_config"`
+	Networks   map[string]*network.EndpointSettings `json:"networks,omitempty"`
+}
+
+// isMetadata reports whether an archive path is in the metadata directory
+func isMetadata(name string) bool {
+	name = filepath.Clean(name)
+	return name == metadataDir || strings.HasPrefix(name, metadataDir+string(filepath.Separator))
+}
+
+// captureDefinitions records the definitions of a service's containers, and the
+// Compose files they were started from when those can be found on this host
+func (m *Manager) captureDefinitions(docker *config.Docker) ([]capturedDump, error) {
+	if docker == nil || (len(docker.ContainerNames()) == 0 && docker.ComposeProject == "") {
+		return nil, nil
+	}
+	names, err := m.ServiceContainers(docker)
+	if err != nil {
+		return nil, err
+	}
+	runtime, err := m.containerRuntime()
+	if err != nil {
+		return nil, err
+	}
+
+	var files []capturedDump
+	var specs []containerSpec
+	seenCompose := make(map[string]bool)
+	for _, name := range names {
+		info, err := runtime.Inspect(context.Background(), name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to inspect container %s: %w", name, err)
+		}
+		specs = append(specs, newContainerSpec(info))
+
+		if info.Config == nil {
+			continue
+		}
+		for _, f := range composeFiles(info.Config.Labels) {
+			if seenCompose[f.name] {
+				continue
+			}
+			seenCompose[f.name] = true
+			data, err := os.ReadFile(f.path)
+			if err != nil {
+				log.Printf("Warning: not storing Compose file %s: %v", f.path, err)
+				continue
+			}
+			files = append(files, capturedDump{name: f.name, data: data, modTime: time.Now()})
+		}
+	}
+
+	data, err := json.MarshalIndent(specs, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode container definitions: %w", err)
+	}
+	files = append([]capturedDump{{name: containersFile, data: data, modTime: time.Now()}}, files...)
+	return files, nil
+}
+
+// newContainerSpec keeps the parts of an inspected container that define it,
+// dropping runtime state
+func newContainerSpec(info types.ContainerJSON) containerSpec {
+	spec := containerSpec{
+		Name:       strings.TrimPrefix(info.Name, "/"),
+		Config:     info.Config,
+		HostConfig: info.HostConfig,
+	}
+	if info.Config != nil {
+		spec.Image = info.Config.Image
+
+		// An unset hostname defaults to the container ID, which a new container won't share
+		if info.ContainerJSONBase != nil && len(info.ID) >= 12 && info.Config.Hostname == info.ID[:12] {
+			cfg := *info.Config
+			cfg.Hostname = ""
+			spec.Config = &cfg
+		}
+	}
+
+	if info.NetworkSettings != nil {
+		for name, endpoint := range info.NetworkSettings.Networks {
+			if endpoint == nil {
+				continue
+			}
+			settings := &network.EndpointSettings{
+				IPAMConfig: endpoint.IPAMConfig,
+				Links:      endpoint.Links,
+				DriverOpts: endpoint.DriverOpts,
+			}
+			for _, alias := range endpoint.Aliases {
+				if len(info.ID) < 12 || alias != info.ID[:12] {
+					settings.Aliases = append(settings.Aliases, alias)
+				}
+			}
+			if spec.Networks == nil {
+				spec.Networks = make(map[string]*network.EndpointSettings)
+			}
+			spec.Networks[name] = settings
+		}
+	}
+	return spec
+}
+
+// composeFile is a Compose file on this host and where it goes in the archive
+type composeFile struct {
+	path string
+	name string
+}
+
+// composeFiles returns the files a Compose container was started from, plus the
+// project's .env file, stored under .packrat/compose/<project>
+func composeFiles(labels map[string]string) []composeFile {
+	project := labels[composeProjectLabel]
+	if project == "" || validateVolumeName(project) != nil {
+		return nil
+	}
+	dir := filepath.Join(metadataDir, "compose", project)
+
+	var files []composeFile
+	for _, path := range splitLabel(labels[composeConfigFilesLabel]) {
+		files = append(files, composeFile{path: path, name: filepath.Join(dir, filepath.Base(path))})
+	}
+	if workingDir := labels[composeWorkingDirLabel]; workingDir != "" {
+		envFile := filepath.Join(workingDir, ".env")
+		if _, err := os.Stat(envFile); err == nil {
+			files = append(files, composeFile{path: envFile, name: filepath.Join(dir, ".env")})
+		}
+	}
+	return files
+}
+
+// readContainerSpecs reads the container definitions stored in a backup
+func readContainerSpecs(archive []byte) ([]containerSpec, error) {
+	var buf bytes.Buffer
+	if err := copyArchiveFile(archive, containersFile, &buf); err != nil {
+		return nil, fmt.Errorf("backup has no container definitions: %w", err)
+	}
+	var specs []containerSpec
+	if err := json.Unmarshal(buf.Bytes(), &specs); err != nil {
+		return nil, fmt.Errorf("failed to read container definitions: %w", err)
+	}
+	if len(specs) == 0 {
+		return nil, fmt.Errorf("backup has no container definitions")
+	}
+	return specs, nil
+}
+
+// pullImages pulls the images of the containers to recreate. An image that
+// can't be pulled is fine as long as it's already on this host.
+func (m *Manager) pullImages(specs []containerSpec) error {
+	runtime, err := m.containerRuntime()
+	if err != nil {
+		return err
+	}
+	for _, spec := range specs {
+		log.Printf("Pulling image %s", spec.Image)
+		if err := runtime.PullImage(context.Background(), spec.Image); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeContainers stops and removes the existing containers that are about to
+// be recreated. Their definitions are saved in a recovery record first, so if
+// packrat dies before recreating them the next daemon start does. The record is
+// returned once anything may have been changed, even if removing failed.
+func (m *Manager) removeContainers(serviceName string, specs []containerSpec, timeouts dockerTimeouts) (*recoveryRecord, error) {
+	runtime, err := m.containerRuntime()
+	if err != nil {
+		return nil, err
+	}
+	record := &recoveryRecord{Service: serviceName, PID: os.Getpid(), Started: time.Now().UTC(), Definitions: specs}
+	if err := m.saveRecoveryRecord(record); err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	for _, spec := range specs {
+		info, err := runtime.Inspect(ctx, spec.Name)
+		if client.IsErrNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return record, fmt.Errorf("failed to inspect container %s: %w", spec.Name, err)
+		}
+		if info.State.Running {
+			if err := m.stopContainer(spec.Name, timeouts); err != nil {
+				return record, fmt.Errorf("container %s: %w", spec.Name, err)
+			}
+		}
+		log.Printf("Removing Docker container: %s", spec.Name)
+		if err := runtime.Remove(ctx, spec.Name); err != nil {
+			return record, fmt.Errorf("failed to remove container %s: %w", spec.Name, err)
+		}
+	}
+	return record, nil
+}
+
+// recreateContainers brings up the containers removed for a restore, failing
+// the job if any of them can't be
+func (m *Manager) recreateContainers(job *hookJob, record *recoveryRecord, timeouts dockerTimeouts, errp *error) {
+	if err := m.recreateDefinitions(record, timeouts); err != nil {
+		job.Containers = ContainersFailed
+		log.Printf("ERROR: containers could not be recreated: %v", err)
+		*errp = errors.Join(*errp, fmt.Errorf("failed to recreate Docker containers: %w", err))
+		return
+	}
+	job.Containers = ContainersRecreated
+}
+
+// recreateDefinitions brings up the containers defined in a recovery record in
+// reverse stop order. The record is removed once they are all up, and otherwise
+// keeps the ones that failed so a later daemon start tries again.
+func (m *Manager) recreateDefinitions(record *recoveryRecord, timeouts dockerTimeouts) error {
+	var errs []error
+	var failed []containerSpec
+	for i := len(record.Definitions) - 1; i >= 0; i-- {
+		spec := record.Definitions[i]
+		if err := m.recreateContainer(spec, timeouts); err != nil {
+			errs = append(errs, fmt.Errorf("container %s: %w", spec.Name, err))
+			failed = append([]containerSpec{spec}, failed...)
+		}
+	}
+
+	record.Definitions = failed
+	if len(failed) == 0 {
+		m.removeRecoveryRecord(record.Service)
+	} else if err := m.saveRecoveryRecord(record); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	return errors.Join(errs...)
+}
+
+// recreateContainer creates a container from its definition and starts it. A
+// container that already exists, because removing it failed or it was created
+// before an earlier attempt gave up, is only started.
+func (m *Manager) recreateContainer(spec containerSpec, timeouts dockerTimeouts) error {
+	runtime, err := m.containerRuntime()
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+
+	info, err := runtime.Inspect(ctx, spec.Name)
+	if err == nil {
+		if info.State != nil && info.State.Running {
+			return nil
+		}
+		return m.startContainerWithRetry(spec.Name, timeouts)
+	}
+	if !client.IsErrNotFound(err) {
+		return fmt.Errorf("failed to inspect container: %w", err)
+	}
+
+	log.Printf("Creating Docker container: %s", spec.Name)
+	if err := runtime.Create(ctx, spec.Name, spec.Config, spec.HostConfig, spec.Networks); err != nil {
+		return err
+	}
+	return m.startContainerWithRetry(spec.Name, timeouts)
+}
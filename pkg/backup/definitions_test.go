@@ -0,0 +1,280 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/logandonley/packrat/pkg/config"
+)
+
+func TestContainerDefinitions(t *testing.T) {
+	id := "0123456789abcdef0123456789abcdef"
+	info := types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{ID: id, Name: "/gitea", HostConfig: &container.HostConfig{NetworkMode: "gitea_default"}},
+		Config: &container.Config{
+			Image:    "gitea/gitea:1.22",
+			Hostname: id[:12],
+			Env:      []string{"GITEA__database__PASSWD=secret"},
+		},
+		NetworkSettings: &types.NetworkSettings{Networks: map[string]*network.EndpointSettings{
+			"gitea_default": {Aliases: []string{"gitea", id[:12]}, IPAddress: "172.18.0.2", EndpointID: "abc"},
+		}},
+	}
+
+	spec := newContainerSpec(info)
+	if spec.Name != "gitea" || spec.Image != "gitea/gitea:1.22" || spec.Config.Hostname != "" {
+		t.Errorf("newContainerSpec() = %+v", spec)
+	}
+	if info.Config.Hostname != id[:12] {
+		t.Error("newContainerSpec modified the inspected config")
+	}
+	if endpoint := spec.Networks["gitea_default"]; endpoint == nil || !reflect.DeepEqual(endpoint.Aliases, []string{"gitea"}) || endpoint.IPAddress != "" {
+		t.Errorf("Network settings = %+v", endpoint)
+	}
+
+	// Definitions are archived under .packrat, and left out of in-place restores
+	data, err := json.Marshal([]containerSpec{spec})
+	if err != nil {
+		t.Fatalf("Failed to encode definitions: %v", err)
+	}
+	srcDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(srcDir, "app.ini"), []byte("config"), 0644); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	manager := &Manager{config: &config.Config{}}
+	var archive bytes.Buffer
+	if _, err := manager.createArchive(archiveSources{
+		path: srcDir,
+		meta: []capturedDump{{name: containersFile, data: data, modTime: time.Now()}},
+	}, &archive); err != nil {
+		t.Fatalf("Failed to create archive: %v", err)
+	}
+
+	specs, err := readContainerSpecs(archive.Bytes())
+	if err != nil {
+		t.Fatalf("readContainerSpecs failed: %v", err)
+	}
+	if len(specs) != 1 || specs[0].Image != spec.Image || !reflect.DeepEqual(specs[0].Config.Env, info.Config.Env) {
+		t.Errorf("readContainerSpecs() = %+v", specs)
+	}
+
+	inPlace := t.TempDir()
+	if err := ExtractArchive(bytes.NewReader(archive.Bytes()), inPlace, RestoreOptions{skipMetadata: true}); err != nil {
+		t.Fatalf("Failed to extract archive: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(inPlace, metadataDir)); !os.IsNotExist(err) {
+		t.Errorf("Expected no %s directory in an in-place restore, got %v", metadataDir, err)
+	}
+	elsewhere := t.TempDir()
+	if err := ExtractArchive(bytes.NewReader(archive.Bytes()), elsewhere, RestoreOptions{}); err != nil {
+		t.Fatalf("Failed to extract archive: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(elsewhere, containersFile)); err != nil {
+		t.Errorf("Definitions not extracted: %v", err)
+	}
+}
+
+func TestComposeFiles(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, ".env"), []byte("TOKEN=x"), 0600); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+
+	files := composeFiles(map[string]string{
+		composeProjectLabel:     "gitea",
+		composeConfigFilesLabel: filepath.Join(dir, "compose.yml") + "," + filepath.Join(dir, "compose.override.yml"),
+		composeWorkingDirLabel:  dir,
+	})
+	want := []composeFile{
+		{path: filepath.Join(dir, "compose.yml"), name: ".packrat/compose/gitea/compose.yml"},
+		{path: filepath.Join(dir, "compose.override.yml"), name: ".packrat/compose/gitea/compose.override.yml"},
+		{path: filepath.Join(dir, ".env"), name: ".packrat/compose/gitea/.env"},
+	}
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("composeFiles() = %+v, want %+v", files, want)
+	}
+
+	if files := composeFiles(map[string]string{}); files != nil {
+		t.Errorf("composeFiles() = %+v for a container outside Compose", files)
+	}
+}
+
+// newRecreateManager backs up a Compose project whose web container depends on
+// its db, and returns the manager and the backup's name
+func newRecreateManager(t *testing.T, runtime *fakeRuntime) (*Manager, string) {
+	t.Helper()
+	runtime.containers["web"] = &fakeContainer{image: "app/web", running: true, labels: map[string]string{
+		composeProjectLabel:   "app",
+		composeServiceLabel:   "web",
+		composeDependsOnLabel: "db:service_started:false",
+	}}
+	runtime.containers["db"] = &fakeContainer{image: "postgres", running: true, labels: map[string]string{
+		composeProjectLabel: "app",
+		composeServiceLabel: "db",
+	}}
+	srcDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(srcDir, "data.txt"), []byte("data"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	store := &mockStorage{files: make(map[string][]byte)}
+	service := config.Service{Path: srcDir, Docker: &config.Docker{ComposeProject: "app"}}
+	manager := &Manager{
+		config:     &config.Config{Services: map[string]config.Service{"app": service}},
+		key:        []byte("testkey0123456789012345678901234"),
+		backupRoot: t.TempDir(),
+		stateDir:   t.TempDir(),
+		Synology:   store,
+		runtime:    runtime,
+	}
+	if err := manager.CreateBackup("app"); err != nil {
+		t.Fatalf("CreateBackup failed: %v", err)
+	}
+	files, _ := store.List("app-")
+	return manager, BackupFiles(files)[0].Name
+}
+
+func TestRecreateContainers(t *testing.T) {
+	defer func(delay time.Duration) { startRetryDelay = delay }(startRetryDelay)
+	startRetryDelay = time.Millisecond
+
+	tests := []struct {
+		name          string
+		missingImages map[string]bool
+		createFails   map[string]int
+		wantOps       []string
+		wantErr       string
+		wantLeft      []string // Definitions left in the recovery record
+	}{
+		{
+			// Containers are removed in stop order and recreated in reverse
+			name: "success",
+			wantOps: []string{
+				"pull app/web", "pull postgres",
+				"stop web", "remove web", "stop db", "remove db",
+				"create db", "start db", "create web", "start web",
+			},
+		},
+		{
+			// Nothing is touched until every image is available
+			name:          "image can't be pulled",
+			missingImages: map[string]bool{"postgres": true},
+			wantOps:       []string{"pull app/web", "pull postgres"},
+			wantErr:       "failed to pull image postgres",
+		},
+		{
+			name:        "container can't be created",
+			createFails: map[string]int{"web": 1},
+			wantOps: []string{
+				"pull app/web", "pull postgres",
+				"stop web", "remove web", "stop db", "remove db",
+				"create db", "start db", "create web",
+			},
+			wantErr:  "failed to recreate Docker containers",
+			wantLeft: []string{"web"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runtime := newFakeRuntime(t)
+			manager, backupName := newRecreateManager(t, runtime)
+			runtime.missingImages = tt.missingImages
+			runtime.createFails = tt.createFails
+			opCount := len(runtime.operations())
+
+			err := manager.RestoreBackupWithOptions("app", backupName, RestoreOptions{RecreateContainers: true})
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("RestoreBackupWithOptions failed: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("RestoreBackupWithOptions() error = %v, want %q", err, tt.wantErr)
+			}
+			if ops := runtime.operations()[opCount:]; !reflect.DeepEqual(ops, tt.wantOps) {
+				t.Errorf("Operations = %v, want %v", ops, tt.wantOps)
+			}
+
+			records, err := manager.loadRecoveryRecords()
+			if err != nil {
+				t.Fatalf("loadRecoveryRecords failed: %v", err)
+			}
+			var left []string
+			for _, record := range records {
+				for _, spec := range record.Definitions {
+					left = append(left, spec.Name)
+				}
+			}
+			if !reflect.DeepEqual(left, tt.wantLeft) {
+				t.Errorf("Recovery record keeps %v, want %v", left, tt.wantLeft)
+			}
+			if tt.wantLeft == nil {
+				for name, c := range runtime.containers {
+					if !c.running {
+						t.Errorf("Container %s was left stopped", name)
+					}
+				}
+				return
+			}
+
+			// The next daemon start creates what's left from the record
+			if err := manager.RecoverContainers(); err != nil {
+				t.Fatalf("RecoverContainers failed: %v", err)
+			}
+			for _, name := range []string{"db", "web"} {
+				if c, ok := runtime.containers[name]; !ok || !c.running {
+					t.Errorf("Container %s was not recovered", name)
+				}
+			}
+			if _, err := os.Stat(manager.recoveryPath("app")); !os.IsNotExist(err) {
+				t.Errorf("Expected the recovery record to be removed, got %v", err)
+			}
+		})
+	}
+}
+
+func TestRecreateContainersInterrupted(t *testing.T) {
+	defer func(delay time.Duration) { startRetryDelay = delay }(startRetryDelay)
+	startRetryDelay = time.Millisecond
+
+	runtime := newFakeRuntime(t)
+	manager, _ := newRecreateManager(t, runtime)
+	specs := make([]containerSpec, 0, 2)
+	for _, name := range []string{"web", "db"} {
+		info, err := runtime.Inspect(context.Background(), name)
+		if err != nil {
+			t.Fatalf("Inspect failed: %v", err)
+		}
+		specs = append(specs, newContainerSpec(info))
+	}
+
+	// A restore that dies once the containers are removed leaves only the record
+	if _, err := manager.removeContainers("app", specs, defaultDockerTimeouts()); err != nil {
+		t.Fatalf("removeContainers failed: %v", err)
+	}
+	if len(runtime.containers) != 0 {
+		t.Fatalf("Containers %v were not removed", runtime.containers)
+	}
+
+	opCount := len(runtime.operations())
+	if err := manager.RecoverContainers(); err != nil {
+		t.Fatalf("RecoverContainers failed: %v", err)
+	}
+	want := []string{"create db", "start db", "create web", "start web"}
+	if ops := runtime.operations()[opCount:]; !reflect.DeepEqual(ops, want) {
+		t.Errorf("Operations = %v, want %v", ops, want)
+	}
+	if web, ok := runtime.containers["web"]; !ok || web.labels[composeServiceLabel] != "web" {
+		t.Errorf("web was not recreated from its definition: %+v", web)
+	}
+	if _, err := os.Stat(manager.recoveryPath("app")); !os.IsNotExist(err) {
+		t.Errorf("Expected the recovery record to be removed, got %v", err)
+	}
+}
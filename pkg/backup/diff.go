@@ -0,0 +1,309 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// ChangeKind says how a path differs between two snapshots
+type ChangeKind byte
+
+const (
+	Added    ChangeKind = 'A'
+	Removed  ChangeKind = 'D'
+	Modified ChangeKind = 'M'
+)
+
+// Change is a path that differs between an old and a new snapshot of a service.
+// Old is nil for added paths and New is nil for removed ones.
+type Change struct {
+	Name string
+	Kind ChangeKind
+	Old  *ArchiveEntry
+	New  *ArchiveEntry
+}
+
+// DiffBackups compares two backups of a service. Content hashes come from the
+// manifests when the backups have them, otherwise from the archives themselves.
+func (m *Manager) DiffBackups(serviceName, oldBackup, newBackup, source string) ([]Change, error) {
+	if _, ok := m.service(serviceName); !ok {
+		return nil, fmt.Errorf("service %s not found in configuration", serviceName)
+	}
+
+	oldEntries, err := m.hashedEntries(serviceName, oldBackup, source)
+	if err != nil {
+		return nil, err
+	}
+	newEntries, err := m.hashedEntries(serviceName, newBackup, source)
+	if err != nil {
+		return nil, err
+	}
+
+	return diffEntries(oldEntries, newEntries), nil
+}
+
+// DiffLive compares a backup with the live service directory. Paths matching
+// the service's exclude patterns, and packrat's generated files such as dumps,
+// which only exist in backups, are ignored on both sides.
+func (m *Manager) DiffLive(serviceName, backupName, source string) ([]Change, error) {
+	service, ok := m.service(serviceName)
+	if !ok {
+		return nil, fmt.Errorf("service %s not found in configuration", serviceName)
+	}
+
+	backupEntries, err := m.hashedEntries(serviceName, backupName, source)
+	if err != nil {
+		return nil, err
+	}
+	oldEntries := backupEntries[:0:0]
+	for _, e := range backupEntries {
+		if !isExcluded(e.Name, service.Exclude) && !isMetadata(e.Name) {
+			oldEntries = append(oldEntries, e)
+		}
+	}
+
+	var liveEntries []ArchiveEntry
+	if service.Path != "" {
+		if liveEntries, err = scanDirectory(service.Path, "", service.Exclude); err != nil {
+			return nil, fmt.Errorf("failed to scan %s: %w", service.Path, err)
+		}
+	}
+	volumes, err := m.resolveVolumes(service.Docker, false)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range volumes {
+		entries, err := scanDirectory(v.path, v.archiveName(), service.Exclude)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan volume %s: %w", v.name, err)
+		}
+		liveEntries = append(liveEntries, entries...)
+	}
+
+	return diffEntries(oldEntries, liveEntries), nil
+}
+
+// hashedEntries lists a backup's entries with content hashes, from its manifest
+// if it has one, or by reading the whole archive otherwise
+func (m *Manager) hashedEntries(serviceName, backupName, source string) ([]ArchiveEntry, error) {
+	manifest, err := m.GetManifest(serviceName, backupName, source)
+	if err != nil {
+		return nil, err
+	}
+	if manifest != nil {
+		return manifest.Entries, nil
+	}
+
+	decrypted, err := m.fetchBackup(serviceName, backupName, source)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := hashArchive(bytes.NewReader(decrypted))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read archive %s: %w", backupName, err)
+	}
+	return entries, nil
+}
+
+// hashArchive lists the entries of a compressed archive, hashing the contents of regular files
+func hashArchive(input io.Reader) ([]ArchiveEntry, error) {
+	zr, err := zstd.NewReader(input)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create zstd reader: %w", err)
+	}
+	defer zr.Close()
+
+	var entries []ArchiveEntry
+	tr := tar.NewReader(zr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read tar header: %w", err)
+		}
+
+		entry := entryFromHeader(header)
+		if header.Typeflag == tar.TypeReg {
+			hash := sha256.New()
+			if _, err := io.Copy(hash, tr); err != nil {
+				return nil, fmt.Errorf("failed to read %s: %w", header.Name, err)
+			}
+			entry.SHA256 = hex.EncodeToString(hash.Sum(nil))
+		}
+		entries = append(entries, entry)
+	}
+
+	fillLinkHashes(entries)
+	return entries, nil
+}
+
+// scanDirectory lists the files under root the way createArchive would archive
+// them under prefix, hashing the contents of regular files
+func scanDirectory(root, prefix string, excludePatterns []string) ([]ArchiveEntry, error) {
+	links := make(map[fileID]string)
+
+	var entries []ArchiveEntry
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relPath, err := filepath.Rel(root, path)
+		if err != nil {
+			return fmt.Errorf("failed to get relative path: %w", err)
+		}
+		if prefix != "" {
+			relPath = filepath.Join(prefix, relPath)
+		}
+		if isExcluded(relPath, excludePatterns) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		var linkTarget string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if linkTarget, err = os.Readlink(path); err != nil {
+				return fmt.Errorf("failed to read symlink: %w", err)
+			}
+		}
+
+		header, err := tar.FileInfoHeader(info, linkTarget)
+		if err != nil {
+			return fmt.Errorf("failed to create tar header: %w", err)
+		}
+		header.Name = relPath
+
+		if id, ok := hardLinkID(info); ok {
+			if first, seen := links[id]; seen {
+				header.Typeflag = tar.TypeLink
+				header.Linkname = first
+				header.Size = 0
+				entries = append(entries, entryFromHeader(header))
+				return nil
+			}
+			links[id] = relPath
+		}
+
+		entry := entryFromHeader(header)
+		if info.Mode().IsRegular() {
+			if entry.SHA256, err = hashFile(path); err != nil {
+				return err
+			}
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	fillLinkHashes(entries)
+	return entries, nil
+}
+
+// hashFile returns the hex SHA-256 digest of a file's contents
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// fillLinkHashes gives hard link entries the hash of the file they share contents with
+func fillLinkHashes(entries []ArchiveEntry) {
+	hashes := make(map[string]string)
+	for _, e := range entries {
+		if e.SHA256 != "" {
+			hashes[e.Name] = e.SHA256
+		}
+	}
+	for i, e := range entries {
+		if e.Type == tar.TypeLink {
+			entries[i].SHA256 = hashes[filepath.Clean(e.Linkname)]
+		}
+	}
+}
+
+// diffEntries compares two listings and returns the changes sorted by path
+func diffEntries(oldEntries, newEntries []ArchiveEntry) []Change {
+	oldByName := make(map[string]*ArchiveEntry, len(oldEntries))
+	for i := range oldEntries {
+		oldByName[oldEntries[i].Name] = &oldEntries[i]
+	}
+
+	var changes []Change
+	seen := make(map[string]bool, len(newEntries))
+	for i := range newEntries {
+		n := &newEntries[i]
+		if n.Name == "." {
+			continue
+		}
+		seen[n.Name] = true
+
+		o, ok := oldByName[n.Name]
+		switch {
+		case !ok:
+			changes = append(changes, Change{Name: n.Name, Kind: Added, New: n})
+		case entryChanged(o, n):
+			changes = append(changes, Change{Name: n.Name, Kind: Modified, Old: o, New: n})
+		}
+	}
+
+	for i := range oldEntries {
+		o := &oldEntries[i]
+		if o.Name != "." && !seen[o.Name] {
+			changes = append(changes, Change{Name: o.Name, Kind: Removed, Old: o})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Name < changes[j].Name
+	})
+	return changes
+}
+
+// entryChanged reports whether the type, permissions or contents of a path differ.
+// Hard links count as regular files, since which path is the link depends on walk order.
+func entryChanged(o, n *ArchiveEntry) bool {
+	if contentType(o.Type) != contentType(n.Type) || o.Mode.Perm() != n.Mode.Perm() {
+		return true
+	}
+	switch contentType(o.Type) {
+	case tar.TypeReg:
+		if o.SHA256 != "" && n.SHA256 != "" {
+			return o.SHA256 != n.SHA256
+		}
+		return o.Size != n.Size || !o.ModTime.Equal(n.ModTime)
+	case tar.TypeSymlink:
+		return o.Linkname != n.Linkname
+	}
+	return false
+}
+
+func contentType(t byte) byte {
+	if t == tar.TypeLink {
+		return tar.TypeReg
+	}
+	return t
+}
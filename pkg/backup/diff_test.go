@@ -0,0 +1,258 @@
+package backup
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/logandonley/packrat/pkg/config"
+)
+
+func TestDiffLive(t *testing.T) {
+	srcDir := t.TempDir()
+	write := func(name, content string) {
+		t.Helper()
+		path := filepath.Join(srcDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+	write("keep.txt", "unchanged")
+	write("data/db.sqlite", "v1")
+	write("old.log", "gone soon")
+	write("cache/tmp.bin", "ignored")
+	if err := os.Symlink("keep.txt", filepath.Join(srcDir, "link")); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+
+	store := &mockStorage{files: make(map[string][]byte)}
+	manager := &Manager{
+		config: &config.Config{
+			Services: map[string]config.Service{
+				"test": {Path: srcDir, Exclude: []string{"cache/**"}},
+			},
+		},
+		key:        []byte("testkey0123456789012345678901234"),
+		backupRoot: t.TempDir(),
+		Synology:   store,
+	}
+	if err := manager.CreateBackup("test"); err != nil {
+		t.Fatalf("Failed to create backup: %v", err)
+	}
+	files, _ := store.List("test-")
+	backupName := BackupFiles(files)[0].Name
+
+	write("data/db.sqlite", "v2")
+	write("new.txt", "hello")
+	write("cache/other.bin", "still ignored")
+	if err := os.Remove(filepath.Join(srcDir, "old.log")); err != nil {
+		t.Fatalf("Failed to remove file: %v", err)
+	}
+
+	want := []string{"M data/db.sqlite", "A new.txt", "D old.log"}
+
+	// Compare using the manifest, then by hashing the archive itself
+	for _, withManifest := range []bool{true, false} {
+		if !withManifest {
+			delete(store.files, ManifestName(backupName))
+		}
+		changes, err := manager.DiffLive("test", backupName, "")
+		if err != nil {
+			t.Fatalf("DiffLive failed: %v", err)
+		}
+		var got []string
+		for _, c := range changes {
+			got = append(got, fmt.Sprintf("%c %s", c.Kind, c.Name))
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("DiffLive (manifest: %v) = %v, want %v", withManifest, got, want)
+		}
+	}
+}
+
+func TestDiffBackups(t *testing.T) {
+	srcDir := t.TempDir()
+	write := func(name, content string) {
+		t.Helper()
+		path := filepath.Join(srcDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+	write("keep.txt", "unchanged")
+	write("data/db.sqlite", "v1")
+	write("old.log", "gone soon")
+	write("script.sh", "#!/bin/sh")
+	write("becomes-dir", "file")
+	if err := os.Symlink("keep.txt", filepath.Join(srcDir, "link")); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+
+	store := &mockStorage{files: make(map[string][]byte)}
+	manager := &Manager{
+		config: &config.Config{
+			Services: map[string]config.Service{"test": {Path: srcDir}},
+		},
+		key:        []byte("testkey0123456789012345678901234"),
+		backupRoot: t.TempDir(),
+		Synology:   store,
+	}
+
+	// Backups are named by the second, so the first is renamed out of the way
+	if err := manager.CreateBackup("test"); err != nil {
+		t.Fatalf("Failed to create backup: %v", err)
+	}
+	files, _ := store.List("test-")
+	oldName := "test-2024-01-01T00-00-00Z.enc"
+	store.files[oldName] = store.files[BackupFiles(files)[0].Name]
+	store.files[ManifestName(oldName)] = store.files[ManifestName(BackupFiles(files)[0].Name)]
+	delete(store.files, BackupFiles(files)[0].Name)
+	delete(store.files, ManifestName(BackupFiles(files)[0].Name))
+
+	write("data/db.sqlite", "v2") // Same size, different contents
+	write("new.txt", "hello")
+	if err := os.Remove(filepath.Join(srcDir, "old.log")); err != nil {
+		t.Fatalf("Failed to remove file: %v", err)
+	}
+	if err := os.Chmod(filepath.Join(srcDir, "script.sh"), 0755); err != nil {
+		t.Fatalf("Failed to change mode: %v", err)
+	}
+	if err := os.Remove(filepath.Join(srcDir, "link")); err != nil {
+		t.Fatalf("Failed to remove symlink: %v", err)
+	}
+	if err := os.Symlink("new.txt", filepath.Join(srcDir, "link")); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+	if err := os.Remove(filepath.Join(srcDir, "becomes-dir")); err != nil {
+		t.Fatalf("Failed to remove file: %v", err)
+	}
+	write("becomes-dir/inner.txt", "inner")
+
+	if err := manager.CreateBackup("test"); err != nil {
+		t.Fatalf("Failed to create backup: %v", err)
+	}
+	files, _ = store.List("test-")
+	var newName string
+	for _, f := range BackupFiles(files) {
+		if f.Name != oldName {
+			newName = f.Name
+		}
+	}
+
+	want := []string{
+		"M becomes-dir",
+		"A becomes-dir/inner.txt",
+		"M data/db.sqlite",
+		"M link",
+		"A new.txt",
+		"D old.log",
+		"M script.sh",
+	}
+
+	// Compare using both manifests, one, then neither
+	for _, drop := range []string{"", ManifestName(oldName), ManifestName(newName)} {
+		if drop != "" {
+			delete(store.files, drop)
+		}
+		changes, err := manager.DiffBackups("test", oldName, newName, "")
+		if err != nil {
+			t.Fatalf("DiffBackups failed: %v", err)
+		}
+		var got []string
+		for _, c := range changes {
+			got = append(got, fmt.Sprintf("%c %s", c.Kind, c.Name))
+			if (c.Kind != Added) != (c.Old != nil) || (c.Kind != Removed) != (c.New != nil) {
+				t.Errorf("Change %s has entries old=%v new=%v", c.Name, c.Old, c.New)
+			}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("DiffBackups (dropped %q) = %v, want %v", drop, got, want)
+		}
+	}
+
+	// A backup is identical to itself
+	changes, err := manager.DiffBackups("test", newName, newName, "")
+	if err != nil || len(changes) != 0 {
+		t.Errorf("DiffBackups with itself = %v, %v; want no changes", changes, err)
+	}
+
+	if _, err := manager.DiffBackups("missing", oldName, newName, ""); err == nil {
+		t.Error("Expected an error for an unknown service")
+	}
+	if _, err := manager.DiffBackups("test", oldName, "test-2000-01-01T00-00-00Z.enc", ""); err == nil {
+		t.Error("Expected an error for a missing backup")
+	}
+}
+
+func TestHashArchive(t *testing.T) {
+	srcDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(srcDir, "data"), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(srcDir, "data", "a.txt"), []byte("contents"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(srcDir, "empty"), nil, 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if err := os.Link(filepath.Join(srcDir, "data", "a.txt"), filepath.Join(srcDir, "hardlink")); err != nil {
+		t.Fatalf("Failed to create hard link: %v", err)
+	}
+	if err := os.Symlink("data/a.txt", filepath.Join(srcDir, "symlink")); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+
+	manager := &Manager{config: &config.Config{}}
+	var archive bytes.Buffer
+	manifestEntries, err := manager.createArchive(archiveSources{path: srcDir}, &archive)
+	if err != nil {
+		t.Fatalf("Failed to create archive: %v", err)
+	}
+
+	entries, err := hashArchive(bytes.NewReader(archive.Bytes()))
+	if err != nil {
+		t.Fatalf("hashArchive failed: %v", err)
+	}
+
+	// Hashing the archive gives the same hashes the manifest records
+	hashes := func(entries []ArchiveEntry) map[string]string {
+		m := make(map[string]string)
+		for _, e := range entries {
+			m[e.Name] = e.SHA256
+		}
+		return m
+	}
+	got, want := hashes(entries), hashes(manifestEntries)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("hashArchive() hashes = %v, want %v", got, want)
+	}
+
+	sum := sha256.Sum256([]byte("contents"))
+	empty := sha256.Sum256(nil)
+	for name, hash := range map[string]string{
+		filepath.Join("data", "a.txt"): hex.EncodeToString(sum[:]),
+		"hardlink":                     hex.EncodeToString(sum[:]),
+		"empty":                        hex.EncodeToString(empty[:]),
+		"symlink":                      "",
+		"data":                         "",
+	} {
+		if got[name] != hash {
+			t.Errorf("Hash of %s = %q, want %q", name, got[name], hash)
+		}
+	}
+
+	if _, err := hashArchive(bytes.NewReader([]byte("not an archive"))); err == nil {
+		t.Error("Expected an error for a corrupt archive")
+	}
+}
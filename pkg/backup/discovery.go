@@ -0,0 +1,249 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/logandonley/packrat/pkg/config"
+	"github.com/robfig/cron/v3"
+)
+
+// Container labels that declare a service
+const (
+	labelEnable   = "packrat.enable"
+	labelName     = "packrat.name"
+	labelSchedule = "packrat.schedule"
+	labelPaths    = "packrat.paths"
+	labelExclude  = "packrat.exclude"
+	labelRetain   = "packrat.retain"
+	labelMode     = "packrat.mode"
+	labelPriority = "packrat.priority"
+)
+
+// serviceNamePattern matches names that are safe to use in backup file names
+var serviceNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// watchRetryDelay is the wait before resubscribing to Docker events after the stream fails
+const watchRetryDelay = 10 * time.Second
+
+// discoveredService is a service declared with labels on a container
+type discoveredService struct {
+	service   config.Service
+	container string
+}
+
+// service returns a configured or discovered service. Configured services take
+// precedence over discovered ones with the same name.
+func (m *Manager) service(name string) (config.Service, bool) {
+	if service, ok := m.config.Services[name]; ok {
+		return service, true
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	d, ok := m.discovered[name]
+	return d.service, ok
+}
+
+// DiscoveredFrom returns the container a service was discovered from, or
+// false if the service comes from the configuration file
+func (m *Manager) DiscoveredFrom(name string) (string, bool) {
+	if _, ok := m.config.Services[name]; ok {
+		return "", false
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	d, ok := m.discovered[name]
+	return d.container, ok
+}
+
+// DiscoverServices replaces the discovered services with those declared by
+// the labels of current containers, running or not. Containers with invalid
+// labels, or whose service name is already taken, are skipped with a warning.
+func (m *Manager) DiscoverServices() error {
+	runtime, err := m.containerRuntime()
+	if err != nil {
+		return fmt.Errorf("cannot discover services: %w", err)
+	}
+
+	list, err := runtime.List(context.Background(), labelEnable+"=true", true)
+	if err != nil {
+		return fmt.Errorf("failed to list containers: %w", err)
+	}
+
+	var names []string
+	labels := make(map[string]map[string]string, len(list))
+	for _, c := range list {
+		if len(c.Names) == 0 {
+			continue
+		}
+		name := strings.TrimPrefix(c.Names[0], "/")
+		names = append(names, name)
+		labels[name] = c.Labels
+	}
+	sort.Strings(names)
+
+	discovered := make(map[string]discoveredService)
+	for _, containerName := range names {
+		name, service, err := parseServiceLabels(containerName, labels[containerName])
+		if err != nil {
+			log.Printf("Warning: ignoring labels on container %s: %v", containerName, err)
+			continue
+		}
+		if _, ok := m.config.Services[name]; ok {
+			log.Printf("Warning: ignoring labels on container %s: service %s is already configured", containerName, name)
+			continue
+		}
+		if other, ok := discovered[name]; ok {
+			log.Printf("Warning: ignoring labels on container %s: service %s is already declared by container %s", containerName, name, other.container)
+			continue
+		}
+		discovered[name] = discoveredService{service: service, container: containerName}
+	}
+
+	m.mu.Lock()
+	m.discovered = discovered
+	m.mu.Unlock()
+	return nil
+}
+
+// WatchServices follows Docker events until ctx is cancelled, rediscovering
+// services as labeled containers are created, renamed or removed. onChange is
+// called after each rediscovery.
+func (m *Manager) WatchServices(ctx context.Context, onChange func()) {
+	cli, err := m.docker()
+	if err != nil {
+		log.Printf("Warning: not watching for labeled containers: %v", err)
+		return
+	}
+
+	for {
+		msgs, errs := cli.Events(ctx, events.ListOptions{
+			Filters: filters.NewArgs(
+				filters.Arg("type", string(events.ContainerEventType)),
+				filters.Arg("label", labelEnable),
+				filters.Arg("event", string(events.ActionCreate)),
+				filters.Arg("event", string(events.ActionDestroy)),
+				filters.Arg("event", string(events.ActionRename)),
+			),
+		})
+
+		// Catch up on anything missed while not subscribed
+		m.rediscover(onChange)
+
+	stream:
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg := <-msgs:
+				debugLog("Docker event %s for container %s", msg.Action, msg.Actor.Attributes["name"])
+				m.rediscover(onChange)
+			case err := <-errs:
+				log.Printf("Warning: Docker event stream failed, retrying in %s: %v", watchRetryDelay, err)
+				break stream
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(watchRetryDelay):
+		}
+	}
+}
+
+func (m *Manager) rediscover(onChange func()) {
+	if err := m.DiscoverServices(); err != nil {
+		log.Printf("Warning: %v", err)
+		return
+	}
+	onChange()
+}
+
+// parseServiceLabels builds a service from a container's packrat.* labels. The
+// service is named after the container unless packrat.name is set, and the
+// container is stopped during its backups. Entries in packrat.paths are host
+// directories if absolute and named volumes otherwise, like docker run -v.
+func parseServiceLabels(containerName string, labels map[string]string) (string, config.Service, error) {
+	name := containerName
+	if labels[labelName] != "" {
+		name = labels[labelName]
+	}
+	if !serviceNamePattern.MatchString(name) {
+		return "", config.Service{}, fmt.Errorf("invalid service name %q", name)
+	}
+
+	service := config.Service{
+		Schedule: labels[labelSchedule],
+		Docker:   &config.Docker{Container: containerName, Mode: labels[labelMode]},
+	}
+
+	for _, entry := range splitLabel(labels[labelPaths]) {
+		if !filepath.IsAbs(entry) {
+			if err := validateVolumeName(entry); err != nil {
+				return "", config.Service{}, err
+			}
+			service.Docker.Volumes = append(service.Docker.Volumes, entry)
+			continue
+		}
+		if service.Path != "" {
+			return "", config.Service{}, fmt.Errorf("%s can have only one host directory", labelPaths)
+		}
+		service.Path = filepath.Clean(entry)
+	}
+	if service.Path == "" && len(service.Docker.Volumes) == 0 {
+		return "", config.Service{}, fmt.Errorf("%s is not set", labelPaths)
+	}
+
+	service.Exclude = splitLabel(labels[labelExclude])
+
+	if service.Schedule != "" {
+		if _, err := cron.ParseStandard(service.Schedule); err != nil {
+			return "", config.Service{}, fmt.Errorf("invalid %s %q: %w", labelSchedule, service.Schedule, err)
+		}
+	}
+
+	if retain := labels[labelRetain]; retain != "" {
+		n, err := strconv.Atoi(retain)
+		if err != nil || n < 1 {
+			return "", config.Service{}, fmt.Errorf("invalid %s %q", labelRetain, retain)
+		}
+		service.RetainBackups = &n
+	}
+
+	if priority := labels[labelPriority]; priority != "" {
+		n, err := strconv.Atoi(priority)
+		if err != nil {
+			return "", config.Service{}, fmt.Errorf("invalid %s %q", labelPriority, priority)
+		}
+		service.Priority = n
+	}
+
+	switch service.Docker.Mode {
+	case "", config.DockerModeStop, config.DockerModePause, config.DockerModeNone:
+	default:
+		return "", config.Service{}, fmt.Errorf("invalid %s %q", labelMode, service.Docker.Mode)
+	}
+
+	return name, service, nil
+}
+
+// splitLabel splits a comma-separated label value, dropping empty items
+func splitLabel(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,78 @@
+package backup
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/logandonley/packrat/pkg/config"
+)
+
+func TestParseServiceLabels(t *testing.T) {
+	name, service, err := parseServiceLabels("gitea", map[string]string{
+		"packrat.enable":   "true",
+		"packrat.schedule": "0 2 * * *",
+		"packrat.paths":    "/srv/gitea/, gitea_data",
+		"packrat.exclude":  "**/tmp/**,**/*.log",
+		"packrat.retain":   "14",
+		"packrat.priority": "10",
+	})
+	if err != nil {
+		t.Fatalf("parseServiceLabels failed: %v", err)
+	}
+	retain := 14
+	want := config.Service{
+		Path:          "/srv/gitea",
+		Schedule:      "0 2 * * *",
+		Docker:        &config.Docker{Container: "gitea", Volumes: []string{"gitea_data"}},
+		Exclude:       []string{"**/tmp/**", "**/*.log"},
+		RetainBackups: &retain,
+		Priority:      10,
+	}
+	if name != "gitea" || !reflect.DeepEqual(service, want) {
+		t.Errorf("parseServiceLabels() = %s, %+v; want gitea, %+v", name, service, want)
+	}
+
+	if name, _, err := parseServiceLabels("app-1", map[string]string{"packrat.name": "app", "packrat.paths": "data"}); err != nil || name != "app" {
+		t.Errorf("parseServiceLabels() = %q, %v; want app", name, err)
+	}
+
+	for _, labels := range []map[string]string{
+		{},
+		{"packrat.paths": "/a,/b"},
+		{"packrat.paths": "/a", "packrat.schedule": "daily"},
+		{"packrat.paths": "/a", "packrat.retain": "0"},
+		{"packrat.paths": "/a", "packrat.mode": "freeze"},
+		{"packrat.paths": "/a", "packrat.priority": "high"},
+		{"packrat.paths": "/a", "packrat.name": "../etc"},
+	} {
+		if _, _, err := parseServiceLabels("app", labels); err == nil {
+			t.Errorf("Expected an error for %v", labels)
+		}
+	}
+}
+
+func TestDiscoveredServices(t *testing.T) {
+	manager := &Manager{
+		config: &config.Config{Services: map[string]config.Service{
+			"app": {Path: "/srv/app"},
+		}},
+		discovered: map[string]discoveredService{
+			"app":   {service: config.Service{Path: "/srv/shadowed"}, container: "app"},
+			"gitea": {service: config.Service{Path: "/srv/gitea"}, container: "gitea-1"},
+		},
+	}
+
+	services := manager.GetServices()
+	if len(services) != 2 || services["app"].Path != "/srv/app" || services["gitea"].Path != "/srv/gitea" {
+		t.Errorf("GetServices() = %+v", services)
+	}
+	if container, ok := manager.DiscoveredFrom("gitea"); !ok || container != "gitea-1" {
+		t.Errorf("DiscoveredFrom(gitea) = %q, %v; want gitea-1, true", container, ok)
+	}
+	if _, ok := manager.DiscoveredFrom("app"); ok {
+		t.Error("Configured service reported as discovered")
+	}
+	if service, ok := manager.service("gitea"); !ok || service.Path != "/srv/gitea" {
+		t.Errorf("service(gitea) = %+v, %v", service, ok)
+	}
+}
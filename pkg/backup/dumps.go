@@ -0,0 +1,253 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/logandonley/packrat/pkg/config"
+)
+
+// dumpsDir is where dumps are stored in the archive. Being inside the metadata
+// directory, they are not extracted when restoring in place.
+var dumpsDir = filepath.Join(metadataDir, "dumps")
+
+// isDump reports whether an archive path is in the dumps directory
+func isDump(name string) bool {
+	return strings.HasPrefix(filepath.Clean(name), dumpsDir+string(filepath.Separator))
+}
+
+// capturedDump is a generated file, ready to be archived. Small files are kept
+// in data; dump command output is spooled to disk.
+type capturedDump struct {
+	name    string
+	data    []byte
+	spool   *dumpSpool
+	modTime time.Time
+}
+
+// size returns the length of the captured contents
+func (d capturedDump) size() int64 {
+	if d.spool != nil {
+		return d.spool.size
+	}
+	return int64(len(d.data))
+}
+
+// open returns a reader for the captured contents
+func (d capturedDump) open() (io.Reader, error) {
+	if d.spool != nil {
+		return d.spool.reader()
+	}
+	return bytes.NewReader(d.data), nil
+}
+
+// dumpSpool holds a dump's output in a temporary file, encrypted with a key
+// that only exists in memory, so the plaintext never touches the host disk
+type dumpSpool struct {
+	file   *os.File
+	key    []byte
+	size   int64
+	writer io.Writer
+}
+
+// newDumpSpool creates an empty spool file in dir
+func newDumpSpool(dir string) (*dumpSpool, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate spool key: %w", err)
+	}
+	file, err := os.CreateTemp(dir, "dump-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create spool file: %w", err)
+	}
+	s := &dumpSpool{file: file, key: key}
+	stream, err := s.stream()
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	s.writer = cipher.StreamWriter{S: stream, W: file}
+	return s, nil
+}
+
+// stream returns the keystream the spool is encrypted with. The key is never
+// reused for other data, so a fixed IV is fine.
+func (s *dumpSpool) stream() (cipher.Stream, error) {
+	block, err := aes.NewCipher(s.key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create spool cipher: %w", err)
+	}
+	return cipher.NewCTR(block, make([]byte, aes.BlockSize)), nil
+}
+
+// Write encrypts p and appends it to the spool file
+func (s *dumpSpool) Write(p []byte) (int, error) {
+	n, err := s.writer.Write(p)
+	s.size += int64(n)
+	return n, err
+}
+
+// reader returns the decrypted contents from the start of the spool file
+func (s *dumpSpool) reader() (io.Reader, error) {
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to rewind spool file: %w", err)
+	}
+	stream, err := s.stream()
+	if err != nil {
+		return nil, err
+	}
+	return io.LimitReader(cipher.StreamReader{S: stream, R: s.file}, s.size), nil
+}
+
+// Close removes the spool file
+func (s *dumpSpool) Close() error {
+	s.file.Close()
+	return os.Remove(s.file.Name())
+}
+
+// closeDumps removes the spool files of captured dumps
+func closeDumps(dumps []capturedDump) {
+	for _, dump := range dumps {
+		if dump.spool != nil {
+			dump.spool.Close()
+		}
+	}
+}
+
+// validateDumpName checks that a dump's name is a relative path that stays
+// inside the dumps directory
+func validateDumpName(name string) error {
+	clean := filepath.Clean(name)
+	if name == "" || clean == "." || filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("invalid dump name %q: must be a relative path", name)
+	}
+	return nil
+}
+
+// captureDumps runs a service's dump commands, spooling their output to
+// encrypted files in dir
+func (m *Manager) captureDumps(service config.Service, job *hookJob, dir string) (dumps []capturedDump, err error) {
+	defer func() {
+		if err != nil {
+			closeDumps(dumps)
+		}
+	}()
+	seen := make(map[string]bool)
+
+	for _, dump := range service.Dumps {
+		if err := validateDumpName(dump.Name); err != nil {
+			return dumps, err
+		}
+		name := filepath.Clean(dump.Name)
+		if seen[name] {
+			return dumps, fmt.Errorf("duplicate dump name %s", name)
+		}
+		seen[name] = true
+
+		spool, err := newDumpSpool(dir)
+		if err != nil {
+			return dumps, err
+		}
+		dumps = append(dumps, capturedDump{name: filepath.Join(dumpsDir, name), spool: spool, modTime: time.Now()})
+		if err := m.runDump(dump, service, job.env("dump:"+name), spool); err != nil {
+			return dumps, fmt.Errorf("failed to capture dump %s: %w", name, err)
+		}
+		debugLog("Captured dump %s (%d bytes)", name, spool.size)
+	}
+
+	return dumps, nil
+}
+
+// runDump runs a dump command on the host or in a container, writing its stdout
+// to stdout. stderr goes to the log.
+func (m *Manager) runDump(dump config.Dump, service config.Service, env []string, stdout io.Writer) error {
+	cmd := dump.Command
+	if dump.Container != "" {
+		cmd.ExecIn = dump.Container
+	}
+
+	containerName, err := execContainer(&cmd, service)
+	if err != nil {
+		return err
+	}
+
+	stderr := newLogWriter(dump.Name + " stderr")
+	defer stderr.Flush()
+
+	if containerName != "" {
+		return m.execInContainer(containerName, &cmd, env, stdout, stderr)
+	}
+
+	timeout, err := commandTimeout(&cmd)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	command := exec.CommandContext(ctx, "sh", "-c", cmd.Command)
+	command.Dir = service.Path
+	if cmd.WorkingDir != "" {
+		command.Dir = cmd.WorkingDir
+	}
+	command.Env = append(os.Environ(), env...)
+	for key, value := range cmd.Environment {
+		command.Env = append(command.Env, fmt.Sprintf("%s=%s", key, value))
+	}
+	command.Stdout = stdout
+	command.Stderr = stderr
+
+	if err := command.Run(); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("command timed out after %s", timeout)
+		}
+		return fmt.Errorf("command failed: %w", err)
+	}
+	return nil
+}
+
+// writeDumps adds captured files to an archive as regular files readable only by their owner
+func writeDumps(tw *tar.Writer, dumps []capturedDump) ([]ArchiveEntry, error) {
+	var entries []ArchiveEntry
+	for _, dump := range dumps {
+		header := &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     dump.name,
+			Size:     dump.size(),
+			Mode:     0600,
+			ModTime:  dump.modTime,
+			Uid:      os.Getuid(),
+			Gid:      os.Getgid(),
+			Format:   tar.FormatPAX,
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return nil, fmt.Errorf("failed to write tar header: %w", err)
+		}
+		contents, err := dump.open()
+		if err != nil {
+			return nil, err
+		}
+		hash := sha256.New()
+		if _, err := io.Copy(tw, io.TeeReader(contents, hash)); err != nil {
+			return nil, fmt.Errorf("failed to write dump %s: %w", dump.name, err)
+		}
+
+		entry := entryFromHeader(header)
+		entry.SHA256 = hex.EncodeToString(hash.Sum(nil))
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
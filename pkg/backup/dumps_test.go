@@ -0,0 +1,133 @@
+package backup
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/logandonley/packrat/pkg/config"
+)
+
+func TestBackupDumps(t *testing.T) {
+	srcDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(srcDir, "data.txt"), []byte("data"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	store := &mockStorage{files: make(map[string][]byte)}
+	service := config.Service{
+		Path: srcDir,
+		Dumps: []config.Dump{
+			{Name: "dumps/db.sql", Command: config.Command{Command: `echo "dump of $PACKRAT_SERVICE"`}},
+		},
+	}
+	manager := &Manager{
+		config:     &config.Config{Services: map[string]config.Service{"test": service}},
+		key:        []byte("testkey0123456789012345678901234"),
+		backupRoot: t.TempDir(),
+		Synology:   store,
+	}
+
+	if err := manager.CreateBackup("test"); err != nil {
+		t.Fatalf("Failed to create backup: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(srcDir, "dumps")); !os.IsNotExist(err) {
+		t.Errorf("Dump was written to the service directory")
+	}
+	if entries, _ := os.ReadDir(manager.backupRoot); len(entries) != 0 {
+		t.Errorf("Spool files were left in the backup root: %v", entries)
+	}
+
+	files, _ := store.List("test-")
+	backupName := BackupFiles(files)[0].Name
+	var out bytes.Buffer
+	if err := manager.CatBackupFile("test", backupName, ".packrat/dumps/dumps/db.sql", "", &out); err != nil {
+		t.Fatalf("Failed to read dump from backup: %v", err)
+	}
+	if got := out.String(); got != "dump of test\n" {
+		t.Errorf("Dump contents = %q, want %q", got, "dump of test\n")
+	}
+
+	// Dumps only exist in backups, so they don't show up as removed files
+	changes, err := manager.DiffLive("test", backupName, "")
+	if err != nil {
+		t.Fatalf("DiffLive failed: %v", err)
+	}
+	if len(changes) != 0 {
+		t.Errorf("DiffLive reported changes: %+v", changes)
+	}
+
+	// A dump may not escape the dumps directory
+	for _, name := range []string{"../escape.sql", "/abs.sql"} {
+		service.Dumps[0].Name = name
+		manager.config.Services["test"] = service
+		if err := manager.CreateBackup("test"); err == nil {
+			t.Errorf("Expected an error for dump name %s", name)
+		}
+	}
+
+	// A failing dump command fails the backup
+	service.Dumps[0] = config.Dump{Name: "db.sql", Command: config.Command{Command: "exit 3"}}
+	manager.config.Services["test"] = service
+	if err := manager.CreateBackup("test"); err == nil {
+		t.Error("Expected a failing dump command to fail the backup")
+	}
+}
+
+func TestRestoreDumpsRoundTrip(t *testing.T) {
+	srcDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(srcDir, "data.txt"), []byte("data"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	store := &mockStorage{files: make(map[string][]byte)}
+	service := config.Service{
+		Path:  srcDir,
+		Dumps: []config.Dump{{Name: "db.sql", Command: config.Command{Command: "echo dump"}}},
+	}
+	manager := &Manager{
+		config:     &config.Config{Services: map[string]config.Service{"test": service}},
+		key:        []byte("testkey0123456789012345678901234"),
+		backupRoot: t.TempDir(),
+		stateDir:   t.TempDir(),
+		Synology:   store,
+	}
+
+	if err := manager.CreateBackup("test"); err != nil {
+		t.Fatalf("Failed to create backup: %v", err)
+	}
+	files, _ := store.List("test-")
+	backupName := BackupFiles(files)[0].Name
+
+	// Restoring in place leaves the dump out of the service directory
+	if err := manager.RestoreBackup("test", backupName); err != nil {
+		t.Fatalf("Failed to restore backup: %v", err)
+	}
+	for _, name := range []string{"db.sql", ".packrat"} {
+		if _, err := os.Stat(filepath.Join(srcDir, name)); !os.IsNotExist(err) {
+			t.Errorf("Restore wrote %s to the service directory", name)
+		}
+	}
+
+	// So the next backup succeeds
+	if err := manager.CreateBackup("test"); err != nil {
+		t.Fatalf("Failed to back up the restored service: %v", err)
+	}
+
+	// Dumps are extracted on request
+	dumpsDir := t.TempDir()
+	if err := manager.RestoreBackupWithOptions("test", backupName, RestoreOptions{DumpsPath: dumpsDir}); err != nil {
+		t.Fatalf("Failed to restore backup with dumps: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(dumpsDir, "db.sql"))
+	if err != nil {
+		t.Fatalf("Dump was not extracted: %v", err)
+	}
+	if string(data) != "dump\n" {
+		t.Errorf("Dump contents = %q, want %q", data, "dump\n")
+	}
+	if _, err := os.Stat(filepath.Join(srcDir, "db.sql")); !os.IsNotExist(err) {
+		t.Error("Dump was extracted to the service directory")
+	}
+}
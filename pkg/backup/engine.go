@@ -0,0 +1,61 @@
+package backup
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/docker/docker/client"
+	"github.com/logandonley/packrat/pkg/config"
+)
+
+// newEngineClient creates a client for the configured Docker-compatible endpoint.
+// The API version is negotiated with the engine unless it is pinned.
+func newEngineClient(engine config.ContainerEngine) (*client.Client, error) {
+	opts := []client.Opt{client.FromEnv}
+	if host := engineHost(engine); host != "" {
+		opts = append(opts, client.WithHost(host))
+	}
+	if engine.APIVersion != "" {
+		opts = append(opts, client.WithVersion(engine.APIVersion))
+	} else {
+		opts = append(opts, client.WithAPIVersionNegotiation())
+	}
+
+	cli, err := client.NewClientWithOpts(opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create container engine client: %w", err)
+	}
+	return cli, nil
+}
+
+// engineHost returns the endpoint to connect to, or "" for the client's default
+func engineHost(engine config.ContainerEngine) string {
+	if engine.Host != "" {
+		return engine.Host
+	}
+	if os.Getenv("DOCKER_HOST") != "" {
+		return ""
+	}
+	for _, socket := range engineSockets() {
+		if info, err := os.Stat(socket); err == nil && info.Mode()&os.ModeSocket != 0 {
+			return "unix://" + socket
+		}
+	}
+	return ""
+}
+
+// engineSockets lists where Docker, rootless Docker and Podman usually listen
+func engineSockets() []string {
+	runtimeDir := os.Getenv("XDG_RUNTIME_DIR")
+	if runtimeDir == "" {
+		runtimeDir = filepath.Join("/run/user", strconv.Itoa(os.Getuid()))
+	}
+	return []string{
+		"/var/run/docker.sock",
+		filepath.Join(runtimeDir, "docker.sock"),
+		filepath.Join(runtimeDir, "podman", "podman.sock"),
+		"/run/podman/podman.sock",
+	}
+}
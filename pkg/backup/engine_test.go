@@ -0,0 +1,49 @@
+package backup
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/logandonley/packrat/pkg/config"
+)
+
+func TestEngineHost(t *testing.T) {
+	runtimeDir := t.TempDir()
+	t.Setenv("XDG_RUNTIME_DIR", runtimeDir)
+	t.Setenv("DOCKER_HOST", "")
+
+	// A configured host always wins
+	engine := config.ContainerEngine{Host: "tcp://engine:2375"}
+	if host := engineHost(engine); host != "tcp://engine:2375" {
+		t.Errorf("Expected the configured host, got %q", host)
+	}
+
+	// Otherwise a rootless Podman socket is found in the runtime directory,
+	// unless a system socket comes first
+	if _, err := os.Stat("/var/run/docker.sock"); err == nil {
+		t.Skip("system Docker socket present")
+	}
+	socketPath := filepath.Join(runtimeDir, "podman", "podman.sock")
+	if err := os.MkdirAll(filepath.Dir(socketPath), 0755); err != nil {
+		t.Fatalf("Failed to create socket directory: %v", err)
+	}
+	if host := engineHost(config.ContainerEngine{}); host != "" {
+		t.Errorf("Expected no host without a socket, got %q", host)
+	}
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("Failed to create socket: %v", err)
+	}
+	defer listener.Close()
+	if host := engineHost(config.ContainerEngine{}); host != "unix://"+socketPath {
+		t.Errorf("Expected the Podman socket, got %q", host)
+	}
+
+	// DOCKER_HOST is left to the client
+	t.Setenv("DOCKER_HOST", "unix:///elsewhere.sock")
+	if host := engineHost(config.ContainerEngine{}); host != "" {
+		t.Errorf("Expected DOCKER_HOST to take over, got %q", host)
+	}
+}
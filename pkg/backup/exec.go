@@ -0,0 +1,112 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/logandonley/packrat/pkg/config"
+)
+
+// ExecInContainer is the exec_in value for running in the service's own
+// container, and ExecInService is accepted for it too. Any other value names a
+// container.
+const (
+	ExecInContainer = "container"
+	ExecInService   = "service"
+)
+
+// IsOwnContainer reports whether an exec_in value means the service's own container
+func IsOwnContainer(execIn string) bool {
+	return execIn == ExecInContainer || execIn == ExecInService
+}
+
+// execContainer returns the container a command runs in, or "" to run it on the host
+func execContainer(cmd *config.Command, service config.Service) (string, error) {
+	if !IsOwnContainer(cmd.ExecIn) {
+		return cmd.ExecIn, nil
+	}
+	if service.Docker == nil || service.Docker.Container == "" {
+		return "", fmt.Errorf("exec_in: %s needs the service to have a docker.container", cmd.ExecIn)
+	}
+	return service.Docker.Container, nil
+}
+
+// execInContainer runs a command in a running container through the container
+// runtime, writing its output to stdout and stderr. env is added before the
+// command's own variables. Unlike host commands, the working directory defaults
+// to the container's.
+func (m *Manager) execInContainer(containerName string, cmd *config.Command, env []string, stdout, stderr io.Writer) error {
+	runtime, err := m.containerRuntime()
+	if err != nil {
+		return fmt.Errorf("cannot run command in container %s: %w", containerName, err)
+	}
+
+	timeout, err := commandTimeout(cmd)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	for key, value := range cmd.Environment {
+		env = append(env, fmt.Sprintf("%s=%s", key, value))
+	}
+
+	exitCode, err := runtime.Exec(ctx, containerName, ExecOptions{
+		Cmd:        []string{"sh", "-c", cmd.Command},
+		User:       cmd.User,
+		WorkingDir: cmd.WorkingDir,
+		Env:        env,
+		Stdout:     stdout,
+		Stderr:     stderr,
+	})
+	if ctx.Err() != nil {
+		if err != nil && !errors.Is(err, ctx.Err()) {
+			return fmt.Errorf("command timed out after %s in container %s: %w", timeout, containerName, err)
+		}
+		return fmt.Errorf("command timed out after %s in container %s", timeout, containerName)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to run command in container %s: %w", containerName, err)
+	}
+	if exitCode != 0 {
+		return fmt.Errorf("command failed in container %s with exit code %d", containerName, exitCode)
+	}
+	return nil
+}
+
+// logWriter logs each line written to it with a prefix
+type logWriter struct {
+	prefix string
+	buf    bytes.Buffer
+}
+
+func newLogWriter(prefix string) *logWriter {
+	return &logWriter{prefix: prefix}
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	w.buf.Write(p)
+	for {
+		line, err := w.buf.ReadString('\n')
+		if err != nil {
+			// Keep the partial line until the rest of it arrives
+			w.buf.Reset()
+			w.buf.WriteString(line)
+			return len(p), nil
+		}
+		log.Printf("[%s] %s", w.prefix, line[:len(line)-1])
+	}
+}
+
+// Flush logs any final line that didn't end with a newline
+func (w *logWriter) Flush() {
+	if w.buf.Len() > 0 {
+		log.Printf("[%s] %s", w.prefix, w.buf.String())
+		w.buf.Reset()
+	}
+}
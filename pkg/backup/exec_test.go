@@ -0,0 +1,217 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/logandonley/packrat/pkg/config"
+)
+
+func TestExecContainer(t *testing.T) {
+	withDocker := config.Service{Docker: &config.Docker{Container: "postgres"}}
+
+	tests := []struct {
+		name    string
+		execIn  string
+		service config.Service
+		want    string
+		wantErr bool
+	}{
+		{name: "host", execIn: "", service: withDocker, want: ""},
+		{name: "own container", execIn: "container", service: withDocker, want: "postgres"},
+		{name: "own container as service", execIn: "service", service: withDocker, want: "postgres"},
+		{name: "named container", execIn: "redis", service: withDocker, want: "redis"},
+		{name: "own container without docker", execIn: "container", service: config.Service{}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := execContainer(&config.Command{ExecIn: tt.execIn}, tt.service)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("execContainer() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("execContainer() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExecInContainerTimeout(t *testing.T) {
+	runtime := newFakeRuntime(t)
+	manager := &Manager{config: &config.Config{}, runtime: runtime}
+	cmd := &config.Command{Command: "sleep 60", Timeout: "10ms"}
+
+	tests := []struct {
+		name string
+		exec func(ctx context.Context, opts ExecOptions) (int, error)
+		want string
+	}{
+		{
+			name: "killed",
+			exec: func(ctx context.Context, opts ExecOptions) (int, error) {
+				<-ctx.Done()
+				return 0, ctx.Err()
+			},
+			want: "command timed out after 10ms in container db",
+		},
+		{
+			name: "still running",
+			exec: func(ctx context.Context, opts ExecOptions) (int, error) {
+				<-ctx.Done()
+				return 0, errors.New("the command could not be killed and is still running (pid 42)")
+			},
+			want: "command timed out after 10ms in container db: the command could not be killed and is still running (pid 42)",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runtime.containers["db"] = &fakeContainer{running: true, exec: tt.exec}
+			err := manager.execInContainer("db", cmd, nil, io.Discard, io.Discard)
+			if err == nil || err.Error() != tt.want {
+				t.Errorf("execInContainer() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+// fakeExecAPI serves the Docker exec API with a process on the host, the way
+// the engine runs an exec's process
+type fakeExecAPI struct {
+	client.APIClient
+	cmd    *exec.Cmd
+	exited chan struct{}
+	conn   net.Conn // The engine's end of the attach connection
+}
+
+func (f *fakeExecAPI) ContainerExecCreate(ctx context.Context, name string, options container.ExecOptions) (types.IDResponse, error) {
+	return types.IDResponse{ID: "exec"}, nil
+}
+
+func (f *fakeExecAPI) ContainerExecAttach(ctx context.Context, execID string, options container.ExecAttachOptions) (types.HijackedResponse, error) {
+	if err := f.cmd.Start(); err != nil {
+		return types.HijackedResponse{}, err
+	}
+	go func() {
+		f.cmd.Wait()
+		close(f.exited)
+	}()
+	client, engine := net.Pipe()
+	f.conn = engine
+	// Stream output until the connection closes, even after the process is gone
+	go func() {
+		out := stdcopy.NewStdWriter(engine, stdcopy.Stdout)
+		for {
+			if _, err := out.Write([]byte("output\n")); err != nil {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	return types.NewHijackedResponse(client, ""), nil
+}
+
+func (f *fakeExecAPI) ContainerExecInspect(ctx context.Context, execID string) (container.ExecInspect, error) {
+	select {
+	case <-f.exited:
+		return container.ExecInspect{ExecID: execID, ExitCode: -1}, nil
+	default:
+		return container.ExecInspect{ExecID: execID, Running: true, Pid: f.cmd.Process.Pid}, nil
+	}
+}
+
+// processGone reports whether a process has exited, counting zombies as exited
+func processGone(pid int) bool {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return true
+	}
+	// The state follows the command name in parentheses
+	fields := strings.Fields(string(data[bytes.LastIndexByte(data, ')')+1:]))
+	return len(fields) > 0 && fields[0] == "Z"
+}
+
+func TestDockerExecTimeout(t *testing.T) {
+	if _, err := os.Stat("/proc/self/stat"); err != nil {
+		t.Skip("Needs /proc")
+	}
+	childFile := filepath.Join(t.TempDir(), "child")
+	api := &fakeExecAPI{
+		// A command that started a child process, as pipelines do
+		cmd:    exec.Command("sh", "-c", fmt.Sprintf("sleep 60 & echo $! > %s; wait", childFile)),
+		exited: make(chan struct{}),
+	}
+	runtime := &dockerRuntime{cli: api}
+
+	var mu sync.Mutex
+	var stdout bytes.Buffer
+	output := writerFunc(func(p []byte) (int, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return stdout.Write(p)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	_, err := runtime.Exec(ctx, "db", ExecOptions{Cmd: []string{"sleep"}, Stdout: output, Stderr: output})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Exec() error = %v, want the context's", err)
+	}
+
+	// The command and the process it started were killed
+	select {
+	case <-api.exited:
+	default:
+		t.Error("The timed-out command is still running")
+	}
+	data, err := os.ReadFile(childFile)
+	if err != nil {
+		t.Fatalf("Failed to read the child's pid: %v", err)
+	}
+	child, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		t.Fatalf("Invalid child pid %q: %v", data, err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); !processGone(child); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("The process the timed-out command started is still running")
+		}
+	}
+
+	// Nothing is written to the output once Exec has returned
+	mu.Lock()
+	written := stdout.Len()
+	mu.Unlock()
+	if written == 0 {
+		t.Error("No output was copied before the timeout")
+	}
+	time.Sleep(20 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if stdout.Len() != written {
+		t.Errorf("%d bytes were written after Exec returned", stdout.Len()-written)
+	}
+}
+
+// writerFunc turns a function into an io.Writer
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
@@ -0,0 +1,183 @@
+package backup
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// historyFile is the run history in the state directory, one JSON entry per line
+const historyFile = "history.jsonl"
+
+// lastSuccessDir holds the time of each service's last successful backup, one
+// file per service, so the daemon can tell which scheduled runs it missed
+const lastSuccessDir = "last_success"
+
+// What started a job
+const (
+	TriggerManual = "manual"
+	TriggerCron   = "cron"
+	// TriggerCatchUp is a scheduled run the daemon missed and ran when it started
+	TriggerCatchUp = "catch-up"
+	// TriggerAPI is a backup requested through the daemon's API
+	TriggerAPI = "api"
+)
+
+// Outcomes of bringing back a job's containers
+const (
+	ContainersRestarted = "restarted"
+	ContainersRecreated = "recreated"
+	ContainersFailed    = "failed"
+)
+
+// HistoryEntry is a finished backup or restore
+type HistoryEntry struct {
+	Service   string    `json:"service"`
+	Operation string    `json:"operation"` // "backup" or "restore"
+	Trigger   string    `json:"trigger"`
+	Started   time.Time `json:"started"`
+	Finished  time.Time `json:"finished"`
+	// Duration is in seconds
+	Duration     float64             `json:"duration"`
+	Backup       string              `json:"backup,omitempty"`
+	Size         int64               `json:"size,omitempty"` // Encrypted archive size, for backups
+	Destinations []DestinationResult `json:"destinations,omitempty"`
+	// Containers is how bringing back the containers the job stopped went, if any were
+	Containers string `json:"containers,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// Succeeded reports whether the job ended without an error
+func (e HistoryEntry) Succeeded() bool {
+	return e.Error == ""
+}
+
+// DestinationResult is the outcome of uploading a backup to one destination
+type DestinationResult struct {
+	Name  string `json:"name"`
+	Error string `json:"error,omitempty"`
+}
+
+// recordHistory appends a finished job to the run history. A job that can't be
+// recorded has still run, so failures are only logged.
+func (m *Manager) recordHistory(job *hookJob) {
+	if m.stateDir == "" {
+		return
+	}
+	finished := time.Now().UTC()
+	entry := HistoryEntry{
+		Service:      job.Service,
+		Operation:    job.Operation,
+		Trigger:      job.Trigger,
+		Started:      job.Started,
+		Finished:     finished,
+		Duration:     finished.Sub(job.Started).Seconds(),
+		Backup:       job.BackupName,
+		Size:         job.Size,
+		Destinations: job.Uploads,
+		Containers:   job.Containers,
+	}
+	if job.Err != nil {
+		entry.Error = job.Err.Error()
+	}
+
+	data, err := json.Marshal(entry)
+	if err == nil {
+		err = m.appendHistory(append(data, '\n'))
+	}
+	if err != nil {
+		log.Printf("Warning: failed to record %s of %s in the run history: %v", job.Operation, job.Service, err)
+	}
+
+	if job.Operation == "backup" && job.Err == nil {
+		if err := m.recordSuccess(job.Service, finished); err != nil {
+			log.Printf("Warning: failed to record the last successful backup of %s: %v", job.Service, err)
+		}
+	}
+}
+
+// recordSuccess stores when a service was last backed up successfully
+func (m *Manager) recordSuccess(serviceName string, finished time.Time) error {
+	dir := filepath.Join(m.stateDir, lastSuccessDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, serviceName)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(finished.Format(time.RFC3339Nano)+"\n"), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// LastSuccess returns when a service was last backed up successfully, or the
+// zero time if it never has been
+func LastSuccess(stateDir, serviceName string) (time.Time, error) {
+	data, err := os.ReadFile(filepath.Join(stateDir, lastSuccessDir, serviceName))
+	if os.IsNotExist(err) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to read last successful backup of %s: %w", serviceName, err)
+	}
+	t, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(string(data)))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to parse last successful backup of %s: %w", serviceName, err)
+	}
+	return t, nil
+}
+
+// appendHistory writes a line to the history file. With O_APPEND each line is
+// written whole, even with several packrat processes recording jobs at once.
+func (m *Manager) appendHistory(line []byte) error {
+	f, err := os.OpenFile(filepath.Join(m.stateDir, historyFile), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(line); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// ReadHistory returns the jobs recorded in a state directory, oldest first,
+// optionally limited to a service and to jobs started at or after since
+func ReadHistory(stateDir, serviceName string, since time.Time) ([]HistoryEntry, error) {
+	f, err := os.Open(filepath.Join(stateDir, historyFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open run history: %w", err)
+	}
+	defer f.Close()
+
+	var entries []HistoryEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry HistoryEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// A line cut short by a crash shouldn't hide the rest of the history
+			debugLog("Skipping unreadable run history line: %v", err)
+			continue
+		}
+		if serviceName != "" && entry.Service != serviceName {
+			continue
+		}
+		if entry.Started.Before(since) {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read run history: %w", err)
+	}
+	return entries, nil
+}
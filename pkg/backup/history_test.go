@@ -0,0 +1,95 @@
+package backup
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/logandonley/packrat/pkg/config"
+)
+
+func TestRunHistory(t *testing.T) {
+	srcDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(srcDir, "data.txt"), []byte("data"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	runtime := newFakeRuntime(t)
+	runtime.containers["db"] = &fakeContainer{running: true}
+	manager := &Manager{
+		config: &config.Config{Services: map[string]config.Service{
+			"app":  {Path: srcDir, Docker: &config.Docker{Container: "db"}},
+			"docs": {Path: srcDir},
+		}},
+		key:        []byte("testkey0123456789012345678901234"),
+		backupRoot: t.TempDir(),
+		stateDir:   t.TempDir(),
+		Synology:   &mockStorage{files: make(map[string][]byte)},
+		runtime:    runtime,
+	}
+
+	if err := manager.CreateBackupWithOptions("app", BackupOptions{Trigger: TriggerCron}); err != nil {
+		t.Fatalf("CreateBackup failed: %v", err)
+	}
+	manager.S3 = &failingStorage{mockStorage{files: make(map[string][]byte)}}
+	if err := manager.CreateBackup("docs"); err == nil {
+		t.Fatal("Expected the S3 upload to fail the backup")
+	}
+
+	entries, err := ReadHistory(manager.stateDir, "", time.Time{})
+	if err != nil {
+		t.Fatalf("ReadHistory failed: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 history entries, got %+v", entries)
+	}
+
+	app := entries[0]
+	if app.Service != "app" || app.Operation != "backup" || app.Trigger != TriggerCron || !app.Succeeded() {
+		t.Errorf("Unexpected entry for app: %+v", app)
+	}
+	if app.Backup == "" || app.Size == 0 || app.Finished.Before(app.Started) {
+		t.Errorf("Entry for app is missing the backup details: %+v", app)
+	}
+	if app.Containers != ContainersRestarted {
+		t.Errorf("Containers = %q, want %q", app.Containers, ContainersRestarted)
+	}
+	if want := []DestinationResult{{Name: "synology"}}; !reflect.DeepEqual(app.Destinations, want) {
+		t.Errorf("Destinations = %+v, want %+v", app.Destinations, want)
+	}
+
+	docs := entries[1]
+	if docs.Trigger != TriggerManual || docs.Succeeded() || docs.Containers != "" {
+		t.Errorf("Unexpected entry for docs: %+v", docs)
+	}
+	want := []DestinationResult{{Name: "synology"}, {Name: "s3", Error: "storage unavailable"}}
+	if !reflect.DeepEqual(docs.Destinations, want) {
+		t.Errorf("Destinations = %+v, want %+v", docs.Destinations, want)
+	}
+
+	// Only successful backups count as the last one
+	if last, err := LastSuccess(manager.stateDir, "app"); err != nil || !last.Equal(app.Finished) {
+		t.Errorf("LastSuccess(app) = %v, %v, want %v", last, err, app.Finished)
+	}
+	if last, err := LastSuccess(manager.stateDir, "docs"); err != nil || !last.IsZero() {
+		t.Errorf("LastSuccess(docs) = %v, %v, want the zero time", last, err)
+	}
+
+	// A line cut short by a crash is skipped
+	f, err := os.OpenFile(filepath.Join(manager.stateDir, historyFile), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatalf("Failed to open history: %v", err)
+	}
+	f.WriteString(`{"service":"app","oper`)
+	f.Close()
+
+	entries, err = ReadHistory(manager.stateDir, "app", time.Time{})
+	if err != nil || len(entries) != 1 || entries[0].Service != "app" {
+		t.Errorf("ReadHistory(app) = %+v, %v", entries, err)
+	}
+	entries, err = ReadHistory(manager.stateDir, "", time.Now().Add(time.Hour))
+	if err != nil || len(entries) != 0 {
+		t.Errorf("ReadHistory(since) = %+v, %v", entries, err)
+	}
+}
@@ -0,0 +1,138 @@
+package backup
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/logandonley/packrat/pkg/config"
+	"github.com/logandonley/packrat/pkg/storage"
+)
+
+// hookJob describes the backup or restore a hook runs for. Hooks see it as
+// PACKRAT_* environment variables.
+type hookJob struct {
+	Operation    string // "backup" or "restore"
+	Service      string
+	ServicePath  string
+	RestorePath  string
+	BackupName   string
+	Size         int64 // Size of the encrypted backup, only set for backups
+	Destinations []string
+	Err          error
+
+	// For the run history
+	Trigger    string
+	Started    time.Time
+	Uploads    []DestinationResult // Every destination tried, including failed ones
+	Containers string              // Outcome of bringing back stopped containers
+}
+
+// newHookJob describes a job that is starting now
+func newHookJob(operation, serviceName, servicePath, trigger string) *hookJob {
+	if trigger == "" {
+		trigger = TriggerManual
+	}
+	return &hookJob{
+		Operation:   operation,
+		Service:     serviceName,
+		ServicePath: servicePath,
+		Trigger:     trigger,
+		Started:     time.Now().UTC(),
+	}
+}
+
+// upload uploads a backup to a destination, recording the result
+func (j *hookJob) upload(destination string, store storage.Storage, localPath, remoteName string) error {
+	result := DestinationResult{Name: destination}
+	err := store.Upload(localPath, remoteName)
+	if err != nil {
+		result.Error = err.Error()
+	} else {
+		j.Destinations = append(j.Destinations, destination)
+	}
+	j.Uploads = append(j.Uploads, result)
+	return err
+}
+
+// env returns the environment variables describing the job to the given hook
+func (j *hookJob) env(hook string) []string {
+	status := "success"
+	var errMsg string
+	if j.Err != nil {
+		status = "failure"
+		errMsg = j.Err.Error()
+	}
+
+	env := []string{
+		"PACKRAT_HOOK=" + hook,
+		"PACKRAT_OPERATION=" + j.Operation,
+		"PACKRAT_SERVICE=" + j.Service,
+		"PACKRAT_SERVICE_PATH=" + j.ServicePath,
+		"PACKRAT_BACKUP_NAME=" + j.BackupName,
+		"PACKRAT_BACKUP_SIZE=" + strconv.FormatInt(j.Size, 10),
+		"PACKRAT_DESTINATIONS=" + strings.Join(j.Destinations, ","),
+		"PACKRAT_STATUS=" + status,
+		"PACKRAT_ERROR=" + errMsg,
+	}
+	if j.RestorePath != "" {
+		env = append(env, "PACKRAT_RESTORE_PATH="+j.RestorePath)
+	}
+	return env
+}
+
+// runHook runs one of a service's hooks, if it is configured, on the host or
+// in a container as set by its exec_in option
+func (m *Manager) runHook(hook string, cmd *config.Command, service config.Service, job *hookJob) error {
+	if cmd == nil {
+		return nil
+	}
+
+	containerName, err := execContainer(cmd, service)
+	if err != nil {
+		return fmt.Errorf("%s hook failed: %w", hook, err)
+	}
+
+	if containerName == "" {
+		debugLog("Executing %s hook for service %s", hook, job.Service)
+		err = m.executeCommand(cmd, job.ServicePath, job.env(hook))
+	} else {
+		log.Printf("Executing %s hook for service %s in container %s", hook, job.Service, containerName)
+		stdout := newLogWriter(containerName + " " + hook)
+		stderr := newLogWriter(containerName + " " + hook + " stderr")
+		err = m.execInContainer(containerName, cmd, job.env(hook), stdout, stderr)
+		stdout.Flush()
+		stderr.Flush()
+	}
+	if err != nil {
+		return fmt.Errorf("%s hook failed: %w", hook, err)
+	}
+	return nil
+}
+
+// finishBackup runs the post_backup hook and then on_success or on_failure. It
+// runs however the backup ended, so a failed post_backup hook fails the backup,
+// while failing notification hooks are only logged.
+func (m *Manager) finishBackup(service config.Service, job *hookJob, errp *error) {
+	job.Err = *errp
+	if err := m.runHook("post_backup", service.PostBackup, service, job); err != nil {
+		if *errp == nil {
+			*errp = err
+		} else {
+			log.Printf("Warning: %v", err)
+		}
+		job.Err = *errp
+	}
+
+	if job.Err == nil {
+		if err := m.runHook("on_success", service.OnSuccess, service, job); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+		return
+	}
+	if err := m.runHook("on_failure", service.OnFailure, service, job); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+}
@@ -0,0 +1,157 @@
+package backup
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/logandonley/packrat/pkg/config"
+	"github.com/logandonley/packrat/pkg/storage"
+)
+
+func TestBackupHooks(t *testing.T) {
+	srcDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(srcDir, "data.txt"), []byte("data"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	logFile := filepath.Join(t.TempDir(), "hooks.log")
+	hook := func(name string) *config.Command {
+		return &config.Command{
+			Command: fmt.Sprintf(`echo "%s $PACKRAT_STATUS $PACKRAT_DESTINATIONS $PACKRAT_ERROR" >> %s`, name, logFile),
+		}
+	}
+	service := config.Service{
+		Path:       srcDir,
+		PreBackup:  hook("pre_backup"),
+		PostBackup: hook("post_backup"),
+		OnSuccess:  hook("on_success"),
+		OnFailure:  hook("on_failure"),
+	}
+
+	tests := []struct {
+		name    string
+		storage storage.Storage
+		wantErr bool
+		want    []string
+	}{
+		{
+			name:    "success",
+			storage: &mockStorage{files: make(map[string][]byte)},
+			want: []string{
+				"pre_backup success",
+				"post_backup success synology",
+				"on_success success synology",
+			},
+		},
+		{
+			name:    "upload failure",
+			storage: &failingStorage{mockStorage{files: make(map[string][]byte)}},
+			wantErr: true,
+			want: []string{
+				"pre_backup success",
+				"post_backup failure failed to upload to Synology: storage unavailable",
+				"on_failure failure failed to upload to Synology: storage unavailable",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Remove(logFile)
+			manager := &Manager{
+				config:     &config.Config{Services: map[string]config.Service{"test": service}},
+				key:        []byte("testkey0123456789012345678901234"),
+				backupRoot: t.TempDir(),
+				Synology:   tt.storage,
+			}
+
+			err := manager.CreateBackup("test")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CreateBackup() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			data, err := os.ReadFile(logFile)
+			if err != nil {
+				t.Fatalf("Failed to read hook log: %v", err)
+			}
+			var got []string
+			for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+				got = append(got, strings.Join(strings.Fields(line), " "))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Hooks ran as %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRestoreHooks(t *testing.T) {
+	srcDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(srcDir, "data.txt"), []byte("data"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	logFile := filepath.Join(t.TempDir(), "hooks.log")
+	hook := func(name, command string) *config.Command {
+		return &config.Command{Command: fmt.Sprintf(`echo "%s $PACKRAT_STATUS" >> %s; %s`, name, logFile, command)}
+	}
+
+	store := &mockStorage{files: make(map[string][]byte)}
+	manager := &Manager{
+		config:     &config.Config{Services: map[string]config.Service{"test": {Path: srcDir}}},
+		key:        []byte("testkey0123456789012345678901234"),
+		backupRoot: t.TempDir(),
+		Synology:   store,
+	}
+	if err := manager.CreateBackup("test"); err != nil {
+		t.Fatalf("Failed to create backup: %v", err)
+	}
+	files, _ := store.List("test-")
+	backupName := BackupFiles(files)[0].Name
+
+	tests := []struct {
+		name       string
+		preRestore string
+		wantErr    string
+		want       []string
+	}{
+		{
+			name: "success",
+			want: []string{"pre_restore success", "post_restore success"},
+		},
+		{
+			name:       "failing pre_restore",
+			preRestore: "exit 3",
+			wantErr:    "pre_restore hook failed: command failed: exit status 3",
+			want:       []string{"pre_restore success"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Remove(logFile)
+			manager.config.Services["test"] = config.Service{
+				Path:        srcDir,
+				PreRestore:  hook("pre_restore", tt.preRestore),
+				PostRestore: hook("post_restore", ""),
+			}
+
+			err := manager.RestoreBackup("test", backupName)
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("RestoreBackup() failed: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.HasPrefix(err.Error(), tt.wantErr)) {
+				t.Fatalf("RestoreBackup() error = %v, want %q", err, tt.wantErr)
+			}
+
+			data, err := os.ReadFile(logFile)
+			if err != nil {
+				t.Fatalf("Failed to read hook log: %v", err)
+			}
+			if got := strings.Split(strings.TrimSpace(string(data)), "\n"); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Hooks ran as %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
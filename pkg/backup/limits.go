@@ -0,0 +1,31 @@
+package backup
+
+import "sync"
+
+// stageLimit caps how many jobs are in a stage of a backup at once. A nil
+// stageLimit has no cap.
+type stageLimit chan struct{}
+
+// newStageLimit returns a limit of n jobs, or nil for n <= 0
+func newStageLimit(n int) stageLimit {
+	if n <= 0 {
+		return nil
+	}
+	return make(stageLimit, n)
+}
+
+// acquire waits for a free slot and returns the function that releases it,
+// which may be called more than once
+func (l stageLimit) acquire(stage, serviceName string) func() {
+	if l == nil {
+		return func() {}
+	}
+	select {
+	case l <- struct{}{}:
+	default:
+		debugLog("Backup of %s is waiting for a free %s slot", serviceName, stage)
+		l <- struct{}{}
+	}
+	var once sync.Once
+	return func() { once.Do(func() { <-l }) }
+}
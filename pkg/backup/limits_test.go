@@ -0,0 +1,34 @@
+package backup
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStageLimit(t *testing.T) {
+	// No limit never blocks
+	var unlimited stageLimit
+	unlimited.acquire("archive", "a")()
+
+	limit := newStageLimit(1)
+	release := limit.acquire("upload", "a")
+
+	acquired := make(chan func())
+	go func() { acquired <- limit.acquire("upload", "b") }()
+	select {
+	case <-acquired:
+		t.Fatal("Second job got a slot while the limit was reached")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// Releasing twice frees only one slot
+	release()
+	release()
+	releaseB := <-acquired
+	select {
+	case limit <- struct{}{}:
+		t.Fatal("Slot was freed twice")
+	default:
+	}
+	releaseB()
+}
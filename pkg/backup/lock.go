@@ -0,0 +1,91 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// locksDir is the state directory subdirectory holding the per-service job locks
+const locksDir = "locks"
+
+// JobRunningError is returned when a service already has a backup or restore
+// running, in this or another packrat process
+type JobRunningError struct {
+	Service   string `json:"service"`
+	Operation string `json:"operation,omitempty"` // Empty if the running job couldn't be identified
+	PID       int    `json:"pid,omitempty"`
+}
+
+func (e *JobRunningError) Error() string {
+	if e.Operation == "" || e.PID == 0 {
+		return fmt.Sprintf("a job for service %s is already running", e.Service)
+	}
+	return fmt.Sprintf("a %s of service %s is already running (pid %d)", e.Operation, e.Service, e.PID)
+}
+
+// IsJobRunning reports whether err means a service already had a job running
+func IsJobRunning(err error) bool {
+	var running *JobRunningError
+	return errors.As(err, &running)
+}
+
+// lockService takes a service's job lock, so only one job stops its containers
+// and writes its data at a time. The lock is a flock on a file in the state
+// directory, which the kernel releases if the process dies. It also excludes
+// other jobs in the same process, since each job opens the file separately.
+func (m *Manager) lockService(serviceName, operation string) (func(), error) {
+	if m.stateDir == "" {
+		return func() {}, nil
+	}
+	dir := filepath.Join(m.stateDir, locksDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create lock directory: %w", err)
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, serviceName+".lock"), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		defer f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, lockHolder(f, serviceName)
+		}
+		return nil, fmt.Errorf("failed to lock service %s: %w", serviceName, err)
+	}
+
+	// Record who holds the lock for the error other jobs get
+	if err := f.Truncate(0); err == nil {
+		fmt.Fprintf(f, "%s %d\n", operation, os.Getpid())
+	}
+
+	return func() {
+		if err := syscall.Flock(int(f.Fd()), syscall.LOCK_UN); err != nil {
+			log.Printf("Warning: failed to unlock service %s: %v", serviceName, err)
+		}
+		f.Close()
+	}, nil
+}
+
+// lockHolder describes the job holding a lock file
+func lockHolder(f *os.File, serviceName string) *JobRunningError {
+	holder := &JobRunningError{Service: serviceName}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return holder
+	}
+	operation, pid, ok := strings.Cut(strings.TrimSpace(string(data)), " ")
+	if !ok {
+		return holder
+	}
+	holder.Operation = operation
+	holder.PID, _ = strconv.Atoi(pid)
+	return holder
+}
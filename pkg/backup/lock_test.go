@@ -0,0 +1,58 @@
+package backup
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/logandonley/packrat/pkg/config"
+)
+
+func TestServiceLock(t *testing.T) {
+	srcDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(srcDir, "data.txt"), []byte("data"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	store := &mockStorage{files: make(map[string][]byte)}
+	manager := &Manager{
+		config:     &config.Config{Services: map[string]config.Service{"test": {Path: srcDir}}},
+		key:        []byte("testkey0123456789012345678901234"),
+		backupRoot: t.TempDir(),
+		stateDir:   t.TempDir(),
+		Synology:   store,
+	}
+
+	unlock, err := manager.lockService("test", "restore")
+	if err != nil {
+		t.Fatalf("lockService failed: %v", err)
+	}
+
+	// Jobs of the same service are refused, naming the running job
+	_, err = manager.lockService("test", "backup")
+	var running *JobRunningError
+	if !errors.As(err, &running) {
+		t.Fatalf("Expected a JobRunningError, got %v", err)
+	}
+	if running.Operation != "restore" || running.PID != os.Getpid() {
+		t.Errorf("JobRunningError = %+v, want the restore in this process", running)
+	}
+	if err := manager.CreateBackup("test"); !IsJobRunning(err) {
+		t.Errorf("Expected CreateBackup to fail while locked, got %v", err)
+	}
+	if len(store.files) != 0 {
+		t.Error("Backup was uploaded while the service was locked")
+	}
+
+	// Other services aren't affected
+	unlockOther, err := manager.lockService("other", "backup")
+	if err != nil {
+		t.Fatalf("lockService for another service failed: %v", err)
+	}
+	unlockOther()
+
+	unlock()
+	if err := manager.CreateBackup("test"); err != nil {
+		t.Errorf("CreateBackup failed after unlocking: %v", err)
+	}
+}
@@ -0,0 +1,129 @@
+package backup
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/logandonley/packrat/pkg/crypto"
+	"github.com/logandonley/packrat/pkg/storage"
+)
+
+// backupSuffix is the extension of encrypted backup archives
+const backupSuffix = ".enc"
+
+// manifestSuffix replaces backupSuffix in the name of a backup's manifest sidecar
+const manifestSuffix = ".manifest"
+
+// Manifest lists the contents of a backup. It is encrypted and stored next to
+// the backup so its contents can be inspected without downloading the archive.
+// Backups made before manifests were introduced don't have one.
+type Manifest struct {
+	Service string         `json:"service"`
+	Backup  string         `json:"backup"`
+	Created time.Time      `json:"created"`
+	Entries []ArchiveEntry `json:"entries"`
+}
+
+// ManifestName returns the name of the manifest sidecar for a backup
+func ManifestName(backupName string) string {
+	return strings.TrimSuffix(backupName, backupSuffix) + manifestSuffix
+}
+
+// IsBackupFile reports whether a stored file is a backup archive rather than a sidecar
+func IsBackupFile(name string) bool {
+	return strings.HasSuffix(name, backupSuffix)
+}
+
+// BackupFiles filters a storage listing down to the backup archives
+func BackupFiles(files []storage.BackupFile) []storage.BackupFile {
+	backups := make([]storage.BackupFile, 0, len(files))
+	for _, f := range files {
+		if IsBackupFile(f.Name) {
+			backups = append(backups, f)
+		}
+	}
+	return backups
+}
+
+// uploadManifest encrypts a manifest and uploads it next to its backup
+func (m *Manager) uploadManifest(tmpDir string, manifest *Manifest) error {
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %w", err)
+	}
+
+	encrypted, err := crypto.Encrypt(m.key, data)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt manifest: %w", err)
+	}
+
+	name := ManifestName(manifest.Backup)
+	localPath := filepath.Join(tmpDir, name)
+	if err := os.WriteFile(localPath, encrypted, 0600); err != nil {
+		return fmt.Errorf("failed to save manifest locally: %w", err)
+	}
+
+	if err := m.Synology.Upload(localPath, name); err != nil {
+		return fmt.Errorf("failed to upload manifest to Synology: %w", err)
+	}
+	if m.S3 != nil {
+		if err := m.S3.Upload(localPath, name); err != nil {
+			return fmt.Errorf("failed to upload manifest to S3: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// GetManifest downloads and decrypts the manifest of a backup. It returns nil
+// without an error if the backup has no manifest.
+func (m *Manager) GetManifest(serviceName, backupName, source string) (*Manifest, error) {
+	encrypted, err := m.downloadFile(serviceName, ManifestName(backupName), source)
+	if errors.Is(err, os.ErrNotExist) {
+		debugLog("No manifest for backup %s: %v", backupName, err)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := crypto.Decrypt(m.key, encrypted)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt manifest: %w", err)
+	}
+
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest: %w", err)
+	}
+	return &manifest, nil
+}
+
+// splitManifests separates a storage listing into the backups and the set of manifest names
+func splitManifests(files []storage.BackupFile) ([]storage.BackupFile, map[string]bool) {
+	manifests := make(map[string]bool)
+	for _, f := range files {
+		if strings.HasSuffix(f.Name, manifestSuffix) {
+			manifests[f.Name] = true
+		}
+	}
+	return BackupFiles(files), manifests
+}
+
+// deleteManifest removes the manifest of a deleted backup if it has one. A
+// leftover manifest is harmless, so failures are only logged.
+func (m *Manager) deleteManifest(store storage.Storage, manifests map[string]bool, backupName string) {
+	name := ManifestName(backupName)
+	if !manifests[name] {
+		return
+	}
+	if err := store.Delete(name); err != nil {
+		log.Printf("Warning: failed to delete manifest %s: %v", name, err)
+	}
+}
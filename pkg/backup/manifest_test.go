@@ -0,0 +1,160 @@
+package backup
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/logandonley/packrat/pkg/config"
+	"github.com/logandonley/packrat/pkg/storage"
+)
+
+func TestManifestListAndCat(t *testing.T) {
+	srcDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(srcDir, "data"), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	content := []byte("[server]\nDOMAIN = git.example.com\n")
+	if err := os.WriteFile(filepath.Join(srcDir, "data", "app.ini"), content, 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if err := os.Link(filepath.Join(srcDir, "data", "app.ini"), filepath.Join(srcDir, "app.ini")); err != nil {
+		t.Fatalf("Failed to create hard link: %v", err)
+	}
+
+	store := &mockStorage{files: make(map[string][]byte)}
+	manager := &Manager{
+		config: &config.Config{
+			Services: map[string]config.Service{"test": {Path: srcDir}},
+		},
+		key:        []byte("testkey0123456789012345678901234"),
+		backupRoot: t.TempDir(),
+		Synology:   store,
+	}
+
+	if err := manager.CreateBackup("test"); err != nil {
+		t.Fatalf("Failed to create backup: %v", err)
+	}
+	files, _ := store.List("test-")
+	backups := BackupFiles(files)
+	if len(backups) != 1 {
+		t.Fatalf("Expected 1 backup, got %d", len(backups))
+	}
+	backupName := backups[0].Name
+
+	manifest, err := manager.GetManifest("test", backupName, "")
+	if err != nil || manifest == nil {
+		t.Fatalf("Failed to get manifest: %v", err)
+	}
+	sum := sha256.Sum256(content)
+	var found bool
+	for _, e := range manifest.Entries {
+		if e.Name == filepath.Join("data", "app.ini") {
+			found = true
+			if e.SHA256 != hex.EncodeToString(sum[:]) {
+				t.Errorf("Manifest hash = %s, want %x", e.SHA256, sum)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("Manifest is missing data/app.ini: %+v", manifest.Entries)
+	}
+
+	// Listing uses the manifest, so it still works with the archive gone
+	archive := store.files[backupName]
+	delete(store.files, backupName)
+	entries, err := manager.ListBackupEntries("test", backupName, "")
+	if err != nil {
+		t.Fatalf("Failed to list entries from manifest: %v", err)
+	}
+	if len(entries) != len(manifest.Entries) {
+		t.Errorf("Listed %d entries, want %d", len(entries), len(manifest.Entries))
+	}
+	store.files[backupName] = archive
+
+	// Without a manifest the archive itself is listed
+	manifestData := store.files[ManifestName(backupName)]
+	delete(store.files, ManifestName(backupName))
+	if manifest, err := manager.GetManifest("test", backupName, ""); manifest != nil || err != nil {
+		t.Errorf("GetManifest without a manifest = %v, %v; want nil, nil", manifest, err)
+	}
+	entries, err = manager.ListBackupEntries("test", backupName, "")
+	if err != nil {
+		t.Fatalf("Failed to list entries from archive: %v", err)
+	}
+	if len(entries) != len(manifest.Entries) {
+		t.Errorf("Listed %d entries, want %d", len(entries), len(manifest.Entries))
+	}
+
+	for _, name := range []string{"data/app.ini", "app.ini"} {
+		var out bytes.Buffer
+		if err := manager.CatBackupFile("test", backupName, name, "", &out); err != nil {
+			t.Fatalf("CatBackupFile(%s) failed: %v", name, err)
+		}
+		if !bytes.Equal(out.Bytes(), content) {
+			t.Errorf("CatBackupFile(%s) = %q, want %q", name, out.Bytes(), content)
+		}
+	}
+
+	if err := manager.CatBackupFile("test", backupName, "data", "", io.Discard); err == nil {
+		t.Error("Expected an error for a directory")
+	}
+	if err := manager.CatBackupFile("test", backupName, "missing.txt", "", io.Discard); err == nil {
+		t.Error("Expected an error for a missing file")
+	}
+
+	// Failing to download a manifest is an error, not a missing manifest
+	store.files[ManifestName(backupName)] = manifestData
+	manager.Synology = &unreachableStorage{*store}
+	if _, err := manager.GetManifest("test", backupName, ""); err == nil {
+		t.Error("Expected an error when the manifest can't be downloaded")
+	}
+}
+
+// unreachableStorage fails every download
+type unreachableStorage struct {
+	mockStorage
+}
+
+func (u *unreachableStorage) Download(remoteName, localPath string) error {
+	return fmt.Errorf("connection reset")
+}
+
+func TestCleanupBackupsRemovesManifests(t *testing.T) {
+	retain := 1
+	store := &MockStorage{
+		files: map[string]storage.BackupFile{
+			"test-2024-01-01T00-00-00Z.enc":      {Name: "test-2024-01-01T00-00-00Z.enc", ModTime: "2024-01-01 00:00:00 UTC"},
+			"test-2024-01-01T00-00-00Z.manifest": {Name: "test-2024-01-01T00-00-00Z.manifest", ModTime: "2024-01-01 00:00:01 UTC"},
+			"test-2024-01-02T00-00-00Z.enc":      {Name: "test-2024-01-02T00-00-00Z.enc", ModTime: "2024-01-02 00:00:00 UTC"},
+			"test-2024-01-02T00-00-00Z.manifest": {Name: "test-2024-01-02T00-00-00Z.manifest", ModTime: "2024-01-02 00:00:01 UTC"},
+		},
+	}
+	manager := &Manager{
+		config: &config.Config{
+			Services: map[string]config.Service{"test": {RetainBackups: &retain}},
+		},
+		Synology: store,
+	}
+
+	counts, err := manager.CleanupBackups("test")
+	if err != nil {
+		t.Fatalf("CleanupBackups failed: %v", err)
+	}
+	if counts["test_synology"] != 1 {
+		t.Errorf("Deleted %d backups, want 1", counts["test_synology"])
+	}
+
+	sort.Strings(store.deleted)
+	want := []string{"test-2024-01-01T00-00-00Z.enc", "test-2024-01-01T00-00-00Z.manifest"}
+	if !reflect.DeepEqual(store.deleted, want) {
+		t.Errorf("Deleted %v, want %v", store.deleted, want)
+	}
+}
@@ -0,0 +1,262 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// paxXattrPrefix is the PAX record prefix used by GNU tar and star for extended attributes.
+// POSIX ACLs (system.posix_acl_*) and SELinux labels (security.selinux) are stored as xattrs.
+const paxXattrPrefix = "SCHILY.xattr."
+
+// recordMetadata adds the metadata tar.FileInfoHeader doesn't capture to a header.
+// Ownership (uid/gid and names) and mtime are already populated from the stat info;
+// this switches to PAX so mtimes keep sub-second precision and records xattrs.
+func recordMetadata(header *tar.Header, path string) error {
+	header.Format = tar.FormatPAX
+	// Access and change times aren't restored, so don't bloat the archive with them
+	header.AccessTime = time.Time{}
+	header.ChangeTime = time.Time{}
+
+	xattrs, err := readXattrs(path)
+	if err != nil {
+		return fmt.Errorf("failed to read extended attributes of %s: %w", path, err)
+	}
+	if len(xattrs) > 0 && header.PAXRecords == nil {
+		header.PAXRecords = make(map[string]string, len(xattrs))
+	}
+	for name, value := range xattrs {
+		header.PAXRecords[paxXattrPrefix+name] = value
+	}
+
+	return nil
+}
+
+// readXattrs returns all extended attributes of path without following symlinks
+func readXattrs(path string) (map[string]string, error) {
+	size, err := unix.Llistxattr(path, nil)
+	if err != nil {
+		if isUnsupportedXattr(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if size == 0 {
+		return nil, nil
+	}
+
+	buf := make([]byte, size)
+	size, err = unix.Llistxattr(path, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	xattrs := make(map[string]string)
+	for _, name := range bytes.Split(buf[:size], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		value, err := getXattr(path, string(name))
+		if err != nil {
+			// Attributes can disappear between list and get, and some namespaces
+			// are listable but not readable without extra privileges
+			debugLog("Skipping xattr %s on %s: %v", name, path, err)
+			continue
+		}
+		xattrs[string(name)] = string(value)
+	}
+
+	return xattrs, nil
+}
+
+// getXattr reads a single extended attribute without following symlinks
+func getXattr(path, name string) ([]byte, error) {
+	size, err := unix.Lgetxattr(path, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	value := make([]byte, size)
+	if size == 0 {
+		return value, nil
+	}
+	size, err = unix.Lgetxattr(path, name, value)
+	if err != nil {
+		return nil, err
+	}
+	return value[:size], nil
+}
+
+// isUnsupportedXattr reports whether err means the filesystem has no xattr support
+func isUnsupportedXattr(err error) bool {
+	return errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EOPNOTSUPP)
+}
+
+// metadataRestorer reapplies ownership, permissions, xattrs and timestamps recorded in tar headers
+type metadataRestorer struct {
+	opts RestoreOptions
+
+	users  map[string]int
+	groups map[string]int
+
+	// Directories get their mode and times applied last, since creating
+	// their children would otherwise reset the mtime or fail on read-only dirs
+	dirs []dirMetadata
+
+	ownershipWarned bool
+	xattrWarned     bool
+}
+
+type dirMetadata struct {
+	path   string
+	header *tar.Header
+}
+
+func newMetadataRestorer(opts RestoreOptions) *metadataRestorer {
+	return &metadataRestorer{
+		opts:   opts,
+		users:  make(map[string]int),
+		groups: make(map[string]int),
+	}
+}
+
+// apply restores the metadata of an extracted entry. Directory modes and times are deferred until finish.
+func (r *metadataRestorer) apply(target string, header *tar.Header) error {
+	if err := r.chown(target, header); err != nil {
+		return err
+	}
+	if err := r.setXattrs(target, header); err != nil {
+		return err
+	}
+
+	if header.Typeflag == tar.TypeDir {
+		r.dirs = append(r.dirs, dirMetadata{path: target, header: header})
+		return nil
+	}
+
+	// Symlink permissions are meaningless and chmod would follow the link.
+	// chmod also runs after chown because chown clears setuid/setgid bits.
+	if header.Typeflag != tar.TypeSymlink {
+		if err := os.Chmod(target, header.FileInfo().Mode()); err != nil {
+			return fmt.Errorf("failed to set permissions on %s: %w", target, err)
+		}
+	}
+
+	return setTimes(target, header.ModTime)
+}
+
+// finish applies the deferred directory metadata, deepest directories first
+func (r *metadataRestorer) finish() error {
+	for i := len(r.dirs) - 1; i >= 0; i-- {
+		dir := r.dirs[i]
+		if err := os.Chmod(dir.path, dir.header.FileInfo().Mode()); err != nil {
+			return fmt.Errorf("failed to set permissions on %s: %w", dir.path, err)
+		}
+		if err := setTimes(dir.path, dir.header.ModTime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *metadataRestorer) chown(target string, header *tar.Header) error {
+	if r.opts.SkipOwnership {
+		return nil
+	}
+
+	uid := r.lookupID(r.users, header.Uname, header.Uid, func(name string) (string, error) {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return "", err
+		}
+		return u.Uid, nil
+	})
+	gid := r.lookupID(r.groups, header.Gname, header.Gid, func(name string) (string, error) {
+		g, err := user.LookupGroup(name)
+		if err != nil {
+			return "", err
+		}
+		return g.Gid, nil
+	})
+
+	if err := os.Lchown(target, uid, gid); err != nil {
+		// Unprivileged users can only give files to themselves; keep restoring
+		// the data rather than failing halfway through
+		if errors.Is(err, os.ErrPermission) && os.Geteuid() != 0 {
+			if !r.ownershipWarned {
+				log.Printf("Warning: not permitted to restore file ownership as a non-root user, files will be owned by the current user (use --no-owner to silence this)")
+				r.ownershipWarned = true
+			}
+			return nil
+		}
+		return fmt.Errorf("failed to set ownership on %s: %w", target, err)
+	}
+	return nil
+}
+
+// lookupID resolves a user or group name to a local ID, falling back to the
+// numeric ID from the archive when the name is unknown on this host
+func (r *metadataRestorer) lookupID(cache map[string]int, name string, id int, lookup func(string) (string, error)) int {
+	if r.opts.NumericOwner || name == "" {
+		return id
+	}
+	if cached, ok := cache[name]; ok {
+		return cached
+	}
+
+	resolved := id
+	if s, err := lookup(name); err == nil {
+		if n, err := strconv.Atoi(s); err == nil {
+			resolved = n
+		}
+	}
+	cache[name] = resolved
+	return resolved
+}
+
+func (r *metadataRestorer) setXattrs(target string, header *tar.Header) error {
+	if r.opts.SkipXattrs {
+		return nil
+	}
+
+	for key, value := range header.PAXRecords {
+		name, ok := strings.CutPrefix(key, paxXattrPrefix)
+		if !ok {
+			continue
+		}
+		if err := unix.Lsetxattr(target, name, []byte(value), 0); err != nil {
+			// The target filesystem may not support xattrs, and security/trusted
+			// namespaces need privileges the restoring user might not have
+			if isUnsupportedXattr(err) || errors.Is(err, os.ErrPermission) {
+				if !r.xattrWarned {
+					log.Printf("Warning: could not restore extended attribute %s on %s: %v (use --no-xattrs to skip)", name, target, err)
+					r.xattrWarned = true
+				}
+				continue
+			}
+			return fmt.Errorf("failed to set extended attribute %s on %s: %w", name, target, err)
+		}
+	}
+	return nil
+}
+
+// setTimes sets the access and modification time of path without following symlinks
+func setTimes(path string, modTime time.Time) error {
+	if modTime.IsZero() {
+		return nil
+	}
+	ts := unix.NsecToTimespec(modTime.UnixNano())
+	if err := unix.UtimesNanoAt(unix.AT_FDCWD, path, []unix.Timespec{ts, ts}, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return fmt.Errorf("failed to set modification time on %s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package backup
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/logandonley/packrat/pkg/config"
+	"golang.org/x/sys/unix"
+)
+
+func TestArchiveMetadataRoundTrip(t *testing.T) {
+	srcDir := t.TempDir()
+	destDir := t.TempDir()
+
+	filePath := filepath.Join(srcDir, "data", "file.txt")
+	if err := os.MkdirAll(filepath.Dir(filePath), 0750); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := os.WriteFile(filePath, []byte("content"), 0640); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+
+	mtime := time.Date(2023, 5, 17, 10, 30, 0, 123456789, time.UTC)
+	for _, p := range []string{filePath, filepath.Dir(filePath)} {
+		if err := os.Chtimes(p, mtime, mtime); err != nil {
+			t.Fatalf("Failed to set times: %v", err)
+		}
+	}
+
+	hasXattrs := unix.Lsetxattr(filePath, "user.packrat.test", []byte("value"), 0) == nil
+	if !hasXattrs {
+		t.Log("Filesystem doesn't support user xattrs, skipping xattr checks")
+	}
+
+	isRoot := os.Geteuid() == 0
+	if isRoot {
+		if err := os.Chown(filePath, 999, 999); err != nil {
+			t.Fatalf("Failed to chown file: %v", err)
+		}
+	}
+
+	manager := &Manager{config: &config.Config{}}
+
+	var archive bytes.Buffer
+	if _, err := manager.createArchive(archiveSources{path: srcDir}, &archive); err != nil {
+		t.Fatalf("Failed to create archive: %v", err)
+	}
+	if err := ExtractArchive(&archive, destDir, RestoreOptions{NumericOwner: true}); err != nil {
+		t.Fatalf("Failed to extract archive: %v", err)
+	}
+
+	restored := filepath.Join(destDir, "data", "file.txt")
+	for _, p := range []string{restored, filepath.Dir(restored)} {
+		info, err := os.Stat(p)
+		if err != nil {
+			t.Fatalf("Failed to stat %s: %v", p, err)
+		}
+		if !info.ModTime().Equal(mtime) {
+			t.Errorf("%s mtime = %v, want %v", p, info.ModTime(), mtime)
+		}
+	}
+
+	info, err := os.Stat(restored)
+	if err != nil {
+		t.Fatalf("Failed to stat restored file: %v", err)
+	}
+	if info.Mode().Perm() != 0640 {
+		t.Errorf("Restored file mode = %v, want %v", info.Mode().Perm(), os.FileMode(0640))
+	}
+
+	if isRoot {
+		stat := info.Sys().(*syscall.Stat_t)
+		if stat.Uid != 999 || stat.Gid != 999 {
+			t.Errorf("Restored owner = %d:%d, want 999:999", stat.Uid, stat.Gid)
+		}
+	}
+
+	if hasXattrs {
+		value, err := getXattr(restored, "user.packrat.test")
+		if err != nil {
+			t.Fatalf("Failed to read restored xattr: %v", err)
+		}
+		if string(value) != "value" {
+			t.Errorf("Restored xattr = %q, want %q", value, "value")
+		}
+	}
+}
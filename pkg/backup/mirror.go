@@ -0,0 +1,136 @@
+package backup
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// readArchiveEntries returns the cleaned names of all entries in a compressed
+// archive, mapped to whether the entry is a directory
+func readArchiveEntries(input io.Reader) (map[string]bool, error) {
+	list, err := listArchive(input)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make(map[string]bool, len(list))
+	for _, e := range list {
+		entries[e.Name] = e.IsDir()
+	}
+	return entries, nil
+}
+
+// pruneStale prunes the restore path, if there is one, and every volume restored in place
+func pruneStale(destPath string, entries map[string]bool, excludePatterns []string, volumePaths map[string]string, dryRun bool) ([]string, error) {
+	var stale []string
+	if destPath != "" {
+		removed, err := pruneStaleFiles(destPath, entries, excludePatterns, dryRun)
+		if err != nil {
+			return nil, err
+		}
+		stale = removed
+	}
+
+	removed, err := pruneStaleVolumes(volumePaths, entries, excludePatterns, dryRun)
+	if err != nil {
+		return nil, err
+	}
+	return append(stale, removed...), nil
+}
+
+// pruneStaleFiles removes everything under destPath that is not present in the
+// archive entries. Excluded paths are left alone since they were never archived,
+// and stale directories that still hold excluded files are kept. A path whose
+// type differs from the archive (file vs directory) is also removed so it can be
+// recreated during extraction. When dryRun is set nothing is deleted. The
+// returned paths are relative to destPath and sorted.
+func pruneStaleFiles(destPath string, entries map[string]bool, excludePatterns []string, dryRun bool) ([]string, error) {
+	var stale []string
+
+	err := filepath.Walk(destPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// Nothing to prune if the service directory doesn't exist yet
+			if os.IsNotExist(err) && path == destPath {
+				return filepath.SkipAll
+			}
+			return err
+		}
+
+		relPath, err := filepath.Rel(destPath, path)
+		if err != nil {
+			return fmt.Errorf("failed to get relative path: %w", err)
+		}
+		if relPath == "." {
+			return nil
+		}
+
+		if isExcluded(relPath, excludePatterns) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		isDir, ok := entries[relPath]
+		if ok && isDir == info.IsDir() {
+			return nil
+		}
+
+		// A stale directory holding excluded files is kept; its other
+		// contents are pruned individually as the walk descends into it
+		if info.IsDir() {
+			keep, err := containsExcluded(destPath, path, excludePatterns)
+			if err != nil {
+				return err
+			}
+			if keep {
+				return nil
+			}
+		}
+
+		stale = append(stale, relPath)
+		if !dryRun {
+			debugLog("Removing stale path: %s", path)
+			if err := os.RemoveAll(path); err != nil {
+				return fmt.Errorf("failed to remove %s: %w", path, err)
+			}
+		}
+		if info.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(stale)
+	return stale, nil
+}
+
+// containsExcluded reports whether any path below dir matches the exclude patterns
+func containsExcluded(destPath, dir string, excludePatterns []string) (bool, error) {
+	if len(excludePatterns) == 0 {
+		return false, nil
+	}
+
+	found := false
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(destPath, path)
+		if err != nil {
+			return fmt.Errorf("failed to get relative path: %w", err)
+		}
+		if isExcluded(relPath, excludePatterns) {
+			found = true
+			return filepath.SkipAll
+		}
+		return nil
+	})
+	return found, err
+}
@@ -0,0 +1,94 @@
+package backup
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/logandonley/packrat/pkg/config"
+	"github.com/logandonley/packrat/pkg/crypto"
+)
+
+func TestRestoreBackupMirror(t *testing.T) {
+	srcDir := t.TempDir()
+	destDir := t.TempDir()
+
+	// Backed-up state
+	for _, f := range []string{"keep.txt", "data/app.db"} {
+		path := filepath.Join(srcDir, f)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte("backed up"), 0644); err != nil {
+			t.Fatalf("Failed to create file: %v", err)
+		}
+	}
+
+	// Live state that drifted since the backup
+	for _, f := range []string{"keep.txt", "stale.txt", "data/app.db", "data/new.db", "newdir/file.txt", "cache/session.tmp", "mixed/x.tmp", "mixed/y.txt"} {
+		path := filepath.Join(destDir, f)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte("live"), 0644); err != nil {
+			t.Fatalf("Failed to create file: %v", err)
+		}
+	}
+
+	key := []byte("testkey0123456789012345678901234")
+	exclude := []string{"**/*.tmp"}
+	manager := &Manager{
+		config: &config.Config{
+			Services: map[string]config.Service{
+				"test": {Path: srcDir, Exclude: exclude},
+			},
+		},
+		key:        key,
+		backupRoot: t.TempDir(),
+	}
+
+	var archive bytes.Buffer
+	if _, err := manager.createArchive(archiveSources{path: srcDir, exclude: exclude}, &archive); err != nil {
+		t.Fatalf("Failed to create archive: %v", err)
+	}
+	encrypted, err := crypto.Encrypt(key, archive.Bytes())
+	if err != nil {
+		t.Fatalf("Failed to encrypt archive: %v", err)
+	}
+	manager.Synology = &mockStorage{files: map[string][]byte{"test-backup.enc": encrypted}}
+	manager.config.Services["test"] = config.Service{Path: destDir, Exclude: exclude}
+
+	wantStale := []string{"data/new.db", "mixed/y.txt", "newdir", "stale.txt"}
+
+	preview, err := manager.PreviewMirrorRestore("test", "test-backup.enc", RestoreOptions{})
+	if err != nil {
+		t.Fatalf("PreviewMirrorRestore failed: %v", err)
+	}
+	if !reflect.DeepEqual(preview, wantStale) {
+		t.Errorf("PreviewMirrorRestore() = %v, want %v", preview, wantStale)
+	}
+	if _, err := os.Stat(filepath.Join(destDir, "stale.txt")); err != nil {
+		t.Errorf("Dry run should not delete files: %v", err)
+	}
+
+	if err := manager.RestoreBackupWithOptions("test", "test-backup.enc", RestoreOptions{Mirror: true}); err != nil {
+		t.Fatalf("RestoreBackupWithOptions failed: %v", err)
+	}
+
+	for _, f := range wantStale {
+		if _, err := os.Stat(filepath.Join(destDir, f)); !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be removed, got err = %v", f, err)
+		}
+	}
+	for _, f := range []string{"keep.txt", "data/app.db", "cache/session.tmp", "mixed/x.tmp"} {
+		if _, err := os.Stat(filepath.Join(destDir, f)); err != nil {
+			t.Errorf("Expected %s to be kept: %v", f, err)
+		}
+	}
+	restored, err := os.ReadFile(filepath.Join(destDir, "keep.txt"))
+	if err != nil || string(restored) != "backed up" {
+		t.Errorf("Expected keep.txt to be restored from backup, got %q (err = %v)", restored, err)
+	}
+}
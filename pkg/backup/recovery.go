@@ -0,0 +1,188 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/client"
+)
+
+// recoveryRecord lists the containers a job has stopped or paused, or the
+// definitions of those a restore removes to recreate. It stays in the state
+// directory while they are down, so if packrat dies mid-job the next daemon
+// start can bring them back.
+type recoveryRecord struct {
+	Service     string              `json:"service"`
+	PID         int                 `json:"pid"`
+	Started     time.Time           `json:"started"`
+	Containers  []quiescedContainer `json:"containers"`
+	Definitions []containerSpec     `json:"definitions,omitempty"` // In stop order
+}
+
+func (m *Manager) recoveryDir() string {
+	return filepath.Join(m.stateDir, "recovery")
+}
+
+func (m *Manager) recoveryPath(serviceName string) string {
+	return filepath.Join(m.recoveryDir(), serviceName+".json")
+}
+
+// saveRecoveryRecord writes a recovery record, replacing it atomically so a
+// crash never leaves a partial one behind
+func (m *Manager) saveRecoveryRecord(record *recoveryRecord) error {
+	if m.stateDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(m.recoveryDir(), 0700); err != nil {
+		return fmt.Errorf("failed to create recovery directory: %w", err)
+	}
+
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode recovery record: %w", err)
+	}
+
+	path := m.recoveryPath(record.Service)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write recovery record: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write recovery record: %w", err)
+	}
+	return nil
+}
+
+// removeRecoveryRecord removes a service's recovery record once its containers are back
+func (m *Manager) removeRecoveryRecord(serviceName string) {
+	if m.stateDir == "" {
+		return
+	}
+	if err := os.Remove(m.recoveryPath(serviceName)); err != nil && !os.IsNotExist(err) {
+		log.Printf("Warning: failed to remove recovery record for %s: %v", serviceName, err)
+	}
+}
+
+// loadRecoveryRecords reads all recovery records in the state directory
+func (m *Manager) loadRecoveryRecords() ([]*recoveryRecord, error) {
+	if m.stateDir == "" {
+		return nil, nil
+	}
+	files, err := os.ReadDir(m.recoveryDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read recovery directory: %w", err)
+	}
+
+	var records []*recoveryRecord
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(m.recoveryDir(), file.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read recovery record: %w", err)
+		}
+		record := &recoveryRecord{}
+		if err := json.Unmarshal(data, record); err != nil {
+			log.Printf("Warning: ignoring invalid recovery record %s: %v", file.Name(), err)
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// RecoverContainers brings back containers left stopped or paused by a packrat
+// process that died mid-job. A record is only acted on once its service's job
+// lock can be taken: while the job holding it is still running, that job will
+// resume its own containers.
+func (m *Manager) RecoverContainers() error {
+	records, err := m.loadRecoveryRecords()
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, record := range records {
+		if err := m.recoverContainers(record); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// recoverContainers resumes the containers in one recovery record
+func (m *Manager) recoverContainers(record *recoveryRecord) error {
+	unlock, err := m.lockService(record.Service, "recovery")
+	if IsJobRunning(err) {
+		debugLog("Skipping recovery for %s: %v", record.Service, err)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("cannot recover containers for %s: %w", record.Service, err)
+	}
+	defer unlock()
+
+	if len(record.Containers) == 0 && len(record.Definitions) == 0 {
+		m.removeRecoveryRecord(record.Service)
+		return nil
+	}
+	runtime, err := m.containerRuntime()
+	if err != nil {
+		return fmt.Errorf("cannot recover containers for %s: %w", record.Service, err)
+	}
+
+	timeouts := defaultDockerTimeouts()
+	if service, ok := m.service(record.Service); ok && service.Docker != nil {
+		if t, err := parseDockerTimeouts(service.Docker); err == nil {
+			timeouts = t
+		}
+	}
+
+	if len(record.Definitions) > 0 {
+		log.Printf("Recreating containers removed by an interrupted restore for service %s", record.Service)
+		if err := m.recreateDefinitions(record, timeouts); err != nil {
+			return fmt.Errorf("failed to recover containers for %s: %w", record.Service, err)
+		}
+		return nil
+	}
+
+	log.Printf("Recovering containers left down by an interrupted job for service %s", record.Service)
+	record.Containers = stillQuiesced(runtime, record.Containers)
+	if err := m.resumeContainers(record, timeouts); err != nil {
+		return fmt.Errorf("failed to recover containers for %s: %w", record.Service, err)
+	}
+	return nil
+}
+
+// stillQuiesced drops containers that are no longer down, or no longer exist,
+// so recovery doesn't touch containers someone else has since dealt with
+func stillQuiesced(runtime ContainerRuntime, containers []quiescedContainer) []quiescedContainer {
+	var down []quiescedContainer
+	for _, c := range containers {
+		info, err := runtime.Inspect(context.Background(), c.Name)
+		if client.IsErrNotFound(err) {
+			log.Printf("Warning: container %s no longer exists, skipping recovery", c.Name)
+			continue
+		}
+		if err == nil && info.State.Running && !info.State.Paused {
+			continue
+		}
+		if err == nil {
+			c.Paused = info.State.Paused
+		}
+		down = append(down, c)
+	}
+	return down
+}
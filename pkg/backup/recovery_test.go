@@ -0,0 +1,132 @@
+package backup
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/logandonley/packrat/pkg/config"
+)
+
+func TestRecoveryRecords(t *testing.T) {
+	runtime := newFakeRuntime(t)
+	runtime.containers["db"] = &fakeContainer{crashes: startAttempts}
+	runtime.containers["web"] = &fakeContainer{running: true, paused: true}
+	manager := &Manager{config: &config.Config{}, stateDir: t.TempDir(), runtime: runtime}
+	defer func(delay time.Duration) { startRetryDelay = delay }(startRetryDelay)
+	startRetryDelay = time.Millisecond
+
+	record := &recoveryRecord{
+		Service:    "app",
+		PID:        os.Getpid(),
+		Started:    time.Now().UTC(),
+		Containers: []quiescedContainer{{Name: "db"}, {Name: "web", Paused: true}},
+	}
+	if err := manager.saveRecoveryRecord(record); err != nil {
+		t.Fatalf("saveRecoveryRecord failed: %v", err)
+	}
+
+	records, err := manager.loadRecoveryRecords()
+	if err != nil {
+		t.Fatalf("loadRecoveryRecords failed: %v", err)
+	}
+	if len(records) != 1 || !reflect.DeepEqual(records[0].Containers, record.Containers) {
+		t.Fatalf("loadRecoveryRecords() = %+v, want %+v", records, record)
+	}
+
+	// A job that still holds the service's lock is left to resume its own
+	// containers, whatever process it runs in
+	unlock, err := manager.lockService("app", "backup")
+	if err != nil {
+		t.Fatalf("lockService failed: %v", err)
+	}
+	if err := manager.RecoverContainers(); err != nil {
+		t.Errorf("RecoverContainers failed: %v", err)
+	}
+	if ops := runtime.operations(); len(ops) != 0 {
+		t.Errorf("Recovered containers of a running job: %v", ops)
+	}
+	unlock()
+
+	// A container that keeps crashing stays in the record for the next try
+	if err := manager.RecoverContainers(); err == nil {
+		t.Error("Expected RecoverContainers to fail for a crashing container")
+	}
+	records, err = manager.loadRecoveryRecords()
+	if err != nil || len(records) != 1 || !reflect.DeepEqual(records[0].Containers, []quiescedContainer{{Name: "db"}}) {
+		t.Fatalf("Expected only db to be left to recover, got %+v (%v)", records, err)
+	}
+	if runtime.containers["web"].paused {
+		t.Error("web was not unpaused")
+	}
+
+	// Once it comes up the record is removed
+	if err := manager.RecoverContainers(); err != nil {
+		t.Errorf("RecoverContainers failed: %v", err)
+	}
+	if !runtime.containers["db"].running {
+		t.Error("db was not started")
+	}
+	if _, err := os.Stat(manager.recoveryPath("app")); !os.IsNotExist(err) {
+		t.Errorf("Expected the recovery record to be removed, got %v", err)
+	}
+
+	// Containers that are back up or gone are left alone
+	record.Containers = []quiescedContainer{{Name: "db"}, {Name: "gone"}}
+	if err := manager.saveRecoveryRecord(record); err != nil {
+		t.Fatalf("saveRecoveryRecord failed: %v", err)
+	}
+	opCount := len(runtime.operations())
+	if err := manager.RecoverContainers(); err != nil {
+		t.Errorf("RecoverContainers failed: %v", err)
+	}
+	if ops := runtime.operations()[opCount:]; len(ops) != 0 {
+		t.Errorf("Unexpected operations %v", ops)
+	}
+	if _, err := os.Stat(manager.recoveryPath("app")); !os.IsNotExist(err) {
+		t.Errorf("Expected the recovery record to be removed, got %v", err)
+	}
+
+	// A failed restart fails the job
+	jobErr := error(nil)
+	job := newHookJob("backup", "app", "", TriggerManual)
+	manager.restartContainers(job, func() error { return fmt.Errorf("no such container") }, &jobErr)
+	if jobErr == nil || !strings.Contains(jobErr.Error(), "failed to restart Docker containers") {
+		t.Errorf("Expected a restart error, got %v", jobErr)
+	}
+	if job.Containers != ContainersFailed {
+		t.Errorf("job.Containers = %q, want %q", job.Containers, ContainersFailed)
+	}
+}
+
+func TestRecoveryRecordDefinitions(t *testing.T) {
+	manager := &Manager{config: &config.Config{}, stateDir: t.TempDir()}
+	record := &recoveryRecord{
+		Service: "app",
+		PID:     os.Getpid(),
+		Started: time.Now().UTC(),
+		Definitions: []containerSpec{{
+			Name:       "web",
+			Image:      "nginx:1.27",
+			Config:     &container.Config{Image: "nginx:1.27", Env: []string{"PORT=80"}},
+			HostConfig: &container.HostConfig{Binds: []string{"/srv/web:/usr/share/nginx/html"}},
+		}},
+	}
+	if err := manager.saveRecoveryRecord(record); err != nil {
+		t.Fatalf("saveRecoveryRecord failed: %v", err)
+	}
+
+	// The definitions are all that's left of removed containers, so they must
+	// come back intact
+	records, err := manager.loadRecoveryRecords()
+	if err != nil {
+		t.Fatalf("loadRecoveryRecords failed: %v", err)
+	}
+	if len(records) != 1 || !reflect.DeepEqual(records[0].Definitions, record.Definitions) {
+		t.Errorf("loadRecoveryRecords() = %+v, want %+v", records, record)
+	}
+}
@@ -0,0 +1,414 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/logandonley/packrat/pkg/config"
+)
+
+// ContainerRuntime is what backups need from a container engine. The Docker API
+// implementation serves Docker and Podman; tests use an in-memory one.
+type ContainerRuntime interface {
+	// Inspect returns a container's definition and state
+	Inspect(ctx context.Context, name string) (types.ContainerJSON, error)
+
+	// List returns the containers that have a label, given as key or key=value.
+	// Stopped containers are included only with all set.
+	List(ctx context.Context, label string, all bool) ([]types.Container, error)
+
+	// Stop stops a container and waits for it to exit. The engine kills the
+	// container if it hasn't exited after the grace period.
+	Stop(ctx context.Context, name string, grace time.Duration) error
+
+	// Start starts a container and waits up to timeout for it to be running
+	Start(ctx context.Context, name string, timeout time.Duration) error
+
+	// Create creates a container from its definition, joined to the given
+	// networks. User-defined networks that don't exist are created first.
+	Create(ctx context.Context, name string, cfg *container.Config, hostCfg *container.HostConfig, networks map[string]*network.EndpointSettings) error
+
+	// Remove removes a stopped container
+	Remove(ctx context.Context, name string) error
+
+	// PullImage pulls an image. It only fails if the image can't be pulled and
+	// there is no local copy to fall back on.
+	PullImage(ctx context.Context, ref string) error
+
+	// WaitHealthy waits up to timeout for a container with a healthcheck to
+	// report healthy. Containers without one are healthy once running.
+	WaitHealthy(ctx context.Context, name string, timeout time.Duration) error
+
+	Pause(ctx context.Context, name string) error
+	Unpause(ctx context.Context, name string) error
+
+	// Exec runs a command in a running container and returns its exit code.
+	// The command is killed if ctx is done before it exits, and an error other
+	// than ctx.Err() is returned if it is still running after that. No output
+	// is written once Exec has returned.
+	Exec(ctx context.Context, name string, opts ExecOptions) (int, error)
+
+	// Volume returns the host directory of a named volume, creating the volume
+	// first if it doesn't exist and create is set
+	Volume(ctx context.Context, name string, create bool) (string, error)
+}
+
+// ExecOptions describe a command run with ContainerRuntime.Exec
+type ExecOptions struct {
+	Cmd        []string
+	User       string
+	WorkingDir string // Defaults to the container's
+	Env        []string
+	Stdout     io.Writer
+	Stderr     io.Writer
+}
+
+// SetContainerRuntime replaces the container engine the manager talks to
+func (m *Manager) SetContainerRuntime(runtime ContainerRuntime) {
+	m.runtimeMu.Lock()
+	defer m.runtimeMu.Unlock()
+	m.runtime = runtime
+}
+
+// containerRuntime returns the container runtime, connecting to the configured
+// engine on first use so services without containers work on hosts that have
+// no engine at all
+func (m *Manager) containerRuntime() (ContainerRuntime, error) {
+	m.runtimeMu.Lock()
+	defer m.runtimeMu.Unlock()
+	if m.runtime != nil {
+		return m.runtime, nil
+	}
+
+	var engine config.ContainerEngine
+	if m.config != nil {
+		engine = m.config.ContainerEngine
+	}
+	cli, err := newEngineClient(engine)
+	if err != nil {
+		return nil, err
+	}
+	m.runtime = &dockerRuntime{cli: cli}
+	return m.runtime, nil
+}
+
+// docker returns the Docker API client, for the operations beyond ContainerRuntime
+// that only the Docker API implementation supports
+func (m *Manager) docker() (client.APIClient, error) {
+	runtime, err := m.containerRuntime()
+	if err != nil {
+		return nil, err
+	}
+	d, ok := runtime.(*dockerRuntime)
+	if !ok {
+		return nil, fmt.Errorf("the container runtime does not support this operation")
+	}
+	return d.cli, nil
+}
+
+// dockerRuntime implements ContainerRuntime with the Docker API
+type dockerRuntime struct {
+	cli client.APIClient
+}
+
+func (r *dockerRuntime) Close() error {
+	return r.cli.Close()
+}
+
+func (r *dockerRuntime) Inspect(ctx context.Context, name string) (types.ContainerJSON, error) {
+	return r.cli.ContainerInspect(ctx, name)
+}
+
+func (r *dockerRuntime) List(ctx context.Context, label string, all bool) ([]types.Container, error) {
+	return r.cli.ContainerList(ctx, container.ListOptions{
+		All:     all,
+		Filters: filters.NewArgs(filters.Arg("label", label)),
+	})
+}
+
+func (r *dockerRuntime) Stop(ctx context.Context, name string, grace time.Duration) error {
+	graceSeconds := int(grace.Round(time.Second).Seconds())
+	if err := r.cli.ContainerStop(ctx, name, container.StopOptions{Timeout: &graceSeconds}); err != nil {
+		return fmt.Errorf("failed to stop container: %w", err)
+	}
+
+	// Wait for container to actually stop
+	deadline := time.Now().Add(grace + 30*time.Second)
+	for {
+		info, err := r.cli.ContainerInspect(ctx, name)
+		if err != nil {
+			return fmt.Errorf("failed to inspect container: %w", err)
+		}
+		if !info.State.Running {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timeout waiting for container %s to stop", name)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func (r *dockerRuntime) Start(ctx context.Context, name string, timeout time.Duration) error {
+	if err := r.cli.ContainerStart(ctx, name, container.StartOptions{}); err != nil {
+		return fmt.Errorf("failed to start container: %w", err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		info, err := r.cli.ContainerInspect(ctx, name)
+		if err != nil {
+			return fmt.Errorf("failed to inspect container: %w", err)
+		}
+		if info.State.Running {
+			return nil
+		}
+		if info.State.ExitCode != 0 {
+			return fmt.Errorf("container %s failed to start (exit code: %d)", name, info.State.ExitCode)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timeout waiting for container %s to start", name)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func (r *dockerRuntime) Create(ctx context.Context, name string, cfg *container.Config, hostCfg *container.HostConfig, networks map[string]*network.EndpointSettings) error {
+	// Docker creates missing volumes itself, but not networks
+	var endpoints *network.NetworkingConfig
+	for networkName, settings := range networks {
+		if err := r.ensureNetwork(ctx, networkName); err != nil {
+			return err
+		}
+		if endpoints == nil {
+			endpoints = &network.NetworkingConfig{EndpointsConfig: make(map[string]*network.EndpointSettings)}
+		}
+		endpoints.EndpointsConfig[networkName] = settings
+	}
+
+	if _, err := r.cli.ContainerCreate(ctx, cfg, hostCfg, endpoints, nil, name); err != nil {
+		return fmt.Errorf("failed to create container: %w", err)
+	}
+	return nil
+}
+
+// ensureNetwork creates a user-defined bridge network if it doesn't exist
+func (r *dockerRuntime) ensureNetwork(ctx context.Context, name string) error {
+	if slices.Contains([]string{"bridge", "host", "none"}, name) {
+		return nil
+	}
+	_, err := r.cli.NetworkInspect(ctx, name, network.InspectOptions{})
+	if err == nil {
+		return nil
+	}
+	if !client.IsErrNotFound(err) {
+		return fmt.Errorf("failed to inspect network %s: %w", name, err)
+	}
+	log.Printf("Creating missing network %s", name)
+	if _, err := r.cli.NetworkCreate(ctx, name, network.CreateOptions{Driver: "bridge"}); err != nil {
+		return fmt.Errorf("failed to create network %s: %w", name, err)
+	}
+	return nil
+}
+
+func (r *dockerRuntime) Remove(ctx context.Context, name string) error {
+	if err := r.cli.ContainerRemove(ctx, name, container.RemoveOptions{}); err != nil {
+		return fmt.Errorf("failed to remove container: %w", err)
+	}
+	return nil
+}
+
+func (r *dockerRuntime) PullImage(ctx context.Context, ref string) error {
+	reader, err := r.cli.ImagePull(ctx, ref, image.PullOptions{})
+	if err == nil {
+		_, err = io.Copy(io.Discard, reader)
+		reader.Close()
+	}
+	if err != nil {
+		if _, _, inspectErr := r.cli.ImageInspectWithRaw(ctx, ref); inspectErr != nil {
+			return fmt.Errorf("failed to pull image %s: %w", ref, err)
+		}
+		log.Printf("Warning: failed to pull image %s, using the local copy: %v", ref, err)
+	}
+	return nil
+}
+
+func (r *dockerRuntime) WaitHealthy(ctx context.Context, name string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		info, err := r.cli.ContainerInspect(ctx, name)
+		if err != nil {
+			return fmt.Errorf("failed to inspect container health: %w", err)
+		}
+		if info.State.Health == nil {
+			return nil
+		}
+
+		switch info.State.Health.Status {
+		case "healthy":
+			return nil
+		case "unhealthy":
+			return fmt.Errorf("container %s is unhealthy after start", name)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timeout waiting for container %s to become healthy", name)
+		}
+		time.Sleep(1 * time.Second)
+	}
+}
+
+func (r *dockerRuntime) Pause(ctx context.Context, name string) error {
+	if err := r.cli.ContainerPause(ctx, name); err != nil {
+		return fmt.Errorf("failed to pause container: %w", err)
+	}
+	return nil
+}
+
+func (r *dockerRuntime) Unpause(ctx context.Context, name string) error {
+	if err := r.cli.ContainerUnpause(ctx, name); err != nil {
+		return fmt.Errorf("failed to unpause container: %w", err)
+	}
+	return nil
+}
+
+func (r *dockerRuntime) Exec(ctx context.Context, name string, opts ExecOptions) (int, error) {
+	created, err := r.cli.ContainerExecCreate(ctx, name, container.ExecOptions{
+		Cmd:          opts.Cmd,
+		User:         opts.User,
+		WorkingDir:   opts.WorkingDir,
+		Env:          opts.Env,
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to create exec: %w", err)
+	}
+
+	attach, err := r.cli.ContainerExecAttach(ctx, created.ID, container.ExecAttachOptions{})
+	if err != nil {
+		return 0, fmt.Errorf("failed to start exec: %w", err)
+	}
+	defer attach.Close()
+
+	copied := make(chan error, 1)
+	go func() {
+		_, err := stdcopy.StdCopy(opts.Stdout, opts.Stderr, attach.Reader)
+		copied <- err
+	}()
+
+	select {
+	case err := <-copied:
+		if err != nil {
+			return 0, fmt.Errorf("failed to read command output: %w", err)
+		}
+	case <-ctx.Done():
+		stopErr := r.killExec(created.ID)
+		// The exec outlives its attach connection, but closing the connection
+		// ends the copy, so nothing is written to the output after Exec returns
+		attach.Close()
+		<-copied
+		if stopErr != nil {
+			return 0, stopErr
+		}
+		return 0, ctx.Err()
+	}
+
+	info, err := r.cli.ContainerExecInspect(context.Background(), created.ID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to inspect exec: %w", err)
+	}
+	return info.ExitCode, nil
+}
+
+// execStopWait is how long a killed exec gets to stop
+var execStopWait = 10 * time.Second
+
+// killExec kills a timed-out exec and the processes it started, then waits
+// for it to stop. Docker has no API for this, so the processes are signalled
+// on the host, which only works when running on the engine's host.
+func (r *dockerRuntime) killExec(execID string) error {
+	info, err := r.cli.ContainerExecInspect(context.Background(), execID)
+	if err != nil {
+		return fmt.Errorf("failed to inspect exec: %w", err)
+	}
+	if info.Running && info.Pid > 0 {
+		for _, pid := range processTree(info.Pid) {
+			if err := syscall.Kill(pid, syscall.SIGKILL); err != nil && !errors.Is(err, syscall.ESRCH) {
+				log.Printf("Warning: failed to kill timed-out command (pid %d): %v", pid, err)
+			}
+		}
+	}
+
+	deadline := time.Now().Add(execStopWait)
+	for {
+		info, err := r.cli.ContainerExecInspect(context.Background(), execID)
+		if err != nil {
+			return fmt.Errorf("failed to inspect exec: %w", err)
+		}
+		if !info.Running {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("the command could not be killed and is still running (pid %d)", info.Pid)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// processTree returns a process and all of its descendants, parents first
+func processTree(pid int) []int {
+	pids := []int{pid}
+	for i := 0; i < len(pids); i++ {
+		tasks, _ := filepath.Glob(fmt.Sprintf("/proc/%d/task/*/children", pids[i]))
+		for _, task := range tasks {
+			data, err := os.ReadFile(task)
+			if err != nil {
+				continue
+			}
+			for _, field := range strings.Fields(string(data)) {
+				if child, err := strconv.Atoi(field); err == nil {
+					pids = append(pids, child)
+				}
+			}
+		}
+	}
+	return pids
+}
+
+// Volume finds a volume's mountpoint. It comes from the volume driver, so
+// volumes outside Docker's own data directory work too.
+func (r *dockerRuntime) Volume(ctx context.Context, name string, create bool) (string, error) {
+	info, err := r.cli.VolumeInspect(ctx, name)
+	if create && client.IsErrNotFound(err) {
+		log.Printf("Creating missing volume %s", name)
+		info, err = r.cli.VolumeCreate(ctx, volume.CreateOptions{Name: name})
+		if err != nil {
+			return "", fmt.Errorf("failed to create volume %s: %w", name, err)
+		}
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to inspect volume %s: %w", name, err)
+	}
+	if info.Mountpoint == "" {
+		return "", fmt.Errorf("volume %s (driver %s) has no mountpoint on this host", name, info.Driver)
+	}
+	return info.Mountpoint, nil
+}
@@ -0,0 +1,271 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/errdefs"
+)
+
+// fakeRuntime is an in-memory ContainerRuntime. Containers can be set up to
+// stop slowly, crash when started or fail their health check.
+type fakeRuntime struct {
+	mu         sync.Mutex
+	containers map[string]*fakeContainer
+	volumeRoot string
+	volumes    map[string]string
+	ops        []string // Operations in order, like "stop db"
+
+	missingImages map[string]bool // Images that can't be pulled
+	createFails   map[string]int  // Creates of a container that fail before one succeeds
+}
+
+type fakeContainer struct {
+	image   string
+	labels  map[string]string
+	running bool
+	paused  bool
+
+	stopDelay   time.Duration // Time the container takes to exit when stopped
+	crashes     int           // Starts that crash before one succeeds
+	healthcheck bool
+	unhealthy   bool // Fails its health check after starting
+	exec        func(ctx context.Context, opts ExecOptions) (int, error)
+}
+
+func newFakeRuntime(t *testing.T) *fakeRuntime {
+	return &fakeRuntime{
+		containers: make(map[string]*fakeContainer),
+		volumeRoot: t.TempDir(),
+		volumes:    make(map[string]string),
+	}
+}
+
+// addVolume creates a volume with the given files
+func (f *fakeRuntime) addVolume(t *testing.T, name string, files map[string]string) {
+	path := filepath.Join(f.volumeRoot, name)
+	for file, content := range files {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(path, file)), 0755); err != nil {
+			t.Fatalf("Failed to create volume directory: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(path, file), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write volume file: %v", err)
+		}
+	}
+	f.volumes[name] = path
+}
+
+func (f *fakeRuntime) operations() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.ops...)
+}
+
+func (f *fakeRuntime) container(name string) (*fakeContainer, error) {
+	c, ok := f.containers[name]
+	if !ok {
+		return nil, errdefs.NotFound(fmt.Errorf("no such container: %s", name))
+	}
+	return c, nil
+}
+
+func (f *fakeRuntime) Inspect(ctx context.Context, name string) (types.ContainerJSON, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, err := f.container(name)
+	if err != nil {
+		return types.ContainerJSON{}, err
+	}
+	state := &types.ContainerState{Running: c.running, Paused: c.paused}
+	if c.healthcheck {
+		state.Health = &types.Health{Status: "healthy"}
+		if c.unhealthy {
+			state.Health.Status = "unhealthy"
+		}
+	}
+	return types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{ID: "0123456789abcdef", Name: "/" + name, State: state},
+		Config:            &container.Config{Image: c.image, Labels: c.labels},
+	}, nil
+}
+
+func (f *fakeRuntime) List(ctx context.Context, label string, all bool) ([]types.Container, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key, value, hasValue := strings.Cut(label, "=")
+	var list []types.Container
+	for name, c := range f.containers {
+		v, ok := c.labels[key]
+		if !ok || (hasValue && v != value) || (!all && !c.running) {
+			continue
+		}
+		list = append(list, types.Container{Names: []string{"/" + name}, Image: c.image, Labels: c.labels})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Names[0] < list[j].Names[0] })
+	return list, nil
+}
+
+func (f *fakeRuntime) Stop(ctx context.Context, name string, grace time.Duration) error {
+	f.mu.Lock()
+	c, err := f.container(name)
+	if err != nil {
+		f.mu.Unlock()
+		return err
+	}
+	delay, op := c.stopDelay, "stop "+name
+	if delay > grace {
+		delay, op = grace, "kill "+name
+	}
+	f.ops = append(f.ops, op)
+	f.mu.Unlock()
+
+	time.Sleep(delay)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c.running, c.paused = false, false
+	return nil
+}
+
+func (f *fakeRuntime) Start(ctx context.Context, name string, timeout time.Duration) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, err := f.container(name)
+	if err != nil {
+		return err
+	}
+	f.ops = append(f.ops, "start "+name)
+	if c.crashes > 0 {
+		c.crashes--
+		return fmt.Errorf("container %s failed to start (exit code: 1)", name)
+	}
+	c.running = true
+	return nil
+}
+
+func (f *fakeRuntime) Create(ctx context.Context, name string, cfg *container.Config, hostCfg *container.HostConfig, networks map[string]*network.EndpointSettings) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.containers[name]; ok {
+		return errdefs.Conflict(fmt.Errorf("container name %s is already in use", name))
+	}
+	f.ops = append(f.ops, "create "+name)
+	if f.createFails[name] > 0 {
+		f.createFails[name]--
+		return fmt.Errorf("failed to create container %s", name)
+	}
+	f.containers[name] = &fakeContainer{image: cfg.Image, labels: cfg.Labels}
+	return nil
+}
+
+func (f *fakeRuntime) Remove(ctx context.Context, name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, err := f.container(name)
+	if err != nil {
+		return err
+	}
+	if c.running {
+		return errdefs.Conflict(fmt.Errorf("container %s is running", name))
+	}
+	f.ops = append(f.ops, "remove "+name)
+	delete(f.containers, name)
+	return nil
+}
+
+func (f *fakeRuntime) PullImage(ctx context.Context, ref string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.ops = append(f.ops, "pull "+ref)
+	if f.missingImages[ref] {
+		return fmt.Errorf("failed to pull image %s: not found", ref)
+	}
+	return nil
+}
+
+func (f *fakeRuntime) WaitHealthy(ctx context.Context, name string, timeout time.Duration) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, err := f.container(name)
+	if err != nil {
+		return err
+	}
+	if c.healthcheck && c.unhealthy {
+		return fmt.Errorf("container %s is unhealthy after start", name)
+	}
+	return nil
+}
+
+func (f *fakeRuntime) Pause(ctx context.Context, name string) error {
+	return f.setPaused(name, true)
+}
+
+func (f *fakeRuntime) Unpause(ctx context.Context, name string) error {
+	return f.setPaused(name, false)
+}
+
+func (f *fakeRuntime) setPaused(name string, paused bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, err := f.container(name)
+	if err != nil {
+		return err
+	}
+	if !c.running {
+		return fmt.Errorf("container %s is not running", name)
+	}
+	if paused {
+		f.ops = append(f.ops, "pause "+name)
+	} else {
+		f.ops = append(f.ops, "unpause "+name)
+	}
+	c.paused = paused
+	return nil
+}
+
+func (f *fakeRuntime) Exec(ctx context.Context, name string, opts ExecOptions) (int, error) {
+	f.mu.Lock()
+	c, err := f.container(name)
+	if err == nil && (!c.running || c.paused) {
+		err = fmt.Errorf("container %s is not running", name)
+	}
+	if err != nil {
+		f.mu.Unlock()
+		return 0, err
+	}
+	f.ops = append(f.ops, "exec "+name)
+	exec := c.exec
+	f.mu.Unlock()
+
+	if exec == nil {
+		return 0, nil
+	}
+	return exec(ctx, opts)
+}
+
+func (f *fakeRuntime) Volume(ctx context.Context, name string, create bool) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if path, ok := f.volumes[name]; ok {
+		return path, nil
+	}
+	if !create {
+		return "", errdefs.NotFound(fmt.Errorf("no such volume: %s", name))
+	}
+	path := filepath.Join(f.volumeRoot, name)
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return "", err
+	}
+	f.volumes[name] = path
+	return path, nil
+}
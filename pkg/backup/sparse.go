@@ -0,0 +1,188 @@
+package backup
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// paxSparseMap records the data regions of a sparse file as comma-separated
+// offset,length pairs.
+//
+// archive/tar can't write GNU sparse entries, so sparse files are stored as
+// regular entries at their full size, with the holes written out as zeros.
+// The holes aren't read from disk, and zstd reduces the zero runs to almost
+// nothing, but they still pass through the compressor. Other tar tools extract
+// a correct (non-sparse) file, and ExtractArchive uses this record to seek over
+// the holes so they are recreated on restore.
+const paxSparseMap = "PACKRAT.sparse.map"
+
+// sparseRegion is a Length-sized run of data at Offset in a sparse file
+type sparseRegion struct {
+	Offset int64
+	Length int64
+}
+
+// fileID identifies an inode for hard link detection
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+// hardLinkID returns the inode identity of a file with more than one link
+func hardLinkID(info os.FileInfo) (fileID, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || stat.Nlink < 2 || !info.Mode().IsRegular() {
+		return fileID{}, false
+	}
+	return fileID{dev: uint64(stat.Dev), ino: uint64(stat.Ino)}, true
+}
+
+// isSparse reports whether a file has fewer allocated blocks than its size needs
+func isSparse(info os.FileInfo) bool {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || !info.Mode().IsRegular() {
+		return false
+	}
+	return int64(stat.Blocks)*512 < info.Size()
+}
+
+// findDataRegions maps the data regions of a file using SEEK_DATA/SEEK_HOLE.
+// It returns nil if the filesystem can't report holes.
+func findDataRegions(file *os.File, size int64) ([]sparseRegion, error) {
+	fd := int(file.Fd())
+	regions := []sparseRegion{} // Non-nil even when the file is all hole
+
+	for offset := int64(0); offset < size; {
+		start, err := unix.Seek(fd, offset, unix.SEEK_DATA)
+		if err != nil {
+			if errors.Is(err, unix.ENXIO) {
+				break // Only a hole remains
+			}
+			if errors.Is(err, unix.EINVAL) || errors.Is(err, unix.ENOTSUP) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("failed to seek to data: %w", err)
+		}
+
+		end, err := unix.Seek(fd, start, unix.SEEK_HOLE)
+		if err != nil {
+			return nil, fmt.Errorf("failed to seek to hole: %w", err)
+		}
+		if end > size {
+			end = size
+		}
+
+		regions = append(regions, sparseRegion{Offset: start, Length: end - start})
+		offset = end
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to rewind file: %w", err)
+	}
+	return regions, nil
+}
+
+func formatSparseMap(regions []sparseRegion) string {
+	parts := make([]string, 0, len(regions)*2)
+	for _, r := range regions {
+		parts = append(parts, strconv.FormatInt(r.Offset, 10), strconv.FormatInt(r.Length, 10))
+	}
+	return strings.Join(parts, ",")
+}
+
+func parseSparseMap(value string, size int64) ([]sparseRegion, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	parts := strings.Split(value, ",")
+	if len(parts)%2 != 0 {
+		return nil, fmt.Errorf("invalid sparse map: odd number of fields")
+	}
+
+	regions := make([]sparseRegion, 0, len(parts)/2)
+	var prevEnd int64
+	for i := 0; i < len(parts); i += 2 {
+		offset, err := strconv.ParseInt(parts[i], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sparse map offset: %w", err)
+		}
+		length, err := strconv.ParseInt(parts[i+1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sparse map length: %w", err)
+		}
+		if offset < prevEnd || length < 0 || offset+length > size {
+			return nil, fmt.Errorf("invalid sparse map region %d+%d", offset, length)
+		}
+		regions = append(regions, sparseRegion{Offset: offset, Length: length})
+		prevEnd = offset + length
+	}
+	return regions, nil
+}
+
+// writeSparseContents writes a sparse file's data regions to the archive, zero-filling the holes
+func writeSparseContents(w io.Writer, file *os.File, regions []sparseRegion, size int64) error {
+	var pos int64
+	for _, r := range regions {
+		if _, err := io.CopyN(w, zeroReader{}, r.Offset-pos); err != nil {
+			return err
+		}
+		if _, err := io.Copy(w, io.NewSectionReader(file, r.Offset, r.Length)); err != nil {
+			return err
+		}
+		pos = r.Offset + r.Length
+	}
+	_, err := io.CopyN(w, zeroReader{}, size-pos)
+	return err
+}
+
+// extractSparseContents writes only the data regions of a sparse entry, seeking over
+// the zero-filled holes, and sizes the file so trailing holes are recreated
+func extractSparseContents(file *os.File, r io.Reader, regions []sparseRegion, size int64) error {
+	var pos int64
+	for _, region := range regions {
+		if _, err := io.CopyN(io.Discard, r, region.Offset-pos); err != nil {
+			return err
+		}
+		if _, err := file.Seek(region.Offset, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(file, r, region.Length); err != nil {
+			return err
+		}
+		pos = region.Offset + region.Length
+	}
+	if _, err := io.CopyN(io.Discard, r, size-pos); err != nil {
+		return err
+	}
+	return file.Truncate(size)
+}
+
+// zeroReader is an endless source of zero bytes
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// sparseRegions returns the data regions recorded for a tar entry and whether it was stored as sparse
+func sparseRegions(header *tar.Header) ([]sparseRegion, bool, error) {
+	value, ok := header.PAXRecords[paxSparseMap]
+	if !ok {
+		return nil, false, nil
+	}
+	regions, err := parseSparseMap(value, header.Size)
+	if err != nil {
+		return nil, false, err
+	}
+	return regions, true, nil
+}
@@ -0,0 +1,115 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/logandonley/packrat/pkg/config"
+)
+
+func TestArchiveHardLinksAndSparseFiles(t *testing.T) {
+	srcDir := t.TempDir()
+	destDir := t.TempDir()
+
+	// Hard-linked file
+	original := filepath.Join(srcDir, "original.bin")
+	if err := os.WriteFile(original, bytes.Repeat([]byte("layer"), 1024), 0644); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	if err := os.Link(original, filepath.Join(srcDir, "linked.bin")); err != nil {
+		t.Fatalf("Failed to create hard link: %v", err)
+	}
+
+	// Sparse file: 64 MiB with a little data in the middle
+	const sparseSize = 64 << 20
+	sparsePath := filepath.Join(srcDir, "disk.img")
+	f, err := os.Create(sparsePath)
+	if err != nil {
+		t.Fatalf("Failed to create sparse file: %v", err)
+	}
+	if err := f.Truncate(sparseSize); err != nil {
+		t.Fatalf("Failed to truncate sparse file: %v", err)
+	}
+	if _, err := f.WriteAt([]byte("boot sector"), 32<<20); err != nil {
+		t.Fatalf("Failed to write sparse file: %v", err)
+	}
+	f.Close()
+
+	info, err := os.Stat(sparsePath)
+	if err != nil {
+		t.Fatalf("Failed to stat sparse file: %v", err)
+	}
+	if !isSparse(info) {
+		t.Skip("Filesystem doesn't support sparse files")
+	}
+
+	manager := &Manager{config: &config.Config{}}
+
+	var archive bytes.Buffer
+	if _, err := manager.createArchive(archiveSources{path: srcDir}, &archive); err != nil {
+		t.Fatalf("Failed to create archive: %v", err)
+	}
+	if archive.Len() > 1<<20 {
+		t.Errorf("Archive size = %d bytes, expected holes to compress away", archive.Len())
+	}
+
+	// Only one of the two links should carry the data
+	zr, err := zstd.NewReader(bytes.NewReader(archive.Bytes()))
+	if err != nil {
+		t.Fatalf("Failed to create zstd reader: %v", err)
+	}
+	tr := tar.NewReader(zr)
+	var linkEntries int
+	for {
+		header, err := tr.Next()
+		if err != nil {
+			break
+		}
+		if header.Typeflag == tar.TypeLink {
+			linkEntries++
+		}
+	}
+	zr.Close()
+	if linkEntries != 1 {
+		t.Errorf("Expected 1 hard link entry, got %d", linkEntries)
+	}
+
+	if err := ExtractArchive(&archive, destDir, RestoreOptions{}); err != nil {
+		t.Fatalf("Failed to extract archive: %v", err)
+	}
+
+	origInfo, err := os.Stat(filepath.Join(destDir, "original.bin"))
+	if err != nil {
+		t.Fatalf("Failed to stat restored file: %v", err)
+	}
+	linkInfo, err := os.Stat(filepath.Join(destDir, "linked.bin"))
+	if err != nil {
+		t.Fatalf("Failed to stat restored link: %v", err)
+	}
+	if !os.SameFile(origInfo, linkInfo) {
+		t.Error("Expected restored files to be hard links to the same inode")
+	}
+
+	restoredSparse := filepath.Join(destDir, "disk.img")
+	info, err = os.Stat(restoredSparse)
+	if err != nil {
+		t.Fatalf("Failed to stat restored sparse file: %v", err)
+	}
+	if info.Size() != sparseSize {
+		t.Errorf("Restored sparse file size = %d, want %d", info.Size(), sparseSize)
+	}
+	if !isSparse(info) {
+		t.Error("Expected restored file to be sparse")
+	}
+	data, err := os.ReadFile(restoredSparse)
+	if err != nil {
+		t.Fatalf("Failed to read restored sparse file: %v", err)
+	}
+	if got := string(data[32<<20 : 32<<20+len("boot sector")]); got != "boot sector" {
+		t.Errorf("Restored sparse data = %q, want %q", got, "boot sector")
+	}
+}
@@ -0,0 +1,132 @@
+package backup
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// backupTimeFormat is the timestamp in backup names
+const backupTimeFormat = "2006-01-02T15-04-05Z"
+
+// VerifyResult is the outcome of verifying a backup
+type VerifyResult struct {
+	Service string `json:"service"`
+	Backup  string `json:"backup"`
+	Files   int    `json:"files"`
+	Size    int64  `json:"size"` // Total size of the files in the archive
+	// Manifest is whether the archive was checked against the backup's manifest
+	Manifest bool `json:"manifest"`
+}
+
+// VerifyBackup checks that a backup can be restored: that it downloads,
+// decrypts and decompresses, and that every file in it matches its manifest,
+// if it has one. Without a backup name, the latest backup is verified.
+func (m *Manager) VerifyBackup(serviceName, backupName, source string) (*VerifyResult, error) {
+	if _, ok := m.service(serviceName); !ok {
+		return nil, fmt.Errorf("service %s not found in configuration", serviceName)
+	}
+	if backupName == "" {
+		latest, err := m.latestBackup(serviceName, source)
+		if err != nil {
+			return nil, err
+		}
+		backupName = latest
+	}
+
+	decrypted, err := m.fetchBackup(serviceName, backupName, source)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := hashArchive(bytes.NewReader(decrypted))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read archive %s: %w", backupName, err)
+	}
+
+	result := &VerifyResult{Service: serviceName, Backup: backupName}
+	for _, e := range entries {
+		if !e.IsDir() {
+			result.Files++
+			result.Size += e.Size
+		}
+	}
+
+	manifest, err := m.GetManifest(serviceName, backupName, source)
+	if err != nil {
+		return nil, err
+	}
+	if manifest == nil {
+		return result, nil
+	}
+	result.Manifest = true
+	if changes := diffEntries(manifest.Entries, entries); len(changes) > 0 {
+		var names []string
+		for _, c := range changes[:min(len(changes), 5)] {
+			names = append(names, c.Name)
+		}
+		return nil, fmt.Errorf("backup %s doesn't match its manifest: %d path(s) differ, including %s",
+			backupName, len(changes), strings.Join(names, ", "))
+	}
+	return result, nil
+}
+
+// latestBackup returns the name of a service's most recent backup. Without a
+// source, the backups on every configured storage are considered.
+func (m *Manager) latestBackup(serviceName, source string) (string, error) {
+	var names []string
+	if source == "" || source == "synology" {
+		files, err := m.Synology.List(serviceName + "-")
+		if err != nil {
+			return "", fmt.Errorf("failed to list Synology backups: %w", err)
+		}
+		for _, f := range BackupFiles(files) {
+			names = append(names, f.Name)
+		}
+	}
+	if m.S3 != nil && (source == "" || source == "s3") {
+		files, err := m.S3.List(serviceName + "-")
+		if err != nil {
+			return "", fmt.Errorf("failed to list S3 backups: %w", err)
+		}
+		for _, f := range BackupFiles(files) {
+			names = append(names, f.Name)
+		}
+	}
+
+	// The prefix also matches services whose names start with this one's, so
+	// only names that are this service's followed by a timestamp count
+	names = filterBackupNames(names, serviceName)
+	if len(names) == 0 {
+		return "", fmt.Errorf("no backups found for service %s", serviceName)
+	}
+	sort.Strings(names)
+	return names[len(names)-1], nil
+}
+
+// filterBackupNames keeps the names of a service's own backups
+func filterBackupNames(names []string, serviceName string) []string {
+	var kept []string
+	for _, name := range names {
+		if _, ok := BackupTime(serviceName, name); ok {
+			kept = append(kept, name)
+		}
+	}
+	return kept
+}
+
+// BackupTime returns when a backup of a service was taken, from its name.
+// It reports false if the name isn't one of the service's backups.
+func BackupTime(serviceName, backupName string) (time.Time, bool) {
+	timestamp, ok := strings.CutPrefix(backupName, serviceName+"-")
+	if !ok {
+		return time.Time{}, false
+	}
+	timestamp, ok = strings.CutSuffix(timestamp, backupSuffix)
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(backupTimeFormat, timestamp)
+	return t, err == nil
+}
@@ -0,0 +1,70 @@
+package backup
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/logandonley/packrat/pkg/config"
+)
+
+func TestVerifyBackup(t *testing.T) {
+	srcDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(srcDir, "data.txt"), []byte("data"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	store := &mockStorage{files: make(map[string][]byte)}
+	manager := &Manager{
+		config: &config.Config{Services: map[string]config.Service{
+			"app":    {Path: srcDir},
+			"app-db": {Path: srcDir},
+		}},
+		key:        []byte("testkey0123456789012345678901234"),
+		backupRoot: t.TempDir(),
+		Synology:   store,
+	}
+	if err := manager.CreateBackup("app"); err != nil {
+		t.Fatalf("CreateBackup failed: %v", err)
+	}
+	if err := manager.CreateBackup("app-db"); err != nil {
+		t.Fatalf("CreateBackup failed: %v", err)
+	}
+
+	// The latest backup is app's own, not app-db's
+	result, err := manager.VerifyBackup("app", "", "")
+	if err != nil {
+		t.Fatalf("VerifyBackup failed: %v", err)
+	}
+	if !strings.HasPrefix(result.Backup, "app-2") || result.Files != 1 || result.Size != 4 || !result.Manifest {
+		t.Errorf("Unexpected result: %+v", result)
+	}
+
+	// A file that doesn't match the manifest fails verification
+	manifest, err := manager.GetManifest("app", result.Backup, "")
+	if err != nil || manifest == nil {
+		t.Fatalf("GetManifest = %v, %v", manifest, err)
+	}
+	for i := range manifest.Entries {
+		if manifest.Entries[i].Name == "data.txt" {
+			manifest.Entries[i].SHA256 = strings.Repeat("0", 64)
+		}
+	}
+	if err := manager.uploadManifest(t.TempDir(), manifest); err != nil {
+		t.Fatalf("uploadManifest failed: %v", err)
+	}
+	if _, err := manager.VerifyBackup("app", result.Backup, ""); err == nil || !strings.Contains(err.Error(), "data.txt") {
+		t.Errorf("Expected a manifest mismatch for data.txt, got %v", err)
+	}
+
+	// So does a corrupted archive
+	archive := store.files[result.Backup]
+	archive[len(archive)-1] ^= 0xff
+	if _, err := manager.VerifyBackup("app", result.Backup, ""); err == nil {
+		t.Error("Expected a corrupted backup to fail verification")
+	}
+
+	if _, err := manager.VerifyBackup("missing", "", ""); err == nil {
+		t.Error("Expected an error for an unknown service")
+	}
+}
@@ -0,0 +1,145 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/logandonley/packrat/pkg/config"
+)
+
+// volumesDir is the archive directory Docker volumes are stored under
+const volumesDir = "volumes"
+
+// archiveVolume is a Docker volume resolved to where its data lives on this host
+type archiveVolume struct {
+	name string
+	path string
+}
+
+// archiveName returns the path a volume's root has in the archive
+func (v archiveVolume) archiveName() string {
+	return filepath.Join(volumesDir, v.name)
+}
+
+// validateVolumeName checks that a volume name can be used as an archive directory
+func validateVolumeName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsRune(name, filepath.Separator) {
+		return fmt.Errorf("invalid volume name %q", name)
+	}
+	return nil
+}
+
+// resolveVolumes looks up where the data of a service's volumes lives. With
+// create set, missing volumes are created, so a service can be restored onto a
+// fresh host.
+func (m *Manager) resolveVolumes(docker *config.Docker, create bool) ([]archiveVolume, error) {
+	if docker == nil || len(docker.Volumes) == 0 {
+		return nil, nil
+	}
+
+	var volumes []archiveVolume
+	for _, name := range docker.Volumes {
+		v, err := m.resolveVolume(name, create)
+		if err != nil {
+			return nil, err
+		}
+		volumes = append(volumes, v)
+	}
+	return volumes, nil
+}
+
+// resolveVolume finds where a volume's data lives on this host
+func (m *Manager) resolveVolume(name string, create bool) (archiveVolume, error) {
+	if err := validateVolumeName(name); err != nil {
+		return archiveVolume{}, err
+	}
+	runtime, err := m.containerRuntime()
+	if err != nil {
+		return archiveVolume{}, fmt.Errorf("cannot resolve volume %s: %w", name, err)
+	}
+	path, err := runtime.Volume(context.Background(), name, create)
+	if err != nil {
+		return archiveVolume{}, err
+	}
+	return archiveVolume{name: name, path: path}, nil
+}
+
+// ValidateVolumes checks that a service's volumes exist and their data is readable
+func (m *Manager) ValidateVolumes(docker *config.Docker) error {
+	volumes, err := m.resolveVolumes(docker, false)
+	if err != nil {
+		return err
+	}
+	for _, v := range volumes {
+		if _, err := os.ReadDir(v.path); err != nil {
+			return fmt.Errorf("failed to read volume %s at %s: %w", v.name, v.path, err)
+		}
+	}
+	return nil
+}
+
+// volumePaths maps volume names to their directories, for RestoreOptions.VolumePaths
+func volumePaths(volumes []archiveVolume) map[string]string {
+	if len(volumes) == 0 {
+		return nil
+	}
+	paths := make(map[string]string, len(volumes))
+	for _, v := range volumes {
+		paths[v.name] = v.path
+	}
+	return paths
+}
+
+// splitVolumeName splits an archive path below volumes/<name> into the volume
+// name and the path inside the volume ("." for its root)
+func splitVolumeName(name string) (string, string, bool) {
+	rest, ok := strings.CutPrefix(filepath.Clean(name), volumesDir+string(filepath.Separator))
+	if !ok {
+		return "", "", false
+	}
+	volumeName, inside, found := strings.Cut(rest, string(filepath.Separator))
+	if !found {
+		inside = "."
+	}
+	return volumeName, inside, true
+}
+
+// pruneStaleVolumes runs pruneStaleFiles on each volume restored in place. Exclude
+// patterns anchored at a volume's archive directory are applied inside it. The
+// returned paths are archive paths.
+func pruneStaleVolumes(volumePaths map[string]string, entries map[string]bool, excludePatterns []string, dryRun bool) ([]string, error) {
+	names := make([]string, 0, len(volumePaths))
+	for name := range volumePaths {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var stale []string
+	for _, name := range names {
+		volumeEntries := make(map[string]bool)
+		for entry, isDir := range entries {
+			if volumeName, inside, ok := splitVolumeName(entry); ok && volumeName == name {
+				volumeEntries[inside] = isDir
+			}
+		}
+
+		prefix := filepath.Join(volumesDir, name) + string(filepath.Separator)
+		excludes := make([]string, len(excludePatterns))
+		for i, pattern := range excludePatterns {
+			excludes[i] = strings.TrimPrefix(pattern, prefix)
+		}
+
+		removed, err := pruneStaleFiles(volumePaths[name], volumeEntries, excludes, dryRun)
+		if err != nil {
+			return nil, fmt.Errorf("volume %s: %w", name, err)
+		}
+		for _, path := range removed {
+			stale = append(stale, filepath.Join(prefix, path))
+		}
+	}
+	return stale, nil
+}
@@ -0,0 +1,108 @@
+package backup
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/logandonley/packrat/pkg/config"
+)
+
+func TestArchiveVolumes(t *testing.T) {
+	srcDir := t.TempDir()
+	volumeDir := t.TempDir()
+	files := map[string]string{
+		filepath.Join(srcDir, "app.conf"):             "config",
+		filepath.Join(volumeDir, "data", "db.sqlite"): "database",
+		filepath.Join(volumeDir, "cache", "blob"):     "cache",
+	}
+	for path, content := range files {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to create file: %v", err)
+		}
+	}
+
+	manager := &Manager{config: &config.Config{}}
+	src := archiveSources{
+		path:    srcDir,
+		exclude: []string{"volumes/app_data/cache/**"},
+		volumes: []archiveVolume{{name: "app_data", path: volumeDir}},
+	}
+
+	var archive bytes.Buffer
+	entries, err := manager.createArchive(src, &archive)
+	if err != nil {
+		t.Fatalf("Failed to create archive: %v", err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name)
+	}
+	want := []string{".", "app.conf", "volumes/app_data", "volumes/app_data/data", "volumes/app_data/data/db.sqlite"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("Archive entries = %v, want %v", names, want)
+	}
+
+	// Restoring in place puts the volume's contents back into the volume
+	restoreDir := t.TempDir()
+	restoreVolume := t.TempDir()
+	if err := os.WriteFile(filepath.Join(restoreVolume, "stale"), []byte("old"), 0644); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	// Excluded paths in the volume are kept
+	if err := os.MkdirAll(filepath.Join(restoreVolume, "cache"), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(restoreVolume, "cache", "blob"), []byte("cache"), 0644); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	opts := RestoreOptions{Mirror: true, VolumePaths: map[string]string{"app_data": restoreVolume}}
+
+	archiveEntries, err := readArchiveEntries(bytes.NewReader(archive.Bytes()))
+	if err != nil {
+		t.Fatalf("Failed to read archive: %v", err)
+	}
+	stale, err := pruneStale(restoreDir, archiveEntries, src.exclude, opts.VolumePaths, false)
+	if err != nil {
+		t.Fatalf("pruneStale failed: %v", err)
+	}
+	if want := []string{"volumes/app_data/stale"}; !reflect.DeepEqual(stale, want) {
+		t.Errorf("pruneStale() = %v, want %v", stale, want)
+	}
+
+	if err := ExtractArchive(bytes.NewReader(archive.Bytes()), restoreDir, opts); err != nil {
+		t.Fatalf("Failed to extract archive: %v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(restoreVolume, "data", "db.sqlite")); err != nil || string(data) != "database" {
+		t.Errorf("Volume file = %q, %v; want %q", data, err, "database")
+	}
+	if _, err := os.Stat(filepath.Join(restoreDir, "app.conf")); err != nil {
+		t.Errorf("Service file not restored: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(restoreDir, volumesDir)); !os.IsNotExist(err) {
+		t.Errorf("Expected no volumes directory in the service path, got %v", err)
+	}
+
+	// Restoring elsewhere keeps the volume under volumes/<name>
+	copyDir := t.TempDir()
+	if err := ExtractArchive(bytes.NewReader(archive.Bytes()), copyDir, RestoreOptions{}); err != nil {
+		t.Fatalf("Failed to extract archive: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(copyDir, "volumes", "app_data", "data", "db.sqlite")); err != nil {
+		t.Errorf("Volume file not restored under volumes/: %v", err)
+	}
+
+	// A service directory with its own volumes directory would be shadowed
+	if err := os.Mkdir(filepath.Join(srcDir, volumesDir), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if _, err := manager.createArchive(src, io.Discard); err == nil {
+		t.Error("Expected an error for a conflicting volumes directory")
+	}
+}
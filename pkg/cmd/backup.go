@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"fmt"
+	"os"
 
 	"github.com/logandonley/packrat/pkg/backup"
 	"github.com/logandonley/packrat/pkg/config"
@@ -19,6 +20,27 @@ func BackupCmd() *cobra.Command {
 		RunE: func(cmd *cobra.Command, args []string) error {
 			serviceName := args[0]
 
+			// Run the backup through the daemon if it's running, so it's queued
+			// with the daemon's own jobs
+			client, err := DaemonClient()
+			if err != nil {
+				return err
+			}
+			if client != nil {
+				fmt.Printf("Creating backup of service %s through the packrat daemon\n", serviceName)
+				err := client.Backup(serviceName, func(line string) {
+					fmt.Fprintln(os.Stderr, line)
+				})
+				if err != nil {
+					if backup.IsJobRunning(err) {
+						return fmt.Errorf("%w, try again when it has finished", err)
+					}
+					return fmt.Errorf("failed to create backup: %w", err)
+				}
+				fmt.Printf("Backup of service %s completed successfully\n", serviceName)
+				return nil
+			}
+
 			// Load configuration
 			var cfg config.Config
 			if err := viper.Unmarshal(&cfg); err != nil {
@@ -40,6 +62,9 @@ func BackupCmd() *cobra.Command {
 			// Create backup
 			fmt.Printf("Creating backup of service: %s\n", serviceName)
 			if err := manager.CreateBackup(serviceName); err != nil {
+				if backup.IsJobRunning(err) {
+					return fmt.Errorf("%w, try again when it has finished", err)
+				}
 				return fmt.Errorf("failed to create backup: %w", err)
 			}
 
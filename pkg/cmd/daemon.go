@@ -0,0 +1,30 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/logandonley/packrat/pkg/config"
+	"github.com/logandonley/packrat/pkg/daemon"
+	"github.com/spf13/viper"
+)
+
+// DaemonClient returns a client for the running daemon, so commands run
+// through it instead of racing with its jobs. It returns nil if no daemon is
+// running, in which case commands run standalone.
+func DaemonClient() (*daemon.Client, error) {
+	var cfg config.Config
+	if err := viper.Unmarshal(&cfg); err != nil {
+		return nil, fmt.Errorf("failed to load configuration: %w", err)
+	}
+	stateDir, err := cfg.StateDirectory()
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := daemon.Connect(stateDir)
+	if errors.Is(err, daemon.ErrNotRunning) {
+		return nil, nil
+	}
+	return client, err
+}
@@ -5,6 +5,7 @@ import (
 	"sort"
 	"strings"
 
+	"github.com/logandonley/packrat/pkg/backup"
 	"github.com/logandonley/packrat/pkg/config"
 	"github.com/logandonley/packrat/pkg/storage"
 	"github.com/spf13/cobra"
@@ -79,14 +80,15 @@ If no service is specified, backups for all services will be listed.`,
 				fmt.Printf("\nBackups for service: %s\n", serviceName)
 				fmt.Printf("Service path: %s\n", service.Path)
 				if service.Docker != nil {
-					fmt.Printf("Docker container: %s\n", service.Docker.Container)
+					fmt.Printf("Docker: %s\n", service.Docker.Describe())
 				}
 
-				// List backups from Synology
-				backups, err := synology.List(serviceName)
+				// List backups from Synology, leaving out their manifests
+				files, err := synology.List(serviceName)
 				if err != nil {
 					return fmt.Errorf("failed to list backups for %s: %w", serviceName, err)
 				}
+				backups := backup.BackupFiles(files)
 
 				if len(backups) == 0 {
 					fmt.Println("No backups found")
@@ -0,0 +1,204 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/logandonley/packrat/pkg/backup"
+	"github.com/logandonley/packrat/pkg/crypto"
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+)
+
+// AnnotationOffline marks commands that work without a config file
+const AnnotationOffline = "packrat.offline"
+
+// offlineKeyFlags holds the key options shared by the offline recovery commands
+type offlineKeyFlags struct {
+	keyFile  string
+	password bool
+}
+
+func (f *offlineKeyFlags) register(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&f.keyFile, "key-file", "", "Encryption key file (default $HOME/.config/packrat/key)")
+	cmd.Flags().BoolVar(&f.password, "password", false, "Derive the key from the original password instead of reading a key file")
+	cmd.MarkFlagsMutuallyExclusive("key-file", "password")
+}
+
+// loadKey returns the encryption key from a key file or by re-deriving it from the password
+func (f *offlineKeyFlags) loadKey() ([]byte, error) {
+	if f.password {
+		password, err := readPassword()
+		if err != nil {
+			return nil, err
+		}
+		key, _, err := crypto.DeriveKey(string(password))
+		if err != nil {
+			return nil, fmt.Errorf("failed to derive key: %w", err)
+		}
+		return key, nil
+	}
+
+	keyFile := f.keyFile
+	if keyFile == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get home directory: %w", err)
+		}
+		keyFile = filepath.Join(home, ".config", "packrat", "key")
+		if _, err := os.Stat(keyFile); err != nil {
+			return nil, fmt.Errorf("no key file at %s: pass --key-file or --password", keyFile)
+		}
+	}
+
+	key, _, err := crypto.LoadKey(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load encryption key: %w", err)
+	}
+	return key, nil
+}
+
+// readPassword prompts for the password on a terminal, or reads one line from piped stdin
+func readPassword() ([]byte, error) {
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		fmt.Fprint(os.Stderr, "Enter original password: ")
+		password, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read password: %w", err)
+		}
+		return password, nil
+	}
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return nil, fmt.Errorf("failed to read password from stdin: %w", err)
+	}
+	return []byte(strings.TrimRight(line, "\r\n")), nil
+}
+
+// decryptFile reads and decrypts a local backup file
+func decryptFile(path string, key []byte) ([]byte, error) {
+	encrypted, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read backup file: %w", err)
+	}
+
+	decrypted, err := crypto.Decrypt(key, encrypted)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt backup (wrong key or password?): %w", err)
+	}
+	return decrypted, nil
+}
+
+// DecryptCmd returns the decrypt command for turning a backup file into a plain archive
+func DecryptCmd() *cobra.Command {
+	var keyFlags offlineKeyFlags
+	var output string
+
+	cmd := &cobra.Command{
+		Use:   "decrypt <file.enc>",
+		Short: "Decrypt a backup file to a .tar.zst archive",
+		Long: `Decrypt a local backup file and write the zstd-compressed tar archive to stdout
+or to the file given with --output. This needs no configuration, storage access
+or Docker, so it works from a copy of the backups on any machine.
+
+The resulting archive can be unpacked with standard tools:
+  tar --zstd -xf out.tar.zst`,
+		Example: `  packrat decrypt gitea-2024-01-02T02-00-00Z.enc --key-file key > gitea.tar.zst
+  packrat decrypt gitea-2024-01-02T02-00-00Z.enc --password -o gitea.tar.zst`,
+		Args:        cobra.ExactArgs(1),
+		Annotations: map[string]string{AnnotationOffline: "true"},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if output == "" && term.IsTerminal(int(os.Stdout.Fd())) {
+				return fmt.Errorf("refusing to write archive data to a terminal: redirect stdout or use --output")
+			}
+
+			key, err := keyFlags.loadKey()
+			if err != nil {
+				return err
+			}
+
+			decrypted, err := decryptFile(args[0], key)
+			if err != nil {
+				return err
+			}
+
+			if output == "" {
+				if _, err := os.Stdout.Write(decrypted); err != nil {
+					return fmt.Errorf("failed to write archive: %w", err)
+				}
+				return nil
+			}
+
+			if err := os.WriteFile(output, decrypted, 0600); err != nil {
+				return fmt.Errorf("failed to write archive: %w", err)
+			}
+			fmt.Fprintf(os.Stderr, "Decrypted %s to %s\n", args[0], output)
+			return nil
+		},
+	}
+
+	keyFlags.register(cmd)
+	cmd.Flags().StringVarP(&output, "output", "o", "", "Write the archive to this file instead of stdout")
+
+	return cmd
+}
+
+// ExtractCmd returns the extract command for restoring a backup file without a configuration
+func ExtractCmd() *cobra.Command {
+	var keyFlags offlineKeyFlags
+	var output string
+	var opts backup.RestoreOptions
+
+	cmd := &cobra.Command{
+		Use:   "extract <file.enc> [path...]",
+		Short: "Decrypt and extract a backup file into a directory",
+		Long: `Decrypt a local backup file and extract it into the directory given with --output.
+This needs no configuration, storage access or Docker, so it can be used for disaster
+recovery from a copy of the backups on any machine.
+
+Optional paths limit the extraction to those files or directories within the backup.
+Ownership, permissions, timestamps and extended attributes are restored as recorded.`,
+		Example: `  packrat extract gitea-2024-01-02T02-00-00Z.enc --key-file key -o /srv/gitea
+  packrat extract gitea-2024-01-02T02-00-00Z.enc --password -o ./restore data/gitea.db`,
+		Args:        cobra.MinimumNArgs(1),
+		Annotations: map[string]string{AnnotationOffline: "true"},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			key, err := keyFlags.loadKey()
+			if err != nil {
+				return err
+			}
+
+			decrypted, err := decryptFile(args[0], key)
+			if err != nil {
+				return err
+			}
+
+			if err := os.MkdirAll(output, 0755); err != nil {
+				return fmt.Errorf("failed to create output directory: %w", err)
+			}
+
+			opts.Paths = args[1:]
+			if err := backup.ExtractArchive(bytes.NewReader(decrypted), output, opts); err != nil {
+				return fmt.Errorf("failed to extract archive: %w", err)
+			}
+
+			fmt.Printf("Extracted %s to %s\n", args[0], output)
+			return nil
+		},
+	}
+
+	keyFlags.register(cmd)
+	cmd.Flags().StringVarP(&output, "output", "o", "", "Directory to extract into")
+	cmd.Flags().BoolVar(&opts.SkipOwnership, "no-owner", false, "Don't restore file ownership (for extracting as a non-root user)")
+	cmd.Flags().BoolVar(&opts.NumericOwner, "numeric-owner", false, "Restore numeric uid/gid instead of mapping user and group names")
+	cmd.Flags().BoolVar(&opts.SkipXattrs, "no-xattrs", false, "Don't restore extended attributes, ACLs or SELinux labels")
+	cmd.MarkFlagRequired("output")
+
+	return cmd
+}
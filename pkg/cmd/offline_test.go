@@ -0,0 +1,301 @@
+package cmd
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/logandonley/packrat/pkg/crypto"
+)
+
+// testFiles are the regular files in the archive written by writeTestBackup
+var testFiles = map[string]string{
+	"data/app.db":     "database",
+	"data/uploads/a":  "upload",
+	"config/app.yaml": "port: 80",
+	"data-old/app.db": "old database",
+}
+
+// writeTestBackup writes an encrypted backup of testFiles, as packrat uploads
+// them, and returns its path and the plain archive
+func writeTestBackup(t *testing.T, key []byte) (string, []byte) {
+	t.Helper()
+	var archive bytes.Buffer
+	zw, err := zstd.NewWriter(&archive)
+	if err != nil {
+		t.Fatalf("Failed to create zstd writer: %v", err)
+	}
+	tw := tar.NewWriter(zw)
+	names := make([]string, 0, len(testFiles))
+	for name := range testFiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	dirs := make(map[string]bool)
+	for _, name := range names {
+		for dir := filepath.Dir(name); dir != "." && !dirs[dir]; dir = filepath.Dir(dir) {
+			dirs[dir] = true
+			if err := tw.WriteHeader(&tar.Header{Name: dir + "/", Typeflag: tar.TypeDir, Mode: 0755}); err != nil {
+				t.Fatalf("Failed to write tar header: %v", err)
+			}
+		}
+		data := testFiles[name]
+		if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(data))}); err != nil {
+			t.Fatalf("Failed to write tar header: %v", err)
+		}
+		if _, err := tw.Write([]byte(data)); err != nil {
+			t.Fatalf("Failed to write tar data: %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Failed to close tar writer: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("Failed to close zstd writer: %v", err)
+	}
+
+	encrypted, err := crypto.Encrypt(key, archive.Bytes())
+	if err != nil {
+		t.Fatalf("Failed to encrypt archive: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "app-2024-01-02T02-00-00Z.enc")
+	if err := os.WriteFile(path, encrypted, 0600); err != nil {
+		t.Fatalf("Failed to write backup: %v", err)
+	}
+	return path, archive.Bytes()
+}
+
+// writeDefaultKey saves a key where the offline commands look without
+// --key-file, under a new home directory
+func writeDefaultKey(t *testing.T, key []byte) {
+	t.Helper()
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	if err := crypto.SaveKey(key, []byte("salt"), filepath.Join(home, ".config", "packrat", "key")); err != nil {
+		t.Fatalf("Failed to save key: %v", err)
+	}
+}
+
+// pipePassword makes the password the next line on stdin
+func pipePassword(t *testing.T, password string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "stdin")
+	if err := os.WriteFile(path, []byte(password+"\n"), 0600); err != nil {
+		t.Fatalf("Failed to write stdin: %v", err)
+	}
+	stdin, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open stdin: %v", err)
+	}
+	original := os.Stdin
+	os.Stdin = stdin
+	t.Cleanup(func() {
+		os.Stdin = original
+		stdin.Close()
+	})
+}
+
+// readTree returns the regular files under dir and their contents
+func readTree(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	files := make(map[string]string)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		files[rel] = string(data)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to read %s: %v", dir, err)
+	}
+	return files
+}
+
+func TestDecryptCmd(t *testing.T) {
+	key := []byte("testkey0123456789012345678901234")
+	passwordKey, _, err := crypto.DeriveKey("correct horse")
+	if err != nil {
+		t.Fatalf("Failed to derive key: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		key     []byte // The backup is encrypted with
+		setup   func(t *testing.T) []string
+		wantErr string
+	}{
+		{
+			name: "default key file",
+			key:  key,
+			setup: func(t *testing.T) []string {
+				writeDefaultKey(t, key)
+				return nil
+			},
+		},
+		{
+			name: "key file",
+			key:  key,
+			setup: func(t *testing.T) []string {
+				t.Setenv("HOME", t.TempDir())
+				path := filepath.Join(t.TempDir(), "key")
+				if err := crypto.SaveKey(key, []byte("salt"), path); err != nil {
+					t.Fatalf("Failed to save key: %v", err)
+				}
+				return []string{"--key-file", path}
+			},
+		},
+		{
+			name: "password",
+			key:  passwordKey,
+			setup: func(t *testing.T) []string {
+				t.Setenv("HOME", t.TempDir())
+				pipePassword(t, "correct horse")
+				return []string{"--password"}
+			},
+		},
+		{
+			name: "wrong password",
+			key:  passwordKey,
+			setup: func(t *testing.T) []string {
+				pipePassword(t, "battery staple")
+				return []string{"--password"}
+			},
+			wantErr: "wrong key or password",
+		},
+		{
+			name: "no key file",
+			key:  key,
+			setup: func(t *testing.T) []string {
+				t.Setenv("HOME", t.TempDir())
+				return nil
+			},
+			wantErr: "pass --key-file or --password",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backupPath, archive := writeTestBackup(t, tt.key)
+			output := filepath.Join(t.TempDir(), "app.tar.zst")
+
+			cmd := DecryptCmd()
+			cmd.SetArgs(append([]string{backupPath, "--output", output}, tt.setup(t)...))
+			cmd.SilenceUsage = true
+			err := cmd.Execute()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("decrypt error = %v, want %q", err, tt.wantErr)
+				}
+				if _, err := os.Stat(output); !os.IsNotExist(err) {
+					t.Errorf("decrypt wrote %s after failing", output)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decrypt failed: %v", err)
+			}
+			got, err := os.ReadFile(output)
+			if err != nil {
+				t.Fatalf("Failed to read the archive: %v", err)
+			}
+			if !bytes.Equal(got, archive) {
+				t.Error("The decrypted archive doesn't match the one that was encrypted")
+			}
+		})
+	}
+}
+
+func TestExtractCmd(t *testing.T) {
+	key := []byte("testkey0123456789012345678901234")
+	passwordKey, _, err := crypto.DeriveKey("correct horse")
+	if err != nil {
+		t.Fatalf("Failed to derive key: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		key       []byte // The backup is encrypted with
+		password  bool
+		paths     []string
+		wantFiles []string
+	}{
+		{
+			name:      "everything",
+			key:       key,
+			wantFiles: []string{"config/app.yaml", "data-old/app.db", "data/app.db", "data/uploads/a"},
+		},
+		{
+			name:      "password",
+			key:       passwordKey,
+			password:  true,
+			wantFiles: []string{"config/app.yaml", "data-old/app.db", "data/app.db", "data/uploads/a"},
+		},
+		{
+			// data-old shares the prefix, but isn't in data
+			name:      "directory",
+			key:       key,
+			paths:     []string{"data"},
+			wantFiles: []string{"data/app.db", "data/uploads/a"},
+		},
+		{
+			name:      "files",
+			key:       key,
+			paths:     []string{"data/uploads/a", "config/app.yaml"},
+			wantFiles: []string{"config/app.yaml", "data/uploads/a"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writeDefaultKey(t, key)
+			backupPath, _ := writeTestBackup(t, tt.key)
+			// The output directory is created as needed
+			output := filepath.Join(t.TempDir(), "restore", "app")
+
+			args := []string{backupPath, "--output", output, "--no-owner"}
+			if tt.password {
+				pipePassword(t, "correct horse")
+				args = append(args, "--password")
+			}
+			cmd := ExtractCmd()
+			cmd.SetArgs(append(args, tt.paths...))
+			cmd.SilenceUsage = true
+			if err := cmd.Execute(); err != nil {
+				t.Fatalf("extract failed: %v", err)
+			}
+
+			files := readTree(t, output)
+			var names []string
+			for name, data := range files {
+				names = append(names, name)
+				if data != testFiles[name] {
+					t.Errorf("%s = %q, want %q", name, data, testFiles[name])
+				}
+			}
+			sort.Strings(names)
+			if strings.Join(names, ",") != strings.Join(tt.wantFiles, ",") {
+				t.Errorf("Extracted %q, want %q", names, tt.wantFiles)
+			}
+		})
+	}
+
+	// There's no default for where to extract to
+	cmd := ExtractCmd()
+	cmd.SetArgs([]string{"app-2024-01-02T02-00-00Z.enc"})
+	cmd.SilenceUsage = true
+	if err := cmd.Execute(); err == nil || !strings.Contains(err.Error(), "output") {
+		t.Errorf("extract without --output = %v, want an error about it", err)
+	}
+}
@@ -3,6 +3,9 @@ package config
 import (
 	"fmt"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 
 	"gopkg.in/yaml.v3"
 )
@@ -16,6 +19,103 @@ type Config struct {
 	Services map[string]Service `yaml:"services" mapstructure:"services"`
 
 	Backup BackupConfiguration `yaml:"backup" mapstructure:"backup"`
+
+	// ContainerEngine is how packrat reaches Docker or Podman
+	ContainerEngine ContainerEngine `yaml:"container_engine,omitempty" mapstructure:"container_engine,omitempty"`
+
+	// Discovery adds services declared with labels on Docker containers
+	Discovery Discovery `yaml:"discovery,omitempty" mapstructure:"discovery,omitempty"`
+
+	// Daemon tunes how the daemon runs scheduled jobs
+	Daemon Daemon `yaml:"daemon,omitempty" mapstructure:"daemon,omitempty"`
+
+	// StateDir holds local state such as container recovery records
+	// (default $XDG_STATE_HOME/packrat or ~/.local/state/packrat)
+	StateDir string `yaml:"state_dir,omitempty" mapstructure:"state_dir,omitempty"`
+}
+
+// ContainerEngine configures the Docker-compatible API packrat talks to
+type ContainerEngine struct {
+	// Host is the API endpoint, such as unix:///run/user/1000/docker.sock for
+	// rootless Docker or unix:///run/podman/podman.sock for Podman. By default
+	// DOCKER_HOST is used, then the first of the usual sockets that exists.
+	Host string `yaml:"host,omitempty" mapstructure:"host,omitempty"`
+	// APIVersion pins the API version instead of negotiating it with the engine
+	APIVersion string `yaml:"api_version,omitempty" mapstructure:"api_version,omitempty"`
+}
+
+// Daemon configures how the daemon runs scheduled jobs
+type Daemon struct {
+	// Overlap is what happens when a service's backup is due while its previous
+	// job is still running: skip it (default), or queue it to run afterwards
+	Overlap string `yaml:"overlap,omitempty" mapstructure:"overlap,omitempty"`
+
+	// MaxConcurrentJobs limits how many backups run at once (0 for no limit).
+	// Jobs over the limit wait in a queue ordered by service priority.
+	MaxConcurrentJobs int `yaml:"max_concurrent_jobs,omitempty" mapstructure:"max_concurrent_jobs,omitempty"`
+	// MaxConcurrentArchives and MaxConcurrentUploads limit the CPU-heavy archive
+	// and encryption stage and the upload stage separately (0 for no limit)
+	MaxConcurrentArchives int `yaml:"max_concurrent_archives,omitempty" mapstructure:"max_concurrent_archives,omitempty"`
+	MaxConcurrentUploads  int `yaml:"max_concurrent_uploads,omitempty" mapstructure:"max_concurrent_uploads,omitempty"`
+
+	// CatchUp is what the daemon does on startup about scheduled backups it
+	// missed while it wasn't running: nothing ("none", the default), run each
+	// such service once ("once"), or run it once if the missed run was no longer
+	// ago than CatchUpWindow ("within-window")
+	CatchUp       string `yaml:"catch_up,omitempty" mapstructure:"catch_up,omitempty"`
+	CatchUpWindow string `yaml:"catch_up_window,omitempty" mapstructure:"catch_up_window,omitempty"`
+	// CatchUpDelay is how long after startup the first catch-up backup starts,
+	// and how long after each other the rest start (default 1m)
+	CatchUpDelay string `yaml:"catch_up_delay,omitempty" mapstructure:"catch_up_delay,omitempty"`
+
+	// API is the daemon's optional HTTP API
+	API DaemonAPI `yaml:"api,omitempty" mapstructure:"api,omitempty"`
+}
+
+// DaemonAPI configures the daemon's HTTP API for status, manual triggers and health checks
+type DaemonAPI struct {
+	// Listen is a TCP address such as 127.0.0.1:8420, or a unix socket such as
+	// unix:///run/packrat/api.sock. The API is off when it's empty.
+	Listen string `yaml:"listen,omitempty" mapstructure:"listen,omitempty"`
+	// Token is the bearer token requests must send. It is required on a TCP
+	// address; on a unix socket, the socket's permissions can stand in for it.
+	Token string `yaml:"token,omitempty" mapstructure:"token,omitempty"`
+}
+
+// Daemon overlap policies
+const (
+	OverlapSkip  = "skip"
+	OverlapQueue = "queue"
+)
+
+// Daemon catch-up policies
+const (
+	CatchUpNone   = "none"
+	CatchUpOnce   = "once"
+	CatchUpWindow = "within-window"
+)
+
+// Discovery configures finding services from packrat.* container labels
+type Discovery struct {
+	Enabled bool `yaml:"enabled" mapstructure:"enabled"`
+}
+
+// StateDirectory returns the directory packrat keeps local state in
+func (c *Config) StateDirectory() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to get home directory: %w", err)
+	}
+
+	switch {
+	case strings.HasPrefix(c.StateDir, "~/"):
+		return filepath.Join(home, c.StateDir[2:]), nil
+	case c.StateDir != "":
+		return c.StateDir, nil
+	case os.Getenv("XDG_STATE_HOME") != "":
+		return filepath.Join(os.Getenv("XDG_STATE_HOME"), "packrat"), nil
+	}
+	return filepath.Join(home, ".local", "state", "packrat"), nil
 }
 
 // Service represents a service to be backed up
@@ -26,11 +126,123 @@ type Service struct {
 	Exclude       []string `yaml:"exclude,omitempty" mapstructure:"exclude,omitempty"`
 	RetainBackups *int     `yaml:"retain_backups,omitempty" mapstructure:"retain_backups,omitempty"`
 	PreBackup     *Command `yaml:"pre_backup,omitempty" mapstructure:"pre_backup,omitempty"`
+
+	// Priority orders queued jobs when the daemon limits concurrent jobs; higher runs first
+	Priority int `yaml:"priority,omitempty" mapstructure:"priority,omitempty"`
+
+	// PostBackup runs after every backup attempt, including failed ones
+	PostBackup *Command `yaml:"post_backup,omitempty" mapstructure:"post_backup,omitempty"`
+	// OnSuccess and OnFailure run last, depending on how the backup ended
+	OnSuccess *Command `yaml:"on_success,omitempty" mapstructure:"on_success,omitempty"`
+	OnFailure *Command `yaml:"on_failure,omitempty" mapstructure:"on_failure,omitempty"`
+
+	// PreRestore runs before a restore; PostRestore runs after it, whether or not it succeeded
+	PreRestore  *Command `yaml:"pre_restore,omitempty" mapstructure:"pre_restore,omitempty"`
+	PostRestore *Command `yaml:"post_restore,omitempty" mapstructure:"post_restore,omitempty"`
+
+	// Dumps are command outputs stored in the backup as files
+	Dumps []Dump `yaml:"dumps,omitempty" mapstructure:"dumps,omitempty"`
+}
+
+// Dump is a command whose stdout is stored in the backup as a file, without
+// being written to disk first
+type Dump struct {
+	// Name is the file's path in the backup, relative to .packrat/dumps
+	Name string `yaml:"name" mapstructure:"name"`
+	// Container runs the command inside this container ("container" for the
+	// service's own) instead of on the host
+	Container string `yaml:"container,omitempty" mapstructure:"container,omitempty"`
+
+	Command `yaml:",inline" mapstructure:",squash"`
+}
+
+// Location describes where a service's data lives, for display
+func (s Service) Location() string {
+	var parts []string
+	if s.Path != "" {
+		parts = append(parts, s.Path)
+	}
+	if s.Docker != nil && len(s.Docker.Volumes) > 0 {
+		parts = append(parts, "volumes "+strings.Join(s.Docker.Volumes, ", "))
+	}
+	return strings.Join(parts, " + ")
+}
+
+// Hook is a configured service hook with its config key
+type Hook struct {
+	Name    string
+	Command *Command
+}
+
+// Hooks returns the service's configured hooks in the order they run
+func (s Service) Hooks() []Hook {
+	var hooks []Hook
+	for _, h := range []Hook{
+		{"pre_backup", s.PreBackup},
+		{"post_backup", s.PostBackup},
+		{"on_success", s.OnSuccess},
+		{"on_failure", s.OnFailure},
+		{"pre_restore", s.PreRestore},
+		{"post_restore", s.PostRestore},
+	} {
+		if h.Command != nil {
+			hooks = append(hooks, h)
+		}
+	}
+	return hooks
 }
 
 // Docker represents Docker-specific configuration
 type Docker struct {
 	Container string `yaml:"container" mapstructure:"container"`
+
+	// Containers are additional containers to stop with Container
+	Containers []string `yaml:"containers,omitempty" mapstructure:"containers,omitempty"`
+	// ComposeProject stops every running container of a Docker Compose project
+	ComposeProject string `yaml:"compose_project,omitempty" mapstructure:"compose_project,omitempty"`
+	// Volumes are named Docker volumes backed up with the service, each stored
+	// under volumes/<name> in the archive
+	Volumes []string `yaml:"volumes,omitempty" mapstructure:"volumes,omitempty"`
+
+	// Mode is how containers are quiesced during a backup or restore: "stop"
+	// (the default), "pause" to freeze their processes, or "none"
+	Mode string `yaml:"mode,omitempty" mapstructure:"mode,omitempty"`
+	// StopTimeout is the grace period before a stopping container is killed (default 30s)
+	StopTimeout string `yaml:"stop_timeout,omitempty" mapstructure:"stop_timeout,omitempty"`
+	// StartTimeout is how long to wait for a started container to be running (default 2m)
+	StartTimeout string `yaml:"start_timeout,omitempty" mapstructure:"start_timeout,omitempty"`
+	// HealthTimeout is how long to wait for a container with a healthcheck to be healthy (default 2m)
+	HealthTimeout string `yaml:"health_timeout,omitempty" mapstructure:"health_timeout,omitempty"`
+}
+
+// Docker modes
+const (
+	DockerModeStop  = "stop"
+	DockerModePause = "pause"
+	DockerModeNone  = "none"
+)
+
+// Describe returns a short description of the containers for display
+func (d *Docker) Describe() string {
+	var parts []string
+	if names := d.ContainerNames(); len(names) > 0 {
+		parts = append(parts, strings.Join(names, ", "))
+	}
+	if d.ComposeProject != "" {
+		parts = append(parts, "compose project "+d.ComposeProject)
+	}
+	return strings.Join(parts, " + ")
+}
+
+// ContainerNames returns the explicitly named containers, without duplicates
+func (d *Docker) ContainerNames() []string {
+	var names []string
+	for _, name := range append([]string{d.Container}, d.Containers...) {
+		if name != "" && !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	return names
 }
 
 // Command represents a command to be executed
@@ -39,6 +251,12 @@ type Command struct {
 	WorkingDir  string            `yaml:"working_dir,omitempty" mapstructure:"working_dir,omitempty"`
 	Environment map[string]string `yaml:"environment,omitempty" mapstructure:"environment,omitempty"`
 	Timeout     string            `yaml:"timeout,omitempty" mapstructure:"timeout,omitempty"`
+
+	// ExecIn runs the command inside a running container instead of on the host:
+	// "container" for the service's own container, or the name of another one
+	ExecIn string `yaml:"exec_in,omitempty" mapstructure:"exec_in,omitempty"`
+	// User runs the command as this user inside the container (exec_in only)
+	User string `yaml:"user,omitempty" mapstructure:"user,omitempty"`
 }
 
 // BackupConfiguration represents backup-specific settings
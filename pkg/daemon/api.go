@@ -0,0 +1,365 @@
+package daemon
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/logandonley/packrat/pkg/backup"
+)
+
+// apiShutdownTimeout is how long Stop waits for API requests in flight
+const apiShutdownTimeout = 10 * time.Second
+
+// APIStatus is the daemon's status as reported by its API
+type APIStatus struct {
+	Status
+	Services []ServiceStatus `json:"services"`
+}
+
+// ServiceStatus is a service's schedule and how its last backup went
+type ServiceStatus struct {
+	Name     string     `json:"name"`
+	Schedule string     `json:"schedule,omitempty"`
+	Priority int        `json:"priority,omitempty"`
+	NextRun  *time.Time `json:"next_run,omitempty"`
+	// LastBackup is the last backup attempt, successful or not
+	LastBackup  *backup.HistoryEntry `json:"last_backup,omitempty"`
+	LastSuccess *time.Time           `json:"last_success,omitempty"`
+}
+
+// controlSocket is the daemon's socket in the state directory, which the CLI
+// uses to run jobs through a running daemon. It serves the API without a
+// token; its permissions keep other users out.
+const controlSocket = "daemon.sock"
+
+// startAPI serves the control socket, and the API if it's configured
+func (d *Daemon) startAPI() error {
+	control, err := d.serve("unix://"+filepath.Join(d.stateDir, controlSocket), d.apiHandler("", backup.TriggerManual))
+	if err != nil {
+		return fmt.Errorf("failed to serve the control socket: %w", err)
+	}
+	d.servers = append(d.servers, control)
+
+	api := d.config.Daemon.API
+	if api.Listen == "" {
+		return nil
+	}
+	if !strings.HasPrefix(api.Listen, "unix://") && api.Token == "" {
+		return fmt.Errorf("the daemon API on %s needs a token", api.Listen)
+	}
+	server, err := d.serve(api.Listen, d.apiHandler(api.Token, backup.TriggerAPI))
+	if err != nil {
+		return err
+	}
+	d.servers = append(d.servers, server)
+	log.Printf("Daemon API listening on %s", api.Listen)
+	return nil
+}
+
+// serve serves a handler on a TCP address or a unix:// socket
+func (d *Daemon) serve(listen string, handler http.Handler) (*http.Server, error) {
+	network, address := "tcp", listen
+	if path, ok := strings.CutPrefix(listen, "unix://"); ok {
+		network, address = "unix", path
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return nil, fmt.Errorf("failed to create socket directory: %w", err)
+		}
+		// A socket left by a daemon that was killed would make listening fail.
+		// Anything else at the path is left alone.
+		if info, err := os.Lstat(path); err == nil {
+			if info.Mode()&os.ModeSocket == 0 {
+				return nil, fmt.Errorf("cannot listen on %s: the path exists and is not a socket", path)
+			}
+			if err := os.Remove(path); err != nil {
+				return nil, fmt.Errorf("failed to remove stale socket: %w", err)
+			}
+		} else if !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to check socket path: %w", err)
+		}
+	}
+
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", listen, err)
+	}
+	if network == "unix" {
+		if err := os.Chmod(address, 0600); err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("failed to restrict socket permissions: %w", err)
+		}
+	}
+
+	server := &http.Server{Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("ERROR: stopped serving %s: %v", listen, err)
+		}
+	}()
+	return server, nil
+}
+
+// stopAPI stops serving the control socket and the API, giving requests in
+// flight a moment to finish
+func (d *Daemon) stopAPI() {
+	ctx, cancel := context.WithTimeout(context.Background(), apiShutdownTimeout)
+	defer cancel()
+	for _, server := range d.servers {
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("Warning: failed to stop the daemon API cleanly: %v", err)
+		}
+	}
+}
+
+// apiHandler serves the API. Requests other than health checks need the
+// token, if there is one, and backups they start are recorded with trigger.
+func (d *Daemon) apiHandler(token, trigger string) http.Handler {
+	auth := func(handler http.HandlerFunc) http.Handler {
+		return authorized(token, handler)
+	}
+	mux := http.NewServeMux()
+	// Health checks don't need the token, so container healthchecks and load
+	// balancers can use them as they are
+	mux.HandleFunc("GET /healthz", d.handleHealth)
+	mux.Handle("GET /status", auth(d.handleStatus))
+	mux.Handle("GET /history", auth(d.handleHistory))
+	mux.Handle("POST /cleanup", auth(d.handleCleanup))
+	mux.Handle("POST /services/{name}/backup", auth(func(w http.ResponseWriter, r *http.Request) {
+		d.handleBackup(w, r, trigger)
+	}))
+	mux.Handle("POST /services/{name}/verify", auth(d.handleVerify))
+	return mux
+}
+
+// authorized requires a bearer token, unless it's empty
+func authorized(token string, handler http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token != "" {
+			got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				writeError(w, http.StatusUnauthorized, errors.New("missing or invalid token"))
+				return
+			}
+		}
+		handler(w, r)
+	})
+}
+
+func (d *Daemon) handleHealth(w http.ResponseWriter, r *http.Request) {
+	if d.ctx.Err() != nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "stopping"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func (d *Daemon) handleStatus(w http.ResponseWriter, r *http.Request) {
+	history, err := backup.ReadHistory(d.stateDir, "", time.Time{})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	lastBackup := make(map[string]backup.HistoryEntry)
+	for _, entry := range history {
+		if entry.Operation == "backup" {
+			lastBackup[entry.Service] = entry
+		}
+	}
+
+	status := APIStatus{
+		Status: Status{
+			PID:               os.Getpid(),
+			Started:           d.started,
+			MaxConcurrentJobs: d.config.Daemon.MaxConcurrentJobs,
+			Jobs:              d.queue.jobs(),
+		},
+	}
+	d.mu.Lock()
+	for name, service := range d.manager.GetServices() {
+		s := ServiceStatus{Name: name, Schedule: service.Schedule, Priority: service.Priority}
+		if entry := d.scheduled[name]; entry.id != 0 {
+			if next := d.cron.Entry(entry.id).Next; !next.IsZero() {
+				s.NextRun = &next
+			}
+		}
+		if entry, ok := lastBackup[name]; ok {
+			s.LastBackup = &entry
+		}
+		if last, err := backup.LastSuccess(d.stateDir, name); err == nil && !last.IsZero() {
+			s.LastSuccess = &last
+		}
+		status.Services = append(status.Services, s)
+	}
+	d.mu.Unlock()
+	sort.Slice(status.Services, func(i, j int) bool {
+		return status.Services[i].Name < status.Services[j].Name
+	})
+
+	writeJSON(w, http.StatusOK, status)
+}
+
+// handleHistory returns the run history, optionally limited with the service
+// and since parameters. since is a duration before now or an RFC 3339 time.
+func (d *Daemon) handleHistory(w http.ResponseWriter, r *http.Request) {
+	var since time.Time
+	if value := r.URL.Query().Get("since"); value != "" {
+		if ago, err := time.ParseDuration(value); err == nil {
+			if ago < 0 {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("invalid since %q: the duration can't be negative", value))
+				return
+			}
+			since = time.Now().Add(-ago)
+		} else if since, err = time.Parse(time.RFC3339, value); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid since %q: use a duration or an RFC 3339 time", value))
+			return
+		}
+	}
+
+	entries, err := backup.ReadHistory(d.stateDir, r.URL.Query().Get("service"), since)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if entries == nil {
+		entries = []backup.HistoryEntry{}
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// JobEvent is a line of the stream a backup started with wait=true returns:
+// the daemon's log entries while the backup runs, then its outcome
+type JobEvent struct {
+	Log   string `json:"log,omitempty"`
+	Done  bool   `json:"done,omitempty"`
+	Error string `json:"error,omitempty"`
+	// Running is set if the backup didn't run because another job for the service was
+	Running *backup.JobRunningError `json:"running,omitempty"`
+}
+
+// handleBackup starts a backup of a service. Without the wait parameter it
+// returns at once, and the backup can be followed with /status and /history.
+// With it, the daemon's log is streamed as JSON lines until the backup ends.
+// The log is the whole daemon's, so with several jobs running it has their
+// entries too.
+func (d *Daemon) handleBackup(w http.ResponseWriter, r *http.Request, trigger string) {
+	name := r.PathValue("name")
+	if _, ok := d.manager.GetServices()[name]; !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("service %s not found", name))
+		return
+	}
+	wait := r.URL.Query().Get("wait") == "true"
+
+	var lines <-chan string
+	if wait {
+		var unsubscribe func()
+		lines, unsubscribe = d.logs.subscribe()
+		defer unsubscribe()
+	}
+	done, err := d.TriggerBackup(name, trigger)
+	if err != nil {
+		var running *backup.JobRunningError
+		if errors.As(err, &running) {
+			writeJSON(w, http.StatusConflict, JobEvent{Error: err.Error(), Running: running})
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !wait {
+		writeJSON(w, http.StatusAccepted, map[string]string{"service": name, "status": "started"})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	send := func(event JobEvent) {
+		enc.Encode(event)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	for {
+		select {
+		case line := <-lines:
+			send(JobEvent{Log: strings.TrimSuffix(line, "\n")})
+		case err := <-done:
+			// Entries logged before the backup ended may still be waiting
+			for drained := false; !drained; {
+				select {
+				case line := <-lines:
+					send(JobEvent{Log: strings.TrimSuffix(line, "\n")})
+				default:
+					drained = true
+				}
+			}
+			event := JobEvent{Done: true}
+			if err != nil {
+				event.Error = err.Error()
+				errors.As(err, &event.Running)
+			}
+			send(event)
+			return
+		case <-r.Context().Done():
+			// The client went away; the backup carries on without it
+			return
+		}
+	}
+}
+
+// handleCleanup removes old backups of the service named by the service
+// parameter, or of every service without it
+func (d *Daemon) handleCleanup(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("service")
+	if _, ok := d.manager.GetServices()[name]; name != "" && !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("service %s not found", name))
+		return
+	}
+	deleted, err := d.manager.CleanupBackups(name)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, deleted)
+}
+
+// handleVerify verifies a service's latest backup, or the one named by the
+// backup parameter, from the storage named by the source parameter if given
+func (d *Daemon) handleVerify(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if _, ok := d.manager.GetServices()[name]; !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("service %s not found", name))
+		return
+	}
+	result, err := d.manager.VerifyBackup(name, r.URL.Query().Get("backup"), r.URL.Query().Get("source"))
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	// The client has gone away if this fails, so there's no one left to tell
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,360 @@
+package daemon
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/logandonley/packrat/pkg/backup"
+	"github.com/logandonley/packrat/pkg/config"
+	"github.com/logandonley/packrat/pkg/storage"
+)
+
+// memStorage keeps backups in memory. The daemon runs jobs concurrently, so
+// it is safe for concurrent use.
+type memStorage struct {
+	mu    sync.Mutex
+	files map[string][]byte
+}
+
+func (m *memStorage) Upload(localPath, remoteName string) error {
+	data, err := os.ReadFile(localPath)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.files[remoteName] = data
+	return nil
+}
+
+func (m *memStorage) Download(remoteName, localPath string) error {
+	m.mu.Lock()
+	data, ok := m.files[remoteName]
+	m.mu.Unlock()
+	if !ok {
+		return os.ErrNotExist
+	}
+	return os.WriteFile(localPath, data, 0600)
+}
+
+func (m *memStorage) List(prefix string) ([]storage.BackupFile, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var files []storage.BackupFile
+	for name, data := range m.files {
+		if strings.HasPrefix(name, prefix) {
+			files = append(files, storage.BackupFile{
+				Name:    name,
+				Size:    int64(len(data)),
+				ModTime: time.Now().UTC().Format("2006-01-02 15:04:05 UTC"),
+			})
+		}
+	}
+	return files, nil
+}
+
+func (m *memStorage) Delete(remoteName string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.files, remoteName)
+	return nil
+}
+
+func (m *memStorage) Close() error {
+	return nil
+}
+
+// startDaemon starts a daemon backing up an "app" service from a temporary
+// directory and a "broken" one whose directory doesn't exist, stopping it
+// when the test ends
+func startDaemon(t *testing.T) *Daemon {
+	t.Helper()
+	dataDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dataDir, "data.txt"), []byte("data"), 0600); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	cfg := &config.Config{
+		Services: map[string]config.Service{
+			"app":    {Path: dataDir},
+			"broken": {Path: filepath.Join(dataDir, "missing")},
+		},
+		StateDir: t.TempDir(),
+	}
+	cfg.Backup.RetainBackups = 5
+
+	manager, err := backup.NewManagerWithStorage(cfg, []byte("testkey0123456789012345678901234"), &memStorage{files: make(map[string][]byte)}, nil)
+	if err != nil {
+		t.Fatalf("Failed to create manager: %v", err)
+	}
+	d := New(cfg, manager)
+	if err := d.Start(); err != nil {
+		t.Fatalf("Failed to start daemon: %v", err)
+	}
+	t.Cleanup(d.Stop)
+	return d
+}
+
+// request sends a request to the API with a token, if it isn't empty
+func request(t *testing.T, server *httptest.Server, method, path, token string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, server.URL+path, nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("%s %s failed: %v", method, path, err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+// readEvents reads a backup's stream of job events until it ends
+func readEvents(t *testing.T, resp *http.Response) []JobEvent {
+	t.Helper()
+	var events []JobEvent
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		var event JobEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("Failed to parse event %q: %v", scanner.Text(), err)
+		}
+		events = append(events, event)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatalf("Failed to read events: %v", err)
+	}
+	return events
+}
+
+func TestAPIAuth(t *testing.T) {
+	d := startDaemon(t)
+	server := httptest.NewServer(d.apiHandler("secret", backup.TriggerAPI))
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		path     string
+		header   string
+		wantCode int
+	}{
+		{name: "health check without a token", path: "/healthz", wantCode: http.StatusOK},
+		{name: "no token", path: "/status", wantCode: http.StatusUnauthorized},
+		{name: "wrong token", path: "/status", header: "Bearer wrong", wantCode: http.StatusUnauthorized},
+		{name: "not a bearer token", path: "/status", header: "Basic secret", wantCode: http.StatusUnauthorized},
+		{name: "token", path: "/status", header: "Bearer secret", wantCode: http.StatusOK},
+		{name: "history without a token", path: "/history", wantCode: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, server.URL+tt.path, nil)
+			if err != nil {
+				t.Fatalf("Failed to create request: %v", err)
+			}
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			resp, err := server.Client().Do(req)
+			if err != nil {
+				t.Fatalf("GET %s failed: %v", tt.path, err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != tt.wantCode {
+				t.Errorf("GET %s = %d, want %d", tt.path, resp.StatusCode, tt.wantCode)
+			}
+			if tt.wantCode == http.StatusUnauthorized && resp.Header.Get("WWW-Authenticate") != "Bearer" {
+				t.Errorf("WWW-Authenticate = %q, want Bearer", resp.Header.Get("WWW-Authenticate"))
+			}
+		})
+	}
+
+	// Without a token, as on the control socket, nothing needs one
+	open := httptest.NewServer(d.apiHandler("", backup.TriggerManual))
+	defer open.Close()
+	if resp := request(t, open, http.MethodGet, "/status", ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("GET /status without a token configured = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+}
+
+func TestAPIStatus(t *testing.T) {
+	d := startDaemon(t)
+	server := httptest.NewServer(d.apiHandler("", backup.TriggerManual))
+	defer server.Close()
+
+	resp := request(t, server, http.MethodGet, "/status", "")
+	var status APIStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		t.Fatalf("Failed to parse status: %v", err)
+	}
+	if status.PID != os.Getpid() {
+		t.Errorf("PID = %d, want %d", status.PID, os.Getpid())
+	}
+	var names []string
+	for _, s := range status.Services {
+		names = append(names, s.Name)
+	}
+	if strings.Join(names, ",") != "app,broken" {
+		t.Errorf("Services = %q, want app and broken", names)
+	}
+}
+
+func TestAPINotFound(t *testing.T) {
+	d := startDaemon(t)
+	server := httptest.NewServer(d.apiHandler("", backup.TriggerManual))
+	defer server.Close()
+
+	for _, tt := range []struct{ method, path string }{
+		{http.MethodPost, "/services/missing/backup"},
+		{http.MethodPost, "/services/missing/backup?wait=true"},
+		{http.MethodPost, "/services/missing/verify"},
+		{http.MethodPost, "/cleanup?service=missing"},
+	} {
+		if resp := request(t, server, tt.method, tt.path, ""); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%s %s = %d, want %d", tt.method, tt.path, resp.StatusCode, http.StatusNotFound)
+		}
+	}
+}
+
+func TestAPIBackupRunning(t *testing.T) {
+	d := startDaemon(t)
+	server := httptest.NewServer(d.apiHandler("", backup.TriggerManual))
+	defer server.Close()
+
+	// A backup of the service is already underway
+	d.mu.Lock()
+	d.jobs["app"] = &jobState{running: true}
+	d.mu.Unlock()
+
+	for _, path := range []string{"/services/app/backup", "/services/app/backup?wait=true"} {
+		resp := request(t, server, http.MethodPost, path, "")
+		if resp.StatusCode != http.StatusConflict {
+			t.Errorf("POST %s = %d, want %d", path, resp.StatusCode, http.StatusConflict)
+			continue
+		}
+		var event JobEvent
+		if err := json.NewDecoder(resp.Body).Decode(&event); err != nil {
+			t.Fatalf("Failed to parse response: %v", err)
+		}
+		if event.Running == nil || event.Running.Service != "app" || event.Running.PID != os.Getpid() {
+			t.Errorf("POST %s: running = %+v, want this daemon's backup of app", path, event.Running)
+		}
+	}
+}
+
+func TestAPIBackupWait(t *testing.T) {
+	d := startDaemon(t)
+	server := httptest.NewServer(d.apiHandler("secret", backup.TriggerAPI))
+	defer server.Close()
+
+	resp := request(t, server, http.MethodPost, "/services/app/backup?wait=true", "secret")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST /services/app/backup?wait=true = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if got := resp.Header.Get("Content-Type"); got != "application/x-ndjson" {
+		t.Errorf("Content-Type = %q, want application/x-ndjson", got)
+	}
+	events := readEvents(t, resp)
+	if len(events) == 0 {
+		t.Fatal("No events streamed")
+	}
+	var logged bool
+	for _, event := range events[:len(events)-1] {
+		if event.Done {
+			t.Errorf("Event %+v is done before the last one", event)
+		}
+		if strings.Contains(event.Log, "Starting API-requested backup for service: app") {
+			logged = true
+		}
+	}
+	if !logged {
+		t.Errorf("The backup's log wasn't streamed: %+v", events)
+	}
+	if last := events[len(events)-1]; !last.Done || last.Error != "" {
+		t.Errorf("Last event = %+v, want a successful end", last)
+	}
+
+	history, err := backup.ReadHistory(d.stateDir, "app", time.Time{})
+	if err != nil {
+		t.Fatalf("Failed to read history: %v", err)
+	}
+	if len(history) != 1 || history[0].Trigger != backup.TriggerAPI || !history[0].Succeeded() {
+		t.Errorf("History = %+v, want one successful API-triggered backup", history)
+	}
+
+	// A failed backup ends the stream with its error
+	resp = request(t, server, http.MethodPost, "/services/broken/backup?wait=true", "secret")
+	events = readEvents(t, resp)
+	if len(events) == 0 {
+		t.Fatal("No events streamed for the failing backup")
+	}
+	if last := events[len(events)-1]; !last.Done || last.Error == "" {
+		t.Errorf("Last event = %+v, want a failed end", last)
+	}
+}
+
+func TestAPIHistorySince(t *testing.T) {
+	d := startDaemon(t)
+	server := httptest.NewServer(d.apiHandler("", backup.TriggerManual))
+	defer server.Close()
+
+	tests := []struct {
+		since    string
+		wantCode int
+	}{
+		{since: "", wantCode: http.StatusOK},
+		{since: "1h", wantCode: http.StatusOK},
+		{since: "2024-01-01T00:00:00Z", wantCode: http.StatusOK},
+		{since: "-1h", wantCode: http.StatusBadRequest},
+		{since: "yesterday", wantCode: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		resp := request(t, server, http.MethodGet, "/history?since="+tt.since, "")
+		if resp.StatusCode != tt.wantCode {
+			t.Errorf("GET /history?since=%s = %d, want %d", tt.since, resp.StatusCode, tt.wantCode)
+		}
+	}
+}
+
+func TestServeSocketPath(t *testing.T) {
+	d := New(&config.Config{}, nil)
+	defer d.wg.Wait()
+	dir := t.TempDir()
+
+	// A file at the socket path is a configuration mistake, not a stale socket
+	file := filepath.Join(dir, "notes.txt")
+	if err := os.WriteFile(file, []byte("keep me"), 0600); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	if _, err := d.serve("unix://"+file, http.NotFoundHandler()); err == nil {
+		t.Error("Expected serving on a regular file to fail")
+	}
+	if data, err := os.ReadFile(file); err != nil || string(data) != "keep me" {
+		t.Errorf("The file at the socket path was changed: %q, %v", data, err)
+	}
+
+	// A socket left behind by a daemon that was killed is replaced
+	socket := filepath.Join(dir, "api.sock")
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: socket, Net: "unix"})
+	if err != nil {
+		t.Fatalf("Failed to create socket: %v", err)
+	}
+	listener.SetUnlinkOnClose(false)
+	listener.Close()
+	server, err := d.serve("unix://"+socket, http.NotFoundHandler())
+	if err != nil {
+		t.Fatalf("Failed to serve on a stale socket: %v", err)
+	}
+	server.Close()
+}
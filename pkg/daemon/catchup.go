@@ -0,0 +1,134 @@
+package daemon
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/logandonley/packrat/pkg/backup"
+	"github.com/logandonley/packrat/pkg/config"
+	"github.com/robfig/cron/v3"
+)
+
+// defaultCatchUpDelay spaces out catch-up backups so they don't all start as
+// the daemon does, along with everything else the host is starting
+const defaultCatchUpDelay = time.Minute
+
+// catchUpPolicy is the parsed catch-up configuration
+type catchUpPolicy struct {
+	mode   string
+	window time.Duration
+	delay  time.Duration
+}
+
+func parseCatchUp(cfg config.Daemon) (catchUpPolicy, error) {
+	policy := catchUpPolicy{mode: cfg.CatchUp, delay: defaultCatchUpDelay}
+	switch cfg.CatchUp {
+	case "", config.CatchUpNone:
+		policy.mode = config.CatchUpNone
+		return policy, nil
+	case config.CatchUpOnce:
+	case config.CatchUpWindow:
+		if cfg.CatchUpWindow == "" {
+			return policy, fmt.Errorf("catch_up %s needs a catch_up_window", config.CatchUpWindow)
+		}
+		window, err := time.ParseDuration(cfg.CatchUpWindow)
+		if err != nil || window <= 0 {
+			return policy, fmt.Errorf("invalid catch_up_window %q", cfg.CatchUpWindow)
+		}
+		policy.window = window
+	default:
+		return policy, fmt.Errorf("invalid daemon catch_up %q: use none, once or within-window", cfg.CatchUp)
+	}
+
+	if cfg.CatchUpDelay != "" {
+		delay, err := time.ParseDuration(cfg.CatchUpDelay)
+		if err != nil || delay < 0 {
+			return policy, fmt.Errorf("invalid catch_up_delay %q", cfg.CatchUpDelay)
+		}
+		policy.delay = delay
+	}
+	return policy, nil
+}
+
+// missedRun returns the first scheduled run of a service the daemon missed
+// since its last successful backup, within the catch-up window if there is
+// one. Services never backed up successfully have nothing to go by, so they
+// are left to their schedule.
+func (d *Daemon) missedRun(serviceName string, now time.Time) (time.Time, bool) {
+	d.mu.Lock()
+	entry, ok := d.scheduled[serviceName]
+	d.mu.Unlock()
+	if !ok || entry.id == 0 {
+		return time.Time{}, false
+	}
+
+	last, err := backup.LastSuccess(d.stateDir, serviceName)
+	if err != nil {
+		log.Printf("Warning: %v", err)
+		return time.Time{}, false
+	}
+	return d.catchUp.missed(d.cron.Entry(entry.id).Schedule, last, now)
+}
+
+// missed returns the first run of schedule between the last successful backup
+// and now that the policy catches up on
+func (p catchUpPolicy) missed(schedule cron.Schedule, last, now time.Time) (time.Time, bool) {
+	if p.mode == config.CatchUpNone || last.IsZero() {
+		return time.Time{}, false
+	}
+
+	from := last
+	if p.mode == config.CatchUpWindow && from.Before(now.Add(-p.window)) {
+		from = now.Add(-p.window)
+	}
+	missed := schedule.Next(from)
+	if missed.After(now) {
+		return time.Time{}, false
+	}
+	return missed, true
+}
+
+// catchUpMissed runs the scheduled backups missed while the daemon wasn't
+// running, once per service, highest priority first. The first starts after
+// the catch-up delay and the rest one delay after another, each through the
+// job queue like any scheduled run.
+func (d *Daemon) catchUpMissed() {
+	services := d.manager.GetServices()
+	now := time.Now()
+	var missed []string
+	for name := range services {
+		if at, ok := d.missedRun(name, now); ok {
+			log.Printf("Service %s missed its scheduled backup at %s", name, at.Format(time.DateTime))
+			missed = append(missed, name)
+		}
+	}
+	if len(missed) == 0 {
+		return
+	}
+	sort.Slice(missed, func(i, j int) bool {
+		if pi, pj := services[missed[i]].Priority, services[missed[j]].Priority; pi != pj {
+			return pi > pj
+		}
+		return missed[i] < missed[j]
+	})
+	log.Printf("Catching up on %d missed backup(s) in %s", len(missed), d.catchUp.delay)
+
+	for _, name := range missed {
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-time.After(d.catchUp.delay):
+		}
+		// A scheduled run may have backed the service up in the meantime
+		if _, ok := d.missedRun(name, time.Now()); !ok {
+			continue
+		}
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			d.scheduledBackup(name, backup.TriggerCatchUp)
+		}()
+	}
+}
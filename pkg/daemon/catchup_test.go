@@ -0,0 +1,93 @@
+package daemon
+
+import (
+	"testing"
+	"time"
+
+	"github.com/logandonley/packrat/pkg/config"
+	"github.com/robfig/cron/v3"
+)
+
+func TestParseCatchUp(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     config.Daemon
+		want    catchUpPolicy
+		wantErr bool
+	}{
+		{name: "default", cfg: config.Daemon{}, want: catchUpPolicy{mode: config.CatchUpNone, delay: defaultCatchUpDelay}},
+		{name: "none", cfg: config.Daemon{CatchUp: "none", CatchUpDelay: "garbage"}, want: catchUpPolicy{mode: config.CatchUpNone, delay: defaultCatchUpDelay}},
+		{name: "once", cfg: config.Daemon{CatchUp: "once"}, want: catchUpPolicy{mode: config.CatchUpOnce, delay: defaultCatchUpDelay}},
+		{name: "once with delay", cfg: config.Daemon{CatchUp: "once", CatchUpDelay: "5m"}, want: catchUpPolicy{mode: config.CatchUpOnce, delay: 5 * time.Minute}},
+		{name: "no delay", cfg: config.Daemon{CatchUp: "once", CatchUpDelay: "0s"}, want: catchUpPolicy{mode: config.CatchUpOnce}},
+		{name: "within window", cfg: config.Daemon{CatchUp: "within-window", CatchUpWindow: "24h"}, want: catchUpPolicy{mode: config.CatchUpWindow, window: 24 * time.Hour, delay: defaultCatchUpDelay}},
+		{name: "window missing", cfg: config.Daemon{CatchUp: "within-window"}, wantErr: true},
+		{name: "window invalid", cfg: config.Daemon{CatchUp: "within-window", CatchUpWindow: "a day"}, wantErr: true},
+		{name: "window zero", cfg: config.Daemon{CatchUp: "within-window", CatchUpWindow: "0s"}, wantErr: true},
+		{name: "window negative", cfg: config.Daemon{CatchUp: "within-window", CatchUpWindow: "-1h"}, wantErr: true},
+		{name: "delay invalid", cfg: config.Daemon{CatchUp: "once", CatchUpDelay: "soon"}, wantErr: true},
+		{name: "delay negative", cfg: config.Daemon{CatchUp: "once", CatchUpDelay: "-1m"}, wantErr: true},
+		{name: "unknown mode", cfg: config.Daemon{CatchUp: "always"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseCatchUp(tt.cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseCatchUp() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("parseCatchUp() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCatchUpMissed(t *testing.T) {
+	// Daily at 02:00 UTC
+	schedule, err := cron.ParseStandard("0 2 * * *")
+	if err != nil {
+		t.Fatalf("Failed to parse schedule: %v", err)
+	}
+	at := func(value string) time.Time {
+		t.Helper()
+		parsed, err := time.Parse(time.DateTime, value)
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %v", value, err)
+		}
+		return parsed
+	}
+	once := catchUpPolicy{mode: config.CatchUpOnce}
+	window := catchUpPolicy{mode: config.CatchUpWindow, window: 12 * time.Hour}
+	now := at("2024-01-10 08:00:00")
+
+	tests := []struct {
+		name   string
+		policy catchUpPolicy
+		last   time.Time
+		want   time.Time // Zero if nothing was missed
+	}{
+		{name: "none", policy: catchUpPolicy{mode: config.CatchUpNone}, last: at("2024-01-05 02:00:00")},
+		{name: "never backed up", policy: once},
+		{name: "up to date", policy: once, last: at("2024-01-10 02:00:00")},
+		{name: "ran late", policy: once, last: at("2024-01-10 02:30:00")},
+		{name: "missed one run", policy: once, last: at("2024-01-09 02:00:00"), want: at("2024-01-10 02:00:00")},
+		{name: "missed several runs", policy: once, last: at("2024-01-05 02:00:00"), want: at("2024-01-06 02:00:00")},
+		{name: "window: missed run inside it", policy: window, last: at("2024-01-09 02:00:00"), want: at("2024-01-10 02:00:00")},
+		{name: "window: old backup is clamped to the window", policy: window, last: at("2024-01-01 02:00:00"), want: at("2024-01-10 02:00:00")},
+		{name: "window: missed run before it", policy: catchUpPolicy{mode: config.CatchUpWindow, window: 4 * time.Hour}, last: at("2024-01-09 02:00:00")},
+		{name: "window: up to date", policy: window, last: at("2024-01-10 02:00:00")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := tt.policy.missed(schedule, tt.last, now)
+			if ok != !tt.want.IsZero() || !got.Equal(tt.want) {
+				t.Errorf("missed() = %v, %v; want %v", got, ok, tt.want)
+			}
+		})
+	}
+
+	// A run due exactly now counts as missed
+	if got, ok := once.missed(schedule, at("2024-01-09 02:00:00"), at("2024-01-10 02:00:00")); !ok || !got.Equal(at("2024-01-10 02:00:00")) {
+		t.Errorf("missed() at the scheduled time = %v, %v; want the run due now", got, ok)
+	}
+}
@@ -0,0 +1,166 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/logandonley/packrat/pkg/backup"
+)
+
+// connectTimeout is how long Connect waits for the control socket to answer
+const connectTimeout = 2 * time.Second
+
+// Client runs commands through a running daemon's control socket
+type Client struct {
+	http *http.Client
+}
+
+// Connect returns a client for the daemon keeping its state in stateDir. It
+// returns ErrNotRunning if no daemon is running there.
+func Connect(stateDir string) (*Client, error) {
+	if _, err := ReadStatus(stateDir); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(stateDir, controlSocket)
+	if _, err := os.Stat(path); err != nil {
+		// Daemons from before the control socket don't serve one
+		return nil, ErrNotRunning
+	}
+	// Nothing answers on a socket left by a daemon that was killed
+	conn, err := net.DialTimeout("unix", path, connectTimeout)
+	if err != nil {
+		return nil, ErrNotRunning
+	}
+	conn.Close()
+
+	return &Client{http: &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", path)
+		},
+	}}}, nil
+}
+
+// Status returns the daemon's status, with its services
+func (c *Client) Status() (*APIStatus, error) {
+	var status APIStatus
+	if err := c.call(http.MethodGet, "/status", &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// Backup runs a backup through the daemon's job queue and waits for it to
+// finish, passing output each entry the daemon logs meanwhile
+func (c *Client) Backup(serviceName string, output func(string)) error {
+	resp, err := c.do(http.MethodPost, "/services/"+url.PathEscape(serviceName)+"/backup?wait=true")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var event JobEvent
+		if err := dec.Decode(&event); err != nil {
+			if errors.Is(err, io.EOF) {
+				return errors.New("the daemon closed the connection before the backup finished")
+			}
+			return fmt.Errorf("failed to read from the daemon: %w", err)
+		}
+		if !event.Done {
+			output(event.Log)
+			continue
+		}
+		if event.Running != nil {
+			return event.Running
+		}
+		if event.Error != "" {
+			return errors.New(event.Error)
+		}
+		return nil
+	}
+}
+
+// Cleanup removes old backups of a service, or of every service if
+// serviceName is empty, and returns how many were deleted, as CleanupBackups does
+func (c *Client) Cleanup(serviceName string) (map[string]int, error) {
+	path := "/cleanup"
+	if serviceName != "" {
+		path += "?service=" + url.QueryEscape(serviceName)
+	}
+	var deleted map[string]int
+	if err := c.call(http.MethodPost, path, &deleted); err != nil {
+		return nil, err
+	}
+	return deleted, nil
+}
+
+// Verify verifies a backup, as VerifyBackup does
+func (c *Client) Verify(serviceName, backupName, source string) (*backup.VerifyResult, error) {
+	query := url.Values{}
+	if backupName != "" {
+		query.Set("backup", backupName)
+	}
+	if source != "" {
+		query.Set("source", source)
+	}
+	path := "/services/" + url.PathEscape(serviceName) + "/verify"
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+	var result backup.VerifyResult
+	if err := c.call(http.MethodPost, path, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// call makes a request and decodes its JSON response into out
+func (c *Client) call(method, path string, out any) error {
+	resp, err := c.do(method, path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to read the daemon's response: %w", err)
+	}
+	return nil
+}
+
+// do makes a request, turning error responses into errors
+func (c *Client) do(method, path string) (*http.Response, error) {
+	req, err := http.NewRequest(method, "http://packrat"+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach the daemon: %w", err)
+	}
+	if resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	// Errors come as {"error": ...}, with the running job for conflicts, which
+	// is how a JobEvent decodes too
+	var event JobEvent
+	if err := json.NewDecoder(resp.Body).Decode(&event); err != nil || event.Error == "" {
+		return nil, fmt.Errorf("the daemon returned %s", resp.Status)
+	}
+	if event.Running != nil {
+		return nil, event.Running
+	}
+	return nil, errors.New(event.Error)
+}
@@ -0,0 +1,229 @@
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/logandonley/packrat/pkg/backup"
+)
+
+// writeTestStatus publishes a daemon status with a PID in stateDir
+func writeTestStatus(t *testing.T, stateDir string, pid int) {
+	t.Helper()
+	data, err := json.Marshal(Status{PID: pid})
+	if err != nil {
+		t.Fatalf("Failed to encode status: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(stateDir, statusFile), data, 0600); err != nil {
+		t.Fatalf("Failed to write status: %v", err)
+	}
+}
+
+// serveControlSocket serves a handler on the control socket in a new state
+// directory with a running daemon's status, and connects to it
+func serveControlSocket(t *testing.T, handler http.Handler) *Client {
+	t.Helper()
+	stateDir := t.TempDir()
+	writeTestStatus(t, stateDir, os.Getpid())
+	listener, err := net.Listen("unix", filepath.Join(stateDir, controlSocket))
+	if err != nil {
+		t.Fatalf("Failed to listen on the control socket: %v", err)
+	}
+	server := httptest.NewUnstartedServer(handler)
+	server.Listener = listener
+	server.Start()
+	t.Cleanup(server.Close)
+
+	client, err := Connect(stateDir)
+	if err != nil {
+		t.Fatalf("Connect() failed: %v", err)
+	}
+	return client
+}
+
+func TestConnectNotRunning(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(t *testing.T, stateDir string)
+	}{
+		{
+			name:  "no daemon",
+			setup: func(t *testing.T, stateDir string) {},
+		},
+		{
+			name: "daemon killed",
+			setup: func(t *testing.T, stateDir string) {
+				writeTestStatus(t, stateDir, 999999999)
+			},
+		},
+		{
+			name: "no socket",
+			setup: func(t *testing.T, stateDir string) {
+				writeTestStatus(t, stateDir, os.Getpid())
+			},
+		},
+		{
+			name: "stale socket",
+			setup: func(t *testing.T, stateDir string) {
+				writeTestStatus(t, stateDir, os.Getpid())
+				listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: filepath.Join(stateDir, controlSocket), Net: "unix"})
+				if err != nil {
+					t.Fatalf("Failed to listen on the control socket: %v", err)
+				}
+				// Leave the socket behind, as a killed daemon does
+				listener.SetUnlinkOnClose(false)
+				listener.Close()
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stateDir := t.TempDir()
+			tt.setup(t, stateDir)
+			if client, err := Connect(stateDir); !errors.Is(err, ErrNotRunning) {
+				t.Errorf("Connect() = %v, %v; want ErrNotRunning", client, err)
+			}
+		})
+	}
+}
+
+func TestClientBackup(t *testing.T) {
+	// stream writes events as a backup started with wait=true does
+	stream := func(events ...JobEvent) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost || r.URL.Path != "/services/app/backup" || r.URL.Query().Get("wait") != "true" {
+				t.Errorf("Unexpected request %s %s", r.Method, r.URL)
+			}
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			for _, event := range events {
+				json.NewEncoder(w).Encode(event)
+			}
+		}
+	}
+	running := &backup.JobRunningError{Service: "app", Operation: "backup", PID: 42}
+
+	tests := []struct {
+		name       string
+		handler    http.Handler
+		wantOutput []string
+		wantErr    string
+		wantPID    int // Of the running job, for conflicts
+	}{
+		{
+			name:       "success",
+			handler:    stream(JobEvent{Log: "starting"}, JobEvent{Log: "uploading"}, JobEvent{Done: true}),
+			wantOutput: []string{"starting", "uploading"},
+		},
+		{
+			name:       "failure",
+			handler:    stream(JobEvent{Log: "starting"}, JobEvent{Done: true, Error: "upload failed"}),
+			wantOutput: []string{"starting"},
+			wantErr:    "upload failed",
+		},
+		{
+			name:    "ran into a job of another process",
+			handler: stream(JobEvent{Done: true, Error: running.Error(), Running: running}),
+			wantErr: running.Error(),
+			wantPID: 42,
+		},
+		{
+			name:       "stream cut short",
+			handler:    stream(JobEvent{Log: "starting"}),
+			wantOutput: []string{"starting"},
+			wantErr:    "closed the connection",
+		},
+		{
+			name: "already running in the daemon",
+			handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				writeJSON(w, http.StatusConflict, JobEvent{Error: running.Error(), Running: running})
+			}),
+			wantErr: running.Error(),
+			wantPID: 42,
+		},
+		{
+			name: "unknown service",
+			handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				writeError(w, http.StatusNotFound, errors.New("service app not found"))
+			}),
+			wantErr: "service app not found",
+		},
+		{
+			name: "error without a body",
+			handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusBadGateway)
+			}),
+			wantErr: "502 Bad Gateway",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := serveControlSocket(t, tt.handler)
+			var output []string
+			err := client.Backup("app", func(line string) { output = append(output, line) })
+			if !reflect.DeepEqual(output, tt.wantOutput) {
+				t.Errorf("Output = %q, want %q", output, tt.wantOutput)
+			}
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("Backup() failed: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Backup() error = %v, want %q", err, tt.wantErr)
+			}
+			var jobRunning *backup.JobRunningError
+			if got := errors.As(err, &jobRunning); got != (tt.wantPID != 0) || (got && jobRunning.PID != tt.wantPID) {
+				t.Errorf("Backup() error = %#v, want a running job with pid %d: %v", err, tt.wantPID, got)
+			}
+		})
+	}
+}
+
+func TestClientDaemon(t *testing.T) {
+	d := startDaemon(t)
+	client, err := Connect(d.stateDir)
+	if err != nil {
+		t.Fatalf("Connect() failed: %v", err)
+	}
+
+	var output []string
+	if err := client.Backup("app", func(line string) { output = append(output, line) }); err != nil {
+		t.Fatalf("Backup() failed: %v", err)
+	}
+	if !strings.Contains(strings.Join(output, "\n"), "Successfully completed backup for service: app") {
+		t.Errorf("The daemon's log wasn't relayed: %q", output)
+	}
+	if err := client.Backup("broken", func(string) {}); err == nil {
+		t.Error("Expected the broken service's backup to fail")
+	}
+	if err := client.Backup("missing", func(string) {}); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("Backup() of a missing service = %v, want not found", err)
+	}
+
+	status, err := client.Status()
+	if err != nil {
+		t.Fatalf("Status() failed: %v", err)
+	}
+	for _, s := range status.Services {
+		if s.Name == "app" && (s.LastSuccess == nil || s.LastBackup == nil || s.LastBackup.Trigger != backup.TriggerManual) {
+			t.Errorf("Status of app = %+v, want its manual backup", s)
+		}
+	}
+
+	deleted, err := client.Cleanup("app")
+	if err != nil {
+		t.Fatalf("Cleanup() failed: %v", err)
+	}
+	if deleted["app_synology"] != 0 {
+		t.Errorf("Cleanup() = %v, want nothing deleted", deleted)
+	}
+}
@@ -2,9 +2,13 @@ package daemon
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"net/http"
+	"os"
 	"sync"
+	"time"
 
 	"github.com/logandonley/packrat/pkg/backup"
 	"github.com/logandonley/packrat/pkg/config"
@@ -19,71 +23,330 @@ type Daemon struct {
 	wg      sync.WaitGroup
 	ctx     context.Context
 	cancel  context.CancelFunc
+
+	mu        sync.Mutex
+	scheduled map[string]scheduledBackup // By service name
+	jobs      map[string]*jobState       // By service name
+
+	queue    *jobQueue
+	catchUp  catchUpPolicy
+	servers  []*http.Server
+	logs     *logBroadcaster
+	stateDir string
+	started  time.Time
+}
+
+// jobState tracks a service's scheduled backups, so they don't overlap
+type jobState struct {
+	running bool
+	queued  bool // Another run is due once the running one finishes
+}
+
+// errStopping is the error of a backup that didn't run because the daemon stopped first
+var errStopping = errors.New("the daemon stopped before the backup could run")
+
+// lockRetryDelay is how often a queued backup checks whether a job running in
+// another packrat process has finished
+const lockRetryDelay = 30 * time.Second
+
+// scheduledBackup is a service's cron entry. Services without a schedule
+// are tracked with a zero entry so they are only warned about once.
+type scheduledBackup struct {
+	id       cron.EntryID
+	schedule string
 }
 
 // New creates a new daemon instance
 func New(cfg *config.Config, manager *backup.Manager) *Daemon {
 	ctx, cancel := context.WithCancel(context.Background())
-	return &Daemon{
-		config:  cfg,
-		manager: manager,
-		cron:    cron.New(),
-		ctx:     ctx,
-		cancel:  cancel,
+	d := &Daemon{
+		config:    cfg,
+		manager:   manager,
+		cron:      cron.New(),
+		ctx:       ctx,
+		cancel:    cancel,
+		scheduled: make(map[string]scheduledBackup),
+		jobs:      make(map[string]*jobState),
 	}
+	d.queue = newJobQueue(cfg.Daemon.MaxConcurrentJobs, d.writeStatus)
+	return d
 }
 
 // Start initializes the daemon and starts scheduling backups
 func (d *Daemon) Start() error {
 	log.Println("Starting Packrat daemon...")
 
+	switch d.config.Daemon.Overlap {
+	case "", config.OverlapSkip, config.OverlapQueue:
+	default:
+		return fmt.Errorf("invalid daemon overlap %q: use skip or queue", d.config.Daemon.Overlap)
+	}
+	catchUp, err := parseCatchUp(d.config.Daemon)
+	if err != nil {
+		return err
+	}
+	d.catchUp = catchUp
+
+	stateDir, err := d.config.StateDirectory()
+	if err != nil {
+		return err
+	}
+	if status, err := ReadStatus(stateDir); err == nil && status.PID != os.Getpid() {
+		return fmt.Errorf("a packrat daemon is already running with state directory %s (pid %d)", stateDir, status.PID)
+	}
+	d.stateDir = stateDir
+	d.started = time.Now().UTC()
+	d.writeStatus(nil)
+
+	// Pass log entries on to CLI clients following their backups
+	d.logs = newLogBroadcaster(log.Writer())
+	log.SetOutput(d.logs)
+
+	// Bring back containers left down if packrat died in the middle of a job
+	if err := d.manager.RecoverContainers(); err != nil {
+		log.Printf("ERROR: %v", err)
+	}
+
 	// Schedule backups for each service
-	for name, service := range d.config.Services {
+	if err := d.syncSchedules(); err != nil {
+		return err
+	}
+
+	// Follow services declared by container labels as containers come and go
+	if d.config.Discovery.Enabled {
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			d.manager.WatchServices(d.ctx, func() {
+				if err := d.syncSchedules(); err != nil {
+					log.Printf("Error: %v", err)
+				}
+			})
+		}()
+	}
+
+	// Start the cron scheduler
+	d.cron.Start()
+
+	if err := d.startAPI(); err != nil {
+		return err
+	}
+	log.Println("Packrat daemon started successfully")
+
+	// Run the backups missed while the daemon was down
+	if d.catchUp.mode != config.CatchUpNone {
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			d.catchUpMissed()
+		}()
+	}
+
+	return nil
+}
+
+// syncSchedules makes the cron entries match the current services, adding
+// new ones, removing those that are gone and rescheduling changed ones
+func (d *Daemon) syncSchedules() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	services := d.manager.GetServices()
+	for name, entry := range d.scheduled {
+		if service, ok := services[name]; !ok || service.Schedule != entry.schedule {
+			if entry.id != 0 {
+				d.cron.Remove(entry.id)
+			}
+			delete(d.scheduled, name)
+			if !ok {
+				log.Printf("Unscheduled backup for removed service %s", name)
+			}
+		}
+	}
+
+	var errs []error
+	for name, service := range services {
+		if _, ok := d.scheduled[name]; ok {
+			continue
+		}
 		if service.Schedule == "" {
 			log.Printf("Warning: Service %s has no schedule configured, skipping", name)
+			d.scheduled[name] = scheduledBackup{}
 			continue
 		}
 
 		serviceName := name // Create a copy for the closure
-		_, err := d.cron.AddFunc(service.Schedule, func() {
-			log.Printf("Starting scheduled backup for service: %s", serviceName)
-			if err := d.manager.CreateBackup(serviceName); err != nil {
-				log.Printf("Error creating backup for service %s: %v", serviceName, err)
-				return
-			}
-			log.Printf("Successfully completed backup for service: %s", serviceName)
-
-			// Clean up old backups
-			deletedCounts, err := d.manager.CleanupBackups(serviceName)
-			if err != nil {
-				log.Printf("Error cleaning up old backups for service %s: %v", serviceName, err)
-				return
-			}
-			if count := deletedCounts[serviceName]; count > 0 {
-				log.Printf("Cleaned up %d old backup(s) for service: %s", count, serviceName)
-			}
+		id, err := d.cron.AddFunc(service.Schedule, func() {
+			d.scheduledBackup(serviceName, backup.TriggerCron)
 		})
-
 		if err != nil {
-			return fmt.Errorf("failed to schedule backup for service %s: %w", name, err)
+			errs = append(errs, fmt.Errorf("failed to schedule backup for service %s: %w", name, err))
+			continue
 		}
+		d.scheduled[name] = scheduledBackup{id: id, schedule: service.Schedule}
 
 		log.Printf("Scheduled backup for service %s with schedule: %s", name, service.Schedule)
 	}
+	return errors.Join(errs...)
+}
 
-	// Start the cron scheduler
-	d.cron.Start()
-	log.Println("Packrat daemon started successfully")
+// scheduledBackup runs a service's scheduled backup unless its previous one is
+// still running, in which case the overlap policy either skips this run or
+// queues it. At most one run is queued per service.
+func (d *Daemon) scheduledBackup(serviceName, trigger string) {
+	d.mu.Lock()
+	state, ok := d.jobs[serviceName]
+	if !ok {
+		state = &jobState{}
+		d.jobs[serviceName] = state
+	}
+	if state.running {
+		if d.config.Daemon.Overlap == config.OverlapQueue && !state.queued {
+			state.queued = true
+			log.Printf("Backup of service %s is still running, queueing the next one", serviceName)
+		} else {
+			log.Printf("Skipping scheduled backup of service %s: the previous one hasn't finished", serviceName)
+		}
+		d.mu.Unlock()
+		return
+	}
+	state.running = true
+	d.mu.Unlock()
+
+	d.runJobs(state, serviceName, trigger, nil)
+}
+
+// TriggerBackup starts a backup of a service now, through the job queue like
+// a scheduled one. The returned channel receives the backup's error, or nil,
+// once it has finished. TriggerBackup returns a *backup.JobRunningError if the
+// daemon is already running a backup of the service.
+func (d *Daemon) TriggerBackup(serviceName, trigger string) (<-chan error, error) {
+	if _, ok := d.manager.GetServices()[serviceName]; !ok {
+		return nil, fmt.Errorf("service %s not found", serviceName)
+	}
+
+	d.mu.Lock()
+	state, ok := d.jobs[serviceName]
+	if !ok {
+		state = &jobState{}
+		d.jobs[serviceName] = state
+	}
+	if state.running {
+		d.mu.Unlock()
+		return nil, &backup.JobRunningError{Service: serviceName, Operation: "backup", PID: os.Getpid()}
+	}
+	state.running = true
+	d.mu.Unlock()
+
+	done := make(chan error, 1)
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		d.runJobs(state, serviceName, trigger, done)
+	}()
+	return done, nil
+}
+
+// runJobs runs a service's backup, then the one queued while it ran, if any.
+// The first backup's error is sent to done, if it isn't nil.
+func (d *Daemon) runJobs(state *jobState, serviceName, trigger string, done chan<- error) {
+	for {
+		err := d.queueBackup(serviceName, trigger)
+		trigger = backup.TriggerCron // Queued runs are the schedule's
+		if done != nil {
+			done <- err
+			done = nil
+		}
 
+		d.mu.Lock()
+		if !state.queued || d.ctx.Err() != nil {
+			state.running, state.queued = false, false
+			d.mu.Unlock()
+			return
+		}
+		state.queued = false
+		d.mu.Unlock()
+	}
+}
+
+// queueBackup runs a service's backup once the job queue gives it a turn. If
+// another packrat process is running a job for the service, the backup is
+// skipped or, with the queue policy, queued again after a while, giving up its
+// slot meanwhile.
+func (d *Daemon) queueBackup(serviceName, trigger string) error {
+	var priority int
+	if service, ok := d.manager.GetServices()[serviceName]; ok {
+		priority = service.Priority
+	}
+
+	for {
+		var err error
+		if !d.queue.run(d.ctx, serviceName, priority, func() { err = d.runBackup(serviceName, trigger) }) {
+			return errStopping
+		}
+		if !backup.IsJobRunning(err) || d.config.Daemon.Overlap != config.OverlapQueue {
+			return err
+		}
+		select {
+		case <-d.ctx.Done():
+			return errStopping
+		case <-time.After(lockRetryDelay):
+		}
+	}
+}
+
+// runBackup backs up a service and cleans up its old backups. Failing to
+// clean up is only logged, since the backup itself succeeded.
+func (d *Daemon) runBackup(serviceName, trigger string) error {
+	log.Printf("Starting %s backup for service: %s", triggerName(trigger), serviceName)
+	if err := d.manager.CreateBackupWithOptions(serviceName, backup.BackupOptions{Trigger: trigger}); err != nil {
+		switch {
+		case !backup.IsJobRunning(err):
+			log.Printf("Error creating backup for service %s: %v", serviceName, err)
+		case d.config.Daemon.Overlap == config.OverlapQueue:
+			log.Printf("Waiting to back up service %s: %v", serviceName, err)
+		default:
+			log.Printf("Skipping %s backup of service %s: %v", triggerName(trigger), serviceName, err)
+		}
+		return err
+	}
+	log.Printf("Successfully completed backup for service: %s", serviceName)
+
+	// Clean up old backups
+	deletedCounts, err := d.manager.CleanupBackups(serviceName)
+	if err != nil {
+		log.Printf("Error cleaning up old backups for service %s: %v", serviceName, err)
+		return nil
+	}
+	if count := deletedCounts[serviceName]; count > 0 {
+		log.Printf("Cleaned up %d old backup(s) for service: %s", count, serviceName)
+	}
 	return nil
 }
 
+// triggerName describes a trigger in log messages
+func triggerName(trigger string) string {
+	switch trigger {
+	case backup.TriggerCron:
+		return "scheduled"
+	case backup.TriggerAPI:
+		return "API-requested"
+	}
+	return trigger
+}
+
 // Stop gracefully shuts down the daemon
 func (d *Daemon) Stop() {
 	log.Println("Stopping Packrat daemon...")
 	d.cancel()
+	d.queue.close()
+	d.stopAPI()
 	<-d.cron.Stop().Done()
 	d.wg.Wait()
+	d.removeStatus()
+	if d.logs != nil {
+		log.SetOutput(d.logs.out)
+	}
 	log.Println("Packrat daemon stopped")
 }
 
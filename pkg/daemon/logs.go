@@ -0,0 +1,49 @@
+package daemon
+
+import (
+	"io"
+	"sync"
+)
+
+// logBuffer is how many lines a slow subscriber can fall behind before lines are dropped
+const logBuffer = 256
+
+// logBroadcaster passes the daemon's log output on to subscribers, such as
+// CLI clients following a backup, as well as writing it out as usual
+type logBroadcaster struct {
+	out io.Writer
+
+	mu   sync.Mutex
+	subs map[chan string]struct{}
+}
+
+func newLogBroadcaster(out io.Writer) *logBroadcaster {
+	return &logBroadcaster{out: out, subs: make(map[chan string]struct{})}
+}
+
+// Write writes a log entry out and passes it to the subscribers. The log
+// package writes each entry with a single Write.
+func (b *logBroadcaster) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	for ch := range b.subs {
+		select {
+		case ch <- string(p):
+		default:
+		}
+	}
+	b.mu.Unlock()
+	return b.out.Write(p)
+}
+
+// subscribe returns a channel receiving log entries until unsubscribe is called
+func (b *logBroadcaster) subscribe() (<-chan string, func()) {
+	ch := make(chan string, logBuffer)
+	b.mu.Lock()
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+	return ch, func() {
+		b.mu.Lock()
+		delete(b.subs, ch)
+		b.mu.Unlock()
+	}
+}
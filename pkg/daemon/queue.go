@@ -0,0 +1,153 @@
+package daemon
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Job states
+const (
+	JobQueued  = "queued"
+	JobRunning = "running"
+)
+
+// Job is a backup waiting in the daemon's queue or running
+type Job struct {
+	Service  string     `json:"service"`
+	Priority int        `json:"priority,omitempty"`
+	State    string     `json:"state"`
+	Queued   time.Time  `json:"queued"`
+	Started  *time.Time `json:"started,omitempty"`
+
+	seq int // Queue order among jobs of the same priority
+}
+
+// jobQueue limits how many jobs run at once. Waiting jobs start in priority
+// order, and in the order they were queued within a priority.
+type jobQueue struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	limit   int // 0 for no limit
+	seq     int
+	closed  bool
+	waiting []*Job
+	running []*Job
+
+	// onChange is called with the queue's jobs whenever they change
+	onChange func([]Job)
+}
+
+func newJobQueue(limit int, onChange func([]Job)) *jobQueue {
+	q := &jobQueue{limit: limit, onChange: onChange}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// run waits for a turn and runs fn. It returns false without running fn if
+// ctx is done or the queue is closed first.
+func (q *jobQueue) run(ctx context.Context, service string, priority int, fn func()) bool {
+	q.mu.Lock()
+	q.seq++
+	job := &Job{Service: service, Priority: priority, State: JobQueued, Queued: time.Now().UTC(), seq: q.seq}
+	q.waiting = append(q.waiting, job)
+	sort.SliceStable(q.waiting, func(i, j int) bool {
+		if q.waiting[i].Priority != q.waiting[j].Priority {
+			return q.waiting[i].Priority > q.waiting[j].Priority
+		}
+		return q.waiting[i].seq < q.waiting[j].seq
+	})
+	waited := !q.canStart(job)
+	if waited {
+		log.Printf("Queued backup of service %s: %d job(s) running, %d waiting", service, len(q.running), len(q.waiting))
+	}
+	q.changed()
+
+	// Wake up the wait below if ctx is done while queued
+	stop := context.AfterFunc(ctx, func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		q.cond.Broadcast()
+	})
+	defer stop()
+
+	for !q.canStart(job) && !q.closed && ctx.Err() == nil {
+		q.cond.Wait()
+	}
+	q.waiting = remove(q.waiting, job)
+	if q.closed || ctx.Err() != nil {
+		q.changed()
+		q.cond.Broadcast()
+		q.mu.Unlock()
+		return false
+	}
+
+	started := time.Now().UTC()
+	job.State, job.Started = JobRunning, &started
+	if waited {
+		log.Printf("Backup of service %s waited %s in the queue", service, started.Sub(job.Queued).Round(time.Second))
+	}
+	q.running = append(q.running, job)
+	q.changed()
+	// The next job may be able to start too, if several slots came free at once
+	q.cond.Broadcast()
+	q.mu.Unlock()
+
+	defer func() {
+		q.mu.Lock()
+		q.running = remove(q.running, job)
+		q.changed()
+		q.cond.Broadcast()
+		q.mu.Unlock()
+	}()
+	fn()
+	return true
+}
+
+// canStart reports whether a waiting job is next and a slot is free
+func (q *jobQueue) canStart(job *Job) bool {
+	return q.waiting[0] == job && (q.limit <= 0 || len(q.running) < q.limit)
+}
+
+// close stops waiting jobs from starting
+func (q *jobQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+// jobs returns the running jobs followed by the waiting ones, in the order they start
+func (q *jobQueue) jobs() []Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.snapshot()
+}
+
+func (q *jobQueue) snapshot() []Job {
+	jobs := make([]Job, 0, len(q.running)+len(q.waiting))
+	for _, job := range q.running {
+		jobs = append(jobs, *job)
+	}
+	for _, job := range q.waiting {
+		jobs = append(jobs, *job)
+	}
+	return jobs
+}
+
+func (q *jobQueue) changed() {
+	if q.onChange != nil {
+		q.onChange(q.snapshot())
+	}
+}
+
+func remove(jobs []*Job, job *Job) []*Job {
+	for i, j := range jobs {
+		if j == job {
+			return append(jobs[:i], jobs[i+1:]...)
+		}
+	}
+	return jobs
+}
@@ -0,0 +1,226 @@
+package daemon
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitFor polls until cond holds, failing the test if it doesn't within a few seconds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// countJobs returns how many of the queue's jobs are in a state
+func countJobs(q *jobQueue, state string) int {
+	var n int
+	for _, job := range q.jobs() {
+		if job.State == state {
+			n++
+		}
+	}
+	return n
+}
+
+// startJob runs a job in the background that blocks until release is closed,
+// once the queue shows it as queued or running
+func startJob(t *testing.T, q *jobQueue, ctx context.Context, service string, priority int, release chan struct{}, order *[]string, mu *sync.Mutex) <-chan bool {
+	t.Helper()
+	before := len(q.jobs())
+	done := make(chan bool, 1)
+	go func() {
+		done <- q.run(ctx, service, priority, func() {
+			mu.Lock()
+			*order = append(*order, service)
+			mu.Unlock()
+			<-release
+		})
+	}()
+	waitFor(t, service+" to be queued", func() bool { return len(q.jobs()) > before })
+	return done
+}
+
+func TestJobQueueOrder(t *testing.T) {
+	q := newJobQueue(1, nil)
+	var mu sync.Mutex
+	var order []string
+
+	// The first job takes the only slot, so the others queue up behind it
+	blocker := make(chan struct{})
+	release := make(chan struct{})
+	close(release)
+	var done []<-chan bool
+	done = append(done, startJob(t, q, context.Background(), "blocker", 0, blocker, &order, &mu))
+	waitFor(t, "blocker to run", func() bool { return countJobs(q, JobRunning) == 1 })
+	for _, job := range []struct {
+		service  string
+		priority int
+	}{{"low-1", 0}, {"high-1", 5}, {"low-2", 0}, {"high-2", 5}, {"mid", 1}} {
+		done = append(done, startJob(t, q, context.Background(), job.service, job.priority, release, &order, &mu))
+	}
+
+	// Waiting jobs are listed in the order they will start
+	var listed []string
+	for _, job := range q.jobs() {
+		listed = append(listed, job.Service+" "+job.State)
+	}
+	want := []string{"blocker running", "high-1 queued", "high-2 queued", "mid queued", "low-1 queued", "low-2 queued"}
+	if !reflect.DeepEqual(listed, want) {
+		t.Errorf("jobs() = %q, want %q", listed, want)
+	}
+
+	close(blocker)
+	for _, d := range done {
+		if !<-d {
+			t.Error("Expected every job to run")
+		}
+	}
+	wantOrder := []string{"blocker", "high-1", "high-2", "mid", "low-1", "low-2"}
+	if !reflect.DeepEqual(order, wantOrder) {
+		t.Errorf("Jobs ran in order %q, want %q", order, wantOrder)
+	}
+	if jobs := q.jobs(); len(jobs) != 0 {
+		t.Errorf("Expected an empty queue, got %+v", jobs)
+	}
+}
+
+func TestJobQueueLimit(t *testing.T) {
+	for _, tt := range []struct {
+		limit       int
+		wantRunning int
+	}{
+		{limit: 2, wantRunning: 2},
+		{limit: 0, wantRunning: 5}, // No limit
+	} {
+		q := newJobQueue(tt.limit, nil)
+		var mu sync.Mutex
+		var order []string
+		release := make(chan struct{})
+
+		var done []<-chan bool
+		for _, service := range []string{"a", "b", "c", "d", "e"} {
+			done = append(done, startJob(t, q, context.Background(), service, 0, release, &order, &mu))
+		}
+		waitFor(t, "jobs to start", func() bool { return countJobs(q, JobRunning) == tt.wantRunning })
+
+		// No more start while the slots are taken
+		time.Sleep(10 * time.Millisecond)
+		if running, queued := countJobs(q, JobRunning), countJobs(q, JobQueued); running != tt.wantRunning || queued != 5-tt.wantRunning {
+			t.Errorf("limit %d: %d running and %d queued, want %d and %d", tt.limit, running, queued, tt.wantRunning, 5-tt.wantRunning)
+		}
+
+		close(release)
+		for _, d := range done {
+			if !<-d {
+				t.Errorf("limit %d: expected every job to run", tt.limit)
+			}
+		}
+		if len(order) != 5 {
+			t.Errorf("limit %d: %d jobs ran, want 5", tt.limit, len(order))
+		}
+	}
+}
+
+func TestJobQueueClose(t *testing.T) {
+	var changes int
+	q := newJobQueue(1, func([]Job) { changes++ })
+	var mu sync.Mutex
+	var order []string
+	release := make(chan struct{})
+
+	running := startJob(t, q, context.Background(), "running", 0, release, &order, &mu)
+	waitFor(t, "the first job to run", func() bool { return countJobs(q, JobRunning) == 1 })
+	waiting := startJob(t, q, context.Background(), "waiting", 0, release, &order, &mu)
+
+	// Closing the queue turns away waiting jobs, but lets running ones finish
+	q.close()
+	select {
+	case ran := <-waiting:
+		if ran {
+			t.Error("A waiting job ran after the queue was closed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("A waiting job was not released when the queue was closed")
+	}
+	close(release)
+	if !<-running {
+		t.Error("The running job was not reported as run")
+	}
+
+	if q.run(context.Background(), "late", 0, func() { t.Error("A job ran on a closed queue") }) {
+		t.Error("Expected run to fail on a closed queue")
+	}
+	if !reflect.DeepEqual(order, []string{"running"}) {
+		t.Errorf("Jobs ran: %q", order)
+	}
+	if jobs := q.jobs(); len(jobs) != 0 {
+		t.Errorf("Expected an empty queue, got %+v", jobs)
+	}
+	if changes == 0 {
+		t.Error("onChange was never called")
+	}
+}
+
+func TestJobQueueCancel(t *testing.T) {
+	q := newJobQueue(1, nil)
+	var mu sync.Mutex
+	var order []string
+	release := make(chan struct{})
+	defer close(release)
+
+	startJob(t, q, context.Background(), "running", 0, release, &order, &mu)
+	waitFor(t, "the first job to run", func() bool { return countJobs(q, JobRunning) == 1 })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	waiting := startJob(t, q, ctx, "waiting", 0, release, &order, &mu)
+	cancel()
+	select {
+	case ran := <-waiting:
+		if ran {
+			t.Error("A cancelled job ran")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("A waiting job was not released when its context was cancelled")
+	}
+	if queued := countJobs(q, JobQueued); queued != 0 {
+		t.Errorf("%d job(s) still queued after cancelling", queued)
+	}
+}
+
+func TestJobQueueSlotsFreedTogether(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		q := newJobQueue(2, nil)
+		var mu sync.Mutex
+		var order []string
+
+		// Two jobs hold both slots, with two more waiting behind them
+		first := make(chan struct{})
+		var done []<-chan bool
+		done = append(done, startJob(t, q, context.Background(), "a", 0, first, &order, &mu))
+		done = append(done, startJob(t, q, context.Background(), "b", 0, first, &order, &mu))
+		waitFor(t, "both slots to be taken", func() bool { return countJobs(q, JobRunning) == 2 })
+		second := make(chan struct{})
+		done = append(done, startJob(t, q, context.Background(), "c", 0, second, &order, &mu))
+		done = append(done, startJob(t, q, context.Background(), "d", 0, second, &order, &mu))
+
+		// Both finish at once, so both waiting jobs start without another one finishing
+		close(first)
+		waitFor(t, "both waiting jobs to start", func() bool { return countJobs(q, JobRunning) == 2 && countJobs(q, JobQueued) == 0 })
+
+		close(second)
+		for _, d := range done {
+			if !<-d {
+				t.Fatal("Expected every job to run")
+			}
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// statusFile is where a running daemon publishes its status, in the state directory
+const statusFile = "daemon.json"
+
+// ErrNotRunning is returned by ReadStatus when no daemon is running
+var ErrNotRunning = errors.New("the packrat daemon is not running")
+
+// Status is what a running daemon reports about itself
+type Status struct {
+	PID               int       `json:"pid"`
+	Started           time.Time `json:"started"`
+	MaxConcurrentJobs int       `json:"max_concurrent_jobs,omitempty"`
+	Jobs              []Job     `json:"jobs"` // Running jobs, then queued ones in the order they start
+}
+
+// ReadStatus reads the status of the daemon keeping its state in stateDir
+func ReadStatus(stateDir string) (*Status, error) {
+	data, err := os.ReadFile(filepath.Join(stateDir, statusFile))
+	if os.IsNotExist(err) {
+		return nil, ErrNotRunning
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read daemon status: %w", err)
+	}
+	var status Status
+	if err := json.Unmarshal(data, &status); err != nil {
+		return nil, fmt.Errorf("failed to parse daemon status: %w", err)
+	}
+
+	// A daemon that was killed leaves its status behind
+	if err := syscall.Kill(status.PID, 0); status.PID <= 0 || (err != nil && !errors.Is(err, syscall.EPERM)) {
+		return nil, ErrNotRunning
+	}
+	return &status, nil
+}
+
+// writeStatus publishes the daemon's status for packrat status
+func (d *Daemon) writeStatus(jobs []Job) {
+	if d.stateDir == "" {
+		return
+	}
+	status := Status{
+		PID:               os.Getpid(),
+		Started:           d.started,
+		MaxConcurrentJobs: d.config.Daemon.MaxConcurrentJobs,
+		Jobs:              jobs,
+	}
+	data, err := json.MarshalIndent(status, "", "  ")
+	if err == nil {
+		path := filepath.Join(d.stateDir, statusFile)
+		tmp := path + ".tmp"
+		if err = os.WriteFile(tmp, data, 0600); err == nil {
+			err = os.Rename(tmp, path)
+		}
+	}
+	if err != nil {
+		log.Printf("Warning: failed to write daemon status: %v", err)
+	}
+}
+
+// removeStatus removes the status file when the daemon stops
+func (d *Daemon) removeStatus() {
+	if d.stateDir == "" {
+		return
+	}
+	if err := os.Remove(filepath.Join(d.stateDir, statusFile)); err != nil && !os.IsNotExist(err) {
+		log.Printf("Warning: failed to remove daemon status: %v", err)
+	}
+}
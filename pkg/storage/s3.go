@@ -2,6 +2,7 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -12,6 +13,7 @@ import (
 	awsconfig "github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
 
 // S3Storage implements backup storage for S3-compatible services
@@ -111,6 +113,10 @@ func (s *S3Storage) Download(remoteName, localPath string) error {
 		Bucket: aws.String(s.config.Bucket),
 		Key:    aws.String(key),
 	})
+	var noSuchKey *types.NoSuchKey
+	if errors.As(err, &noSuchKey) {
+		return fmt.Errorf("failed to get object: %w: %w", os.ErrNotExist, err)
+	}
 	if err != nil {
 		return fmt.Errorf("failed to get object: %w", err)
 	}
@@ -5,7 +5,8 @@ type Storage interface {
 	// Upload uploads a file to the storage
 	Upload(localPath, remoteName string) error
 
-	// Download downloads a file from the storage
+	// Download downloads a file from the storage. The error matches
+	// os.ErrNotExist if the file doesn't exist.
 	Download(remoteName, localPath string) error
 
 	// List lists all backup files in the storage with the given prefix
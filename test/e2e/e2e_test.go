@@ -148,10 +148,11 @@ func TestE2E(t *testing.T) {
 	}
 
 	// List backups to verify
-	backups, err := manager.Synology.List("test-service")
+	files, err := manager.Synology.List("test-service")
 	if err != nil {
 		t.Fatalf("Failed to list backups: %v", err)
 	}
+	backups := backup.BackupFiles(files)
 	if len(backups) != 1 {
 		t.Fatalf("Expected 1 backup, got %d", len(backups))
 	}
@@ -196,11 +197,11 @@ func TestE2E(t *testing.T) {
 	t.Log("Waiting for scheduled backup...")
 	deadline := time.Now().Add(2 * time.Minute)
 	for time.Now().Before(deadline) {
-		backups, err := manager.Synology.List("test-service")
+		files, err := manager.Synology.List("test-service")
 		if err != nil {
 			t.Fatalf("Failed to list backups: %v", err)
 		}
-		if len(backups) > 1 {
+		if len(backup.BackupFiles(files)) > 1 {
 			t.Log("Daemon created a backup successfully")
 			break
 		}
@@ -225,12 +226,12 @@ func TestE2E(t *testing.T) {
 	}
 
 	// Verify all backups were deleted
-	backups, err = manager.Synology.List("test-service")
+	files, err = manager.Synology.List("test-service")
 	if err != nil {
 		t.Fatalf("Failed to list backups: %v", err)
 	}
-	if len(backups) != 0 {
-		t.Fatalf("Expected 0 backups after cleanup, got %d", len(backups))
+	if len(files) != 0 {
+		t.Fatalf("Expected 0 backups or manifests after cleanup, got %d", len(files))
 	}
 
 	t.Log("E2E test completed successfully")